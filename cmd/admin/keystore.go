@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto"
+)
+
+const passphraseEnv = "DECIDR_KEYSTORE_PASSPHRASE"
+
+// loadAdminKeypair unlocks the admin's static keypair from the keystore at path,
+// creating the keystore on first start. With rotate set, the stored keypair is
+// replaced by a new one before it is returned.
+func loadAdminKeypair(path string, rotate bool) (crypto.StaticKeypair, error) {
+	passphrase, err := readPassphrase()
+	if err != nil {
+		return crypto.StaticKeypair{}, err
+	}
+
+	keypair, created, err := crypto.OpenOrCreateKeystore(path, passphrase)
+	if err != nil {
+		return crypto.StaticKeypair{}, fmt.Errorf("open keystore %s: %w", path, err)
+	}
+	if created {
+		log.Println("Created new admin keystore at", path)
+	}
+
+	if rotate && !created {
+		if keypair, err = crypto.RotateKeystore(path, passphrase); err != nil {
+			return crypto.StaticKeypair{}, fmt.Errorf("rotate keystore %s: %w", path, err)
+		}
+		log.Println("Rotated admin key; voters must verify the new fingerprint")
+	}
+
+	return keypair, nil
+}
+
+// readPassphrase takes the keystore passphrase from the environment, falling
+// back to the first line of standard input.
+func readPassphrase() (string, error) {
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+
+	fmt.Fprint(os.Stderr, "Keystore passphrase: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("read passphrase: %w", err)
+	}
+
+	passphrase := strings.TrimRight(line, "\r\n")
+	if passphrase == "" {
+		return "", errors.New("keystore passphrase must not be empty")
+	}
+	return passphrase, nil
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"flag"
 	"log"
 	"net/http"
 
+	"github.com/Dsek-LTH/decidr/internal/crypto"
+	"github.com/Dsek-LTH/decidr/internal/crypto/handshake"
 	"github.com/Dsek-LTH/decidr/internal/routes"
 	"github.com/Dsek-LTH/decidr/internal/templates"
 )
@@ -21,17 +26,59 @@ func loggingMiddleWare(next http.Handler) http.Handler {
 }
 
 func main() {
+	keystorePath := flag.String("keystore", "admin.keystore", "path to the admin keystore")
+	rotateKey := flag.Bool("rotate-key", false, "replace the admin key before starting")
+	proxyURL := flag.String("proxy-url", "ws://localhost:8080", "proxy URL voters connect to")
+	adminID := flag.String("admin-id", "admin-1", "ID this admin registers with at the proxy")
+	metricsListen := flag.String(
+		"metrics-listen",
+		"127.0.0.1:9091",
+		"address /metrics is served on, apart from the one voters enrol on; "+
+			"empty to not serve metrics",
+	)
+	flag.Parse()
+
+	adminKeypair, err := loadAdminKeypair(*keystorePath, *rotateKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Admin public key:", base64.RawURLEncoding.EncodeToString(adminKeypair.Public))
+
+	signingKey, err := crypto.DeriveSigningKey(adminKeypair)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println(
+		"Admin signing key for the proxy allowlist:",
+		*adminID,
+		base64.RawURLEncoding.EncodeToString(signingKey.Public().(ed25519.PublicKey)),
+	)
+
 	templateRenderer := templates.NewTemplateRenderer()
 
 	mux := http.NewServeMux()
 
-	routes.RegisterRoutes(mux, templateRenderer)
+	routes.RegisterRoutes(mux, templateRenderer, handshake.Enrollment{
+		ProxyURL:       *proxyURL,
+		AdminID:        *adminID,
+		AdminPublicKey: adminKeypair.Public,
+	})
 
 	fs := http.FileServer(http.Dir("./web/static"))
 	mux.Handle("/static/", http.StripPrefix("/static/", fs))
 
-	logged := loggingMiddleWare(mux)
+	adminMetrics := newAdminMetrics()
+	if *metricsListen != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", adminMetrics.registry)
+		go func() {
+			log.Println("Metrics served on", *metricsListen)
+			log.Fatal(http.ListenAndServe(*metricsListen, metricsMux))
+		}()
+	}
+
+	logged := loggingMiddleWare(adminMetrics.middleware(mux))
 
-	log.Println("Server listening on :11337")
+	log.Println("Server listening on :11337, voters enrol at /enrol")
 	log.Fatal(http.ListenAndServe(":11337", logged))
 }
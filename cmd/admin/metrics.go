@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/metrics"
+)
+
+// adminMetrics is what the admin server serves at /metrics.
+type adminMetrics struct {
+	registry *metrics.Registry
+	requests *metrics.Counter
+	duration *metrics.Histogram
+}
+
+func newAdminMetrics() *adminMetrics {
+	registry := metrics.NewRegistry()
+	return &adminMetrics{
+		registry: registry,
+		requests: registry.Counter(
+			"decidr_admin_http_requests_total",
+			"HTTP requests by route and status code.",
+			"route",
+			"code",
+		),
+		duration: registry.Histogram(
+			"decidr_admin_http_request_duration_seconds",
+			"How long HTTP requests took to serve, by route.",
+			metrics.DefaultLatencyBuckets,
+			"route",
+		),
+	}
+}
+
+// statusRecorder remembers the status code a handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// middleware counts the requests served by next, which must be a ServeMux so
+// that requests are labelled by the pattern they matched rather than by
+// their path.
+func (m *adminMetrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		m.requests.Inc(route, strconv.Itoa(recorder.status))
+		m.duration.Observe(time.Since(start).Seconds(), route)
+	})
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -2,175 +2,174 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"fmt"
 	"log"
+	"net/url"
+	"strings"
 	"sync"
 
+	"github.com/Dsek-LTH/decidr/internal/crypto"
 	"github.com/Dsek-LTH/decidr/internal/crypto/handshake"
+	"github.com/Dsek-LTH/decidr/internal/envelope"
+	"github.com/Dsek-LTH/decidr/internal/transport"
 	"github.com/gorilla/websocket"
 )
 
+// demoPrologue binds both demo handshakes to the same meeting and routing IDs.
+func demoPrologue(adminID, clientID string) handshake.Prologue {
+	return handshake.Prologue{
+		MeetingID: "demo",
+		AdminID:   adminID,
+		ClientID:  clientID,
+	}
+}
+
 func main() {
 	var wg sync.WaitGroup
 	wg.Add(2)
 
+	// Stands in for the voter scanning the admin's enrolment QR code.
+	enrollmentURIs := make(chan string, 1)
+
 	go func() {
-		runAdmin()
+		runAdmin(enrollmentURIs)
 		wg.Done()
 	}()
 	go func() {
-		runClient()
+		runClient(enrollmentURIs)
 		wg.Done()
 	}()
 
 	wg.Wait()
 }
 
-func runClient() {
+func runClient(enrollmentURIs <-chan string) {
 	ctx := context.Background()
 
+	enrollment, err := handshake.ParseEnrollmentURI(<-enrollmentURIs)
+	if err != nil {
+		log.Fatal("[client] invalid enrollment:", err)
+	}
+	fmt.Println("[client] admin fingerprint:", strings.Join(enrollment.FingerprintWords(), " "))
+
 	conn, _, err := websocket.DefaultDialer.Dial(
-		"ws://localhost:8080/ws/client?id=client-1&admin=admin-1",
+		enrollment.ProxyURL+"/ws/client?admin="+url.QueryEscape(enrollment.AdminID),
 		nil,
 	)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer conn.Close()
-
-	transportPeer := handshake.NewFuncPeer(
-		func(b []byte) error {
-			return conn.WriteMessage(websocket.BinaryMessage, b)
-		},
-		func() ([]byte, error) {
-			_, msg, err := conn.ReadMessage()
-			return msg, err
-		},
-	)
 
-	send := func(b []byte) error {
-		return transportPeer.Send(ctx, b)
-	}
+	transportPeer := transport.NewWebSocketPeer(conn)
+	defer transportPeer.CloseWithCode(websocket.CloseNormalClosure, "")
 
-	receive := func() ([]byte, error) {
-		return transportPeer.Receive(ctx)
+	// The proxy assigns the client ID. A real client keeps the token to get
+	// the same ID back after reconnecting with ?token=.
+	session, err := handshake.ReceiveClientSession(ctx, transportPeer)
+	if err != nil {
+		log.Fatal("[client] no session:", err)
 	}
+	fmt.Println("[client] assigned client ID:", session.ID)
 
-	msg, _ := transportPeer.Receive(ctx)
-	clientEndpoint := handshake.GetClientEndpoint(msg)
+	adminPeer := envelope.NewPeer(transportPeer, enrollment.AdminID)
+	clientEndpoint := enrollment.ClientEndpoint()
 	fmt.Println("[client] client endpoint identity:", clientEndpoint.Identity)
 
-	sendCS, recvCS, _, err := handshake.Perform(
+	securePeer, err := handshake.Establish(
 		ctx,
-		send,
-		receive,
+		adminPeer.As(envelope.TypeHandshake),
 		clientEndpoint.Identity,
+		handshake.WithPrologue(demoPrologue(enrollment.AdminID, session.ID)),
+		handshake.WithHello(handshake.Hello{DisplayName: "client"}),
 	)
 	if err != nil {
 		log.Fatal("[client] handshake failed:", err)
 	} else {
-		fmt.Println("[client] handshake succeeded")
+		securePeer.SetTransport(adminPeer)
+		fmt.Println("[client] handshake succeeded with", securePeer.RemoteHello().DisplayName)
+		fmt.Println(
+			"[client] verification words:",
+			strings.Join(securePeer.VerificationWords(), " "),
+		)
 	}
 
-	securePeer := handshake.NewFuncPeer(
-		// Send: encrypt → transport
-		func(plaintext []byte) error {
-			ciphertext, err := sendCS.Encrypt(nil, nil, plaintext)
-			if err != nil {
-				return err
-			}
-			return transportPeer.Send(ctx, ciphertext)
-		},
-		// Receive: transport → decrypt
-		func() ([]byte, error) {
-			ciphertext, err := transportPeer.Receive(ctx)
-			if err != nil {
-				return nil, err
-			}
-			return recvCS.Decrypt(nil, nil, ciphertext)
-		},
-	)
-
 	// Send message
 	_ = securePeer.Send(ctx, []byte("hello admin"))
 	fmt.Println("[client] message sent: hello admin")
 
 	// Receive response
-	msg, _ = securePeer.Receive(ctx)
+	msg, _ := securePeer.Receive(ctx)
 	fmt.Println("[client] message received:", string(msg))
 }
 
-func runAdmin() {
+func runAdmin(enrollmentURIs chan<- string) {
 	ctx := context.Background()
 
+	// The proxy pins each admin ID to the first key that registers it, and the
+	// demo admin has a new key every run, so it needs a new ID as well.
+	adminID := "admin-" + rand.Text()[:8]
+
+	keypair, err := crypto.GenerateStaticKeypair()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	conn, _, err := websocket.DefaultDialer.Dial(
-		"ws://localhost:8080/ws/admin?id=admin-1",
+		"ws://localhost:8080/ws/admin?id="+url.QueryEscape(adminID),
 		nil,
 	)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer conn.Close()
-
-	transportPeer := handshake.NewFuncPeer(
-		func(b []byte) error {
-			return conn.WriteMessage(websocket.BinaryMessage, b)
-		},
-		func() ([]byte, error) {
-			_, msg, err := conn.ReadMessage()
-			return msg, err
-		},
-	)
 
-	send := func(b []byte) error {
-		return transportPeer.Send(ctx, append([]byte("client-1\n"), b...))
-	}
+	transportPeer := transport.NewWebSocketPeer(conn)
+	defer transportPeer.CloseWithCode(websocket.CloseNormalClosure, "")
 
-	receive := func() ([]byte, error) {
-		return transportPeer.Receive(ctx)
+	if err := handshake.RespondToChallenge(ctx, transportPeer, keypair, adminID); err != nil {
+		log.Fatal("[admin] registration failed:", err)
+	}
+	// The proxy confirms the registration with the clients already connected.
+	if _, err := waitForControl(ctx, transportPeer, envelope.ControlClientList); err != nil {
+		log.Fatal("[admin] registration not confirmed:", err)
 	}
+	fmt.Println("[admin] registered with the proxy as", adminID)
 
-	clientEndpoint, adminEndpoint, _ := handshake.NewAdminEndpoint()
+	clientEndpoint, adminEndpoint := handshake.NewAdminEndpointFromKeypair(keypair)
 	fmt.Println("[admin] client endpoint identity:", clientEndpoint.Identity)
 
-	if err := transportPeer.Send(
-		ctx,
-		append([]byte("client-1\n"), clientEndpoint.Identity.GetPublicKey()...),
-	); err != nil {
-		log.Fatal("[admin] failed to send public key to client:", err)
+	enrollmentURIs <- handshake.Enrollment{
+		ProxyURL:       "ws://localhost:8080",
+		AdminID:        adminID,
+		AdminPublicKey: clientEndpoint.Identity.GetPublicKey(),
+	}.URI()
+
+	joined, err := waitForControl(ctx, transportPeer, envelope.ControlClientConnected)
+	if err != nil {
+		log.Fatal("[admin] no client joined:", err)
 	}
+	clientID := joined.ClientIDs[0]
+	fmt.Println("[admin] client joined:", clientID)
+	clientPeer := envelope.NewPeer(transportPeer, clientID)
 
-	sendCS, recvCS, _, err := handshake.Perform(
+	securePeer, err := handshake.Establish(
 		ctx,
-		send,
-		receive,
+		clientPeer.As(envelope.TypeHandshake),
 		adminEndpoint.Identity,
+		handshake.WithPrologue(demoPrologue(adminID, clientID)),
+		handshake.WithHello(handshake.Hello{DisplayName: adminID}),
 	)
 	if err != nil {
 		log.Fatal("[admin] handshake failed:", err)
 	} else {
-		fmt.Println("[admin] handshake succeeded")
+		securePeer.SetTransport(clientPeer)
+		fmt.Println("[admin] handshake succeeded with", securePeer.RemoteHello().DisplayName)
+		fmt.Println(
+			"[admin] verification words:",
+			strings.Join(securePeer.VerificationWords(), " "),
+		)
 	}
 
-	securePeer := handshake.NewFuncPeer(
-		// Send: encrypt → transport
-		func(plaintext []byte) error {
-			ciphertext, err := sendCS.Encrypt(nil, nil, plaintext)
-			if err != nil {
-				return err
-			}
-			return transportPeer.Send(ctx, append([]byte("client-1\n"), ciphertext...))
-		},
-		// Receive: transport → decrypt
-		func() ([]byte, error) {
-			ciphertext, err := transportPeer.Receive(ctx)
-			if err != nil {
-				return nil, err
-			}
-			return recvCS.Decrypt(nil, nil, ciphertext)
-		},
-	)
-
 	// Receive message
 	msg, _ := securePeer.Receive(ctx)
 	fmt.Println("[admin] message received:", string(msg))
@@ -179,3 +178,29 @@ func runAdmin() {
 	_ = securePeer.Send(ctx, []byte("hello client"))
 	fmt.Println("[admin] message sent: hello client")
 }
+
+// waitForControl returns the next control envelope of the given kind from the
+// proxy, skipping any other frame.
+func waitForControl(
+	ctx context.Context,
+	transportPeer handshake.Peer,
+	kind envelope.ControlKind,
+) (envelope.Control, error) {
+	proxy := envelope.NewPeer(transportPeer, "")
+	for {
+		e, err := proxy.ReceiveEnvelope(ctx)
+		if err != nil {
+			return envelope.Control{}, err
+		}
+		if e.Type != envelope.TypeControl {
+			continue
+		}
+		control, err := e.Control()
+		if err != nil {
+			return envelope.Control{}, err
+		}
+		if control.Kind == kind {
+			return control, nil
+		}
+	}
+}
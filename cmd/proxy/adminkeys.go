@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto/handshake"
+)
+
+// loadAdminKeys reads the admin allowlist at path. Each non-empty line that
+// does not start with '#' holds an admin ID and its base64url signing key,
+// separated by whitespace.
+func loadAdminKeys(path string) (map[string]ed25519.PublicKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := make(map[string]ed25519.PublicKey)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 || !handshake.ValidAdminID(fields[0]) {
+			return nil, fmt.Errorf("%s:%d: expected an admin ID and a key", path, line)
+		}
+		key, err := base64.RawURLEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s:%d: invalid signing key", path, line)
+		}
+		keys[fields[0]] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// storedPin is how a pin is kept in the file of admin pins.
+type storedPin struct {
+	Key       string `json:"key"`
+	Confirmed bool   `json:"confirmed"`
+}
+
+// loadAdminPins reads the pins saveAdminPins saved at path, if there are any.
+func loadAdminPins(path string) (map[string]handshake.AdminPin, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stored map[string]storedPin
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	pins := make(map[string]handshake.AdminPin, len(stored))
+	for adminID, pin := range stored {
+		key, err := base64.RawURLEncoding.DecodeString(pin.Key)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s: invalid signing key for %q", path, adminID)
+		}
+		pins[adminID] = handshake.AdminPin{Key: key, Confirmed: pin.Confirmed}
+	}
+	return pins, nil
+}
+
+// saveAdminPins replaces the file at path with pins, as a JSON object keyed
+// by admin ID, so that a reader never sees half of it. JSON escapes the IDs,
+// so no ID can add an entry of its own or break the file.
+func saveAdminPins(path string, pins map[string]handshake.AdminPin) error {
+	stored := make(map[string]storedPin, len(pins))
+	for adminID, pin := range pins {
+		stored[adminID] = storedPin{
+			Key:       base64.RawURLEncoding.EncodeToString(pin.Key),
+			Confirmed: pin.Confirmed,
+		}
+	}
+	data, err := json.MarshalIndent(stored, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto/handshake"
+)
+
+func newSigningKey(t *testing.T) ed25519.PublicKey {
+	t.Helper()
+	key, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// newPin returns a pin of a new key.
+func newPin(t *testing.T, confirmed bool) handshake.AdminPin {
+	t.Helper()
+	return handshake.AdminPin{Key: newSigningKey(t), Confirmed: confirmed}
+}
+
+func TestAdminPinsRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.adminpins")
+	if pins, err := loadAdminPins(path); err != nil || pins != nil {
+		t.Fatalf("loading missing pins = %v, %v", pins, err)
+	}
+
+	// The registry refuses such IDs, but the file must not depend on it.
+	attacker := newSigningKey(t)
+	pins := map[string]handshake.AdminPin{
+		"admin-1": newPin(t, true),
+		"admin-1 " + base64.RawURLEncoding.EncodeToString(attacker) + "\nzz": {Key: attacker},
+		"admin-2\nadmin-1 key": newPin(t, false),
+		"# comment":            newPin(t, true),
+		"with space":           newPin(t, false),
+		"quote\" and \\":       newPin(t, true),
+		"\x00 ":                newPin(t, false),
+		"ordförande":           newPin(t, true),
+	}
+	if err := saveAdminPins(path, pins); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadAdminPins(path)
+	if err != nil {
+		t.Fatalf("loading saved pins: %v", err)
+	}
+	equal := func(a, b handshake.AdminPin) bool {
+		return a.Key.Equal(b.Key) && a.Confirmed == b.Confirmed
+	}
+	if !maps.EqualFunc(loaded, pins, equal) {
+		t.Fatalf("loaded %d pins, saved %d, or they differ", len(loaded), len(pins))
+	}
+}
+
+func TestLoadAdminPinsRejects(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		content string
+	}{
+		{"not json", "admin-1 AAAA\n"},
+		{"bad key", `{"admin-1": {"key": "not a key"}}`},
+		{"short key", `{"admin-1": {"key": "AAAA", "confirmed": true}}`},
+		{"no key", `{"admin-1": {"confirmed": true}}`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "proxy.adminpins")
+			if err := os.WriteFile(path, []byte(test.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadAdminPins(path); err == nil {
+				t.Fatal("loaded invalid pins")
+			}
+		})
+	}
+}
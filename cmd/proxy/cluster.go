@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/transport"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// clusterSendQueue is the send queue of a link to another instance,
+	// which carries the frames of many connections.
+	clusterSendQueue = 16 * transport.DefaultSendQueue
+
+	// clusterRetryInterval is how long to wait before dialling an instance
+	// again after its link failed.
+	clusterRetryInterval = 5 * time.Second
+)
+
+var clusterPeerOptions []transport.WebSocketOption
+
+// clusterHandler accepts a link from another instance of the cluster.
+func clusterHandler(w http.ResponseWriter, r *http.Request) {
+	address := remoteAddress(r)
+	if !limits.connections.Acquire(address) {
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+	defer limits.connections.Release(address)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	peer := transport.NewWebSocketPeer(conn, clusterPeerOptions...)
+	defer peer.CloseWithCode(websocket.CloseNormalClosure, "")
+	connections.add(peer)
+	defer connections.remove(peer)
+
+	err = cluster.AcceptNode(r.Context(), peer)
+	log.Println("cluster link from", address, "closed:", err)
+}
+
+// serveCluster serves /cluster on cluster-listen, apart from the public
+// listener, so that only the other instances can try to link to this one.
+func serveCluster(cfg config, tlsConfig *tls.Config) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cluster", clusterHandler)
+	server := &http.Server{
+		Addr:              cfg.clusterListen,
+		Handler:           mux,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: cfg.readHeaderTimeout,
+	}
+	go func() {
+		var err error
+		log.Println("Cluster links accepted on", cfg.clusterListen)
+		if tlsConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	return server
+}
+
+// linkClusterPeer keeps a link to the instance at url until ctx is done.
+func linkClusterPeer(ctx context.Context, url string) {
+	for {
+		conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+		if err == nil {
+			peer := transport.NewWebSocketPeer(conn, clusterPeerOptions...)
+			connections.add(peer)
+			log.Println("Linked to", url)
+			err = cluster.ConnectNode(ctx, peer)
+			connections.remove(peer)
+			_ = peer.CloseWithCode(websocket.CloseNormalClosure, "")
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("cluster link to", url, "closed:", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(clusterRetryInterval):
+		}
+	}
+}
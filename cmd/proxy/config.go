@@ -0,0 +1,520 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto/handshake"
+	"github.com/Dsek-LTH/decidr/internal/envelope"
+	"github.com/Dsek-LTH/decidr/internal/transport"
+)
+
+// envPrefix is prepended to a setting's name, upper-cased with dashes turned
+// into underscores, to get the environment variable that sets it, e.g.
+// DECIDR_PROXY_LISTEN for -listen.
+const envPrefix = "DECIDR_PROXY_"
+
+// config holds every proxy setting. Settings are read from a JSON config file,
+// then the environment, then the command line, each overriding the last.
+type config struct {
+	listen         string
+	metricsListen  string
+	allowedOrigins stringList
+
+	tlsCert       string
+	tlsKey        string
+	tlsSelfSigned bool
+
+	readBufferSize  int
+	writeBufferSize int
+	sendQueue       int
+	maxMessageSize  int
+
+	writeTimeout      time.Duration
+	readHeaderTimeout time.Duration
+	pingInterval      time.Duration
+	idleTimeout       time.Duration
+	shutdownTimeout   time.Duration
+
+	clientRate               float64
+	clientBurst              int
+	addressRate              float64
+	addressBurst             int
+	adminRate                float64
+	adminBurst               int
+	pinRate                  float64
+	pinBurst                 int
+	maxConnectionsPerAddress int
+
+	clusterNode   string
+	clusterListen string
+	clusterPeers  stringList
+
+	adminListen string
+
+	adminAllowlist string
+	adminPins      string
+	sessionKey     string
+}
+
+// stringList is a comma-separated flag value.
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = nil
+	for item := range strings.SplitSeq(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*list = append(*list, item)
+		}
+	}
+	return nil
+}
+
+func (cfg *config) bindFlags(flags *flag.FlagSet) {
+	flags.StringVar(&cfg.listen, "listen", ":8080", "address to listen on")
+	flags.StringVar(
+		&cfg.metricsListen,
+		"metrics-listen",
+		"127.0.0.1:9090",
+		"address /metrics is served on, apart from listen so that it is not public; "+
+			"empty to not serve metrics",
+	)
+	flags.Var(
+		&cfg.allowedOrigins,
+		"allowed-origins",
+		"comma-separated origins allowed to open WebSockets, or * for any; "+
+			"without it only same-origin requests are allowed",
+	)
+
+	flags.StringVar(&cfg.tlsCert, "tls-cert", "", "TLS certificate file, PEM")
+	flags.StringVar(&cfg.tlsKey, "tls-key", "", "TLS private key file, PEM")
+	flags.BoolVar(
+		&cfg.tlsSelfSigned,
+		"tls-self-signed",
+		false,
+		"serve TLS with a certificate generated at startup",
+	)
+
+	flags.IntVar(&cfg.readBufferSize, "read-buffer", 4096, "WebSocket read buffer size in bytes")
+	flags.IntVar(&cfg.writeBufferSize, "write-buffer", 4096, "WebSocket write buffer size in bytes")
+	flags.IntVar(
+		&cfg.sendQueue,
+		"send-queue",
+		transport.DefaultSendQueue,
+		"frames queued for a slow connection before senders get a busy error",
+	)
+	flags.IntVar(
+		&cfg.maxMessageSize,
+		"max-message-size",
+		handshake.DefaultMaxFrameSize,
+		"largest frame in bytes a connection may send",
+	)
+
+	flags.DurationVar(
+		&cfg.writeTimeout,
+		"write-timeout",
+		transport.DefaultWriteTimeout,
+		"how long a single write may take",
+	)
+	flags.DurationVar(
+		&cfg.readHeaderTimeout,
+		"read-header-timeout",
+		10*time.Second,
+		"how long a request's headers may take to arrive",
+	)
+	flags.DurationVar(
+		&cfg.pingInterval,
+		"ping-interval",
+		transport.DefaultPingInterval,
+		"how often connections are pinged",
+	)
+	flags.DurationVar(
+		&cfg.idleTimeout,
+		"idle-timeout",
+		transport.DefaultPongTimeout,
+		"how long a connection may stay silent, pongs included, before it is closed",
+	)
+	flags.DurationVar(
+		&cfg.shutdownTimeout,
+		"shutdown-timeout",
+		10*time.Second,
+		"how long to wait for queued frames to be written when shutting down",
+	)
+
+	flags.Float64Var(
+		&cfg.clientRate,
+		"client-rate",
+		20,
+		"frames per second each client may send, 0 for no limit",
+	)
+	flags.IntVar(&cfg.clientBurst, "client-burst", 40, "frames a client may send at once")
+	flags.Float64Var(
+		&cfg.addressRate,
+		"address-rate",
+		1000,
+		"frames per second all clients behind one IP address may send, 0 for no limit",
+	)
+	flags.IntVar(
+		&cfg.addressBurst,
+		"address-burst",
+		2000,
+		"frames the clients behind one IP address may send at once",
+	)
+	flags.Float64Var(
+		&cfg.adminRate,
+		"admin-rate",
+		500,
+		"frames per second each admin may send, 0 for no limit",
+	)
+	flags.IntVar(&cfg.adminBurst, "admin-burst", 1000, "frames an admin may send at once")
+	flags.Float64Var(
+		&cfg.pinRate,
+		"pin-rate",
+		1.0/60,
+		"admin IDs per second one IP address may pin without admin-allowlist, 0 for no limit",
+	)
+	flags.IntVar(&cfg.pinBurst, "pin-burst", 5, "admin IDs one IP address may pin at once")
+	flags.IntVar(
+		&cfg.maxConnectionsPerAddress,
+		"max-connections-per-address",
+		512,
+		"WebSockets one IP address may have open, 0 for no limit",
+	)
+
+	flags.StringVar(
+		&cfg.clusterNode,
+		"cluster-node",
+		"",
+		"name of this instance in a cluster of proxies sharing one session key; "+
+			"without it the proxy runs alone",
+	)
+	flags.StringVar(
+		&cfg.clusterListen,
+		"cluster-listen",
+		"",
+		"address /cluster is served on for the other instances to link to, "+
+			"apart from listen so that only they can reach it",
+	)
+	flags.Var(
+		&cfg.clusterPeers,
+		"cluster-peers",
+		"comma-separated /cluster URLs of the other instances to link to, "+
+			"e.g. wss://proxy-2.internal:8090/cluster",
+	)
+
+	flags.StringVar(
+		&cfg.adminListen,
+		"admin-listen",
+		"",
+		"unix:PATH or tcp:HOST:PORT where admins can connect without a WebSocket, "+
+			"e.g. from the same machine; each frame is prefixed by its length "+
+			"as a big-endian uint32 and the first one holds the admin's ID",
+	)
+
+	flags.StringVar(
+		&cfg.adminAllowlist,
+		"admin-allowlist",
+		"",
+		"file of admin IDs and signing keys allowed to register; "+
+			"without it each admin ID is pinned to the first key that registers it, "+
+			"which anyone may claim first; give it for elections that matter",
+	)
+	flags.StringVar(
+		&cfg.adminPins,
+		"admin-pins",
+		"proxy.adminpins",
+		"file the pinned admin keys are kept in across restarts, unless admin-allowlist is given",
+	)
+	flags.StringVar(
+		&cfg.sessionKey,
+		"session-key",
+		"proxy.sessionkey",
+		"file holding the key client resumption tokens are signed with, created if missing",
+	)
+}
+
+// loadConfig reads the settings from the config file named by -config or
+// DECIDR_PROXY_CONFIG, the environment and args, and validates them.
+func loadConfig(args []string) (config, error) {
+	var cfg config
+	flags := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	cfg.bindFlags(flags)
+	configPath := flags.String(
+		"config",
+		os.Getenv(envPrefix+"CONFIG"),
+		"JSON file of settings keyed by flag name",
+	)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage of proxy:")
+		flags.PrintDefaults()
+		fmt.Fprintf(
+			flags.Output(),
+			"\nSettings can also be set in the config file, or in the environment as\n"+
+				"%sLISTEN, %sALLOWED_ORIGINS and so on. Flags take precedence.\n",
+			envPrefix,
+			envPrefix,
+		)
+	}
+	if err := flags.Parse(args); err != nil {
+		return config{}, err
+	}
+
+	onCommandLine := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { onCommandLine[f.Name] = true })
+
+	if *configPath != "" {
+		if err := applyConfigFile(flags, *configPath, onCommandLine); err != nil {
+			return config{}, err
+		}
+	}
+	if err := applyEnv(flags, onCommandLine); err != nil {
+		return config{}, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return config{}, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+// applyConfigFile sets the flags named by the keys of the JSON object in path,
+// except those set on the command line. Lists may be given as JSON arrays.
+func applyConfigFile(flags *flag.FlagSet, path string, skip map[string]bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var settings map[string]any
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	for name, value := range settings {
+		if flags.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("config file %s: unknown setting %q", path, name)
+		}
+		if skip[name] {
+			continue
+		}
+
+		text := fmt.Sprint(value)
+		if list, ok := value.([]any); ok {
+			items := make([]string, len(list))
+			for i, item := range list {
+				items[i] = fmt.Sprint(item)
+			}
+			text = strings.Join(items, ",")
+		}
+		if err := flags.Set(name, text); err != nil {
+			return fmt.Errorf("config file %s: %s: %w", path, name, err)
+		}
+	}
+	return nil
+}
+
+// applyEnv sets the flags that have an environment variable, except those set
+// on the command line.
+func applyEnv(flags *flag.FlagSet, skip map[string]bool) error {
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || skip[f.Name] || f.Name == "config" {
+			return
+		}
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(name); ok {
+			if setErr := flags.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("%s: %w", name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// validate reports the first setting that cannot work.
+func (cfg *config) validate() error {
+	if _, _, err := net.SplitHostPort(cfg.listen); err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	if cfg.metricsListen != "" {
+		if _, _, err := net.SplitHostPort(cfg.metricsListen); err != nil {
+			return fmt.Errorf("metrics-listen: %w", err)
+		}
+	}
+	for _, origin := range cfg.allowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			return fmt.Errorf(
+				"allowed-origins: %q is not an origin like https://vote.example.org",
+				origin,
+			)
+		}
+	}
+
+	if (cfg.tlsCert == "") != (cfg.tlsKey == "") {
+		return errors.New("tls-cert and tls-key must be given together")
+	}
+	if cfg.tlsSelfSigned && cfg.tlsCert != "" {
+		return errors.New("tls-self-signed cannot be combined with tls-cert")
+	}
+
+	if cfg.readBufferSize < 0 || cfg.writeBufferSize < 0 {
+		return errors.New("read-buffer and write-buffer must not be negative")
+	}
+	if cfg.sendQueue < 1 {
+		return errors.New("send-queue must be at least 1")
+	}
+	if cfg.maxMessageSize <= envelope.MaxHeaderSize {
+		return fmt.Errorf(
+			"max-message-size must be larger than the %d byte envelope header",
+			envelope.MaxHeaderSize,
+		)
+	}
+
+	for _, timeout := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"write-timeout", cfg.writeTimeout},
+		{"read-header-timeout", cfg.readHeaderTimeout},
+		{"ping-interval", cfg.pingInterval},
+		{"idle-timeout", cfg.idleTimeout},
+		{"shutdown-timeout", cfg.shutdownTimeout},
+	} {
+		if timeout.value <= 0 {
+			return fmt.Errorf("%s must be positive", timeout.name)
+		}
+	}
+	for _, limit := range []struct {
+		name  string
+		rate  float64
+		burst int
+	}{
+		{"client", cfg.clientRate, cfg.clientBurst},
+		{"address", cfg.addressRate, cfg.addressBurst},
+		{"admin", cfg.adminRate, cfg.adminBurst},
+		{"pin", cfg.pinRate, cfg.pinBurst},
+	} {
+		if limit.rate < 0 {
+			return fmt.Errorf("%s-rate must not be negative", limit.name)
+		}
+		if limit.rate > 0 && limit.burst < 1 {
+			return fmt.Errorf("%s-burst must be at least 1", limit.name)
+		}
+	}
+	if cfg.maxConnectionsPerAddress < 0 {
+		return errors.New("max-connections-per-address must not be negative")
+	}
+
+	if (len(cfg.clusterPeers) > 0 || cfg.clusterListen != "") && cfg.clusterNode == "" {
+		return errors.New("cluster-peers and cluster-listen require cluster-node")
+	}
+	if cfg.clusterNode != "" {
+		if cfg.clusterListen == "" {
+			return errors.New("cluster-node requires cluster-listen")
+		}
+		if _, _, err := net.SplitHostPort(cfg.clusterListen); err != nil {
+			return fmt.Errorf("cluster-listen: %w", err)
+		}
+		if cfg.clusterListen == cfg.listen {
+			return errors.New("cluster-listen must not be listen, which is public")
+		}
+	}
+	if len(cfg.clusterNode) > envelope.MaxIDLength {
+		return errors.New("cluster-node is too long")
+	}
+	for _, peer := range cfg.clusterPeers {
+		u, err := url.Parse(peer)
+		if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			return fmt.Errorf("cluster-peers: %q is not a ws:// or wss:// URL", peer)
+		}
+	}
+
+	if cfg.adminListen != "" {
+		if _, _, err := cfg.adminListenAddress(); err != nil {
+			return err
+		}
+	}
+
+	if cfg.idleTimeout <= cfg.pingInterval {
+		return errors.New("idle-timeout must be longer than ping-interval")
+	}
+	return nil
+}
+
+// usesTLS reports whether the proxy serves wss:// rather than ws://.
+func (cfg *config) usesTLS() bool {
+	return cfg.tlsCert != "" || cfg.tlsSelfSigned
+}
+
+// checkOrigin returns the upgrader's origin check, or nil to keep the
+// default same-origin check.
+func (cfg *config) checkOrigin() func(*http.Request) bool {
+	if len(cfg.allowedOrigins) == 0 {
+		return nil
+	}
+	allowed := make(map[string]bool, len(cfg.allowedOrigins))
+	for _, origin := range cfg.allowedOrigins {
+		allowed[strings.ToLower(origin)] = true
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		// Non-browser clients send no origin.
+		return allowed["*"] || origin == "" || allowed[strings.ToLower(origin)]
+	}
+}
+
+// adminListenAddress splits admin-listen into a network and an address.
+func (cfg *config) adminListenAddress() (network, address string, err error) {
+	network, address, _ = strings.Cut(cfg.adminListen, ":")
+	if (network != "unix" && network != "tcp") || address == "" {
+		return "", "", fmt.Errorf(
+			"admin-listen: %q is not unix:PATH or tcp:HOST:PORT",
+			cfg.adminListen,
+		)
+	}
+	return network, address, nil
+}
+
+// peerOptions configures the WebSocket peers of all connections.
+func (cfg *config) peerOptions() []transport.WebSocketOption {
+	return []transport.WebSocketOption{
+		transport.WithSendQueue(cfg.sendQueue),
+		transport.WithWriteTimeout(cfg.writeTimeout),
+		transport.WithKeepalive(cfg.pingInterval, cfg.idleTimeout),
+		transport.WithReadLimit(int64(cfg.maxMessageSize)),
+	}
+}
+
+// sseOptions configures the peers of clients connected over SSE.
+func (cfg *config) sseOptions() []transport.SSEOption {
+	return []transport.SSEOption{
+		transport.WithSSESendQueue(cfg.sendQueue),
+		transport.WithSSEWriteTimeout(cfg.writeTimeout),
+		transport.WithSSEKeepalive(cfg.pingInterval),
+		transport.WithSSEMaxFrameSize(cfg.maxMessageSize),
+	}
+}
+
+// streamOptions configures the peers of admins connected to admin-listen.
+func (cfg *config) streamOptions() []transport.StreamOption {
+	return []transport.StreamOption{
+		transport.WithStreamSendQueue(cfg.sendQueue),
+		transport.WithMaxFrameSize(cfg.maxMessageSize),
+		transport.WithStreamWriteTimeout(cfg.writeTimeout),
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/transport"
+)
+
+// writeConfigFile writes a JSON config file and returns its path.
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "proxy.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `{"listen": ":1001", "send-queue": 11, "write-timeout": "1s"}`)
+
+	for _, test := range []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		queue int
+		want  string
+	}{
+		{"defaults", nil, nil, transport.DefaultSendQueue, ":8080"},
+		{"file", map[string]string{"DECIDR_PROXY_CONFIG": path}, nil, 11, ":1001"},
+		{
+			"env over file",
+			map[string]string{"DECIDR_PROXY_CONFIG": path, "DECIDR_PROXY_LISTEN": ":1002"},
+			nil,
+			11,
+			":1002",
+		},
+		{
+			"flag over env",
+			map[string]string{"DECIDR_PROXY_CONFIG": path, "DECIDR_PROXY_LISTEN": ":1002"},
+			[]string{"-listen", ":1003", "-send-queue", "13"},
+			13,
+			":1003",
+		},
+		{
+			"config flag",
+			map[string]string{"DECIDR_PROXY_SEND_QUEUE": "12"},
+			[]string{"-config", path},
+			12,
+			":1001",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			cfg, err := loadConfig(test.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.listen != test.want || cfg.sendQueue != test.queue {
+				t.Fatalf("listen %q and send-queue %d, want %q and %d",
+					cfg.listen, cfg.sendQueue, test.want, test.queue)
+			}
+		})
+	}
+}
+
+func TestLoadConfigLists(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"allowed-origins": ["https://a.example.org", "https://b.example.org"],
+		"cluster-node": "one",
+		"cluster-listen": "10.0.0.1:8090",
+		"cluster-peers": "ws://two:8090/cluster, ws://three:8090/cluster",
+		"read-header-timeout": "3s"
+	}`)
+
+	cfg, err := loadConfig([]string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	origins := []string{"https://a.example.org", "https://b.example.org"}
+	if !slices.Equal(cfg.allowedOrigins, origins) {
+		t.Fatalf("allowed-origins %q, want %q", cfg.allowedOrigins, origins)
+	}
+	peers := []string{"ws://two:8090/cluster", "ws://three:8090/cluster"}
+	if !slices.Equal(cfg.clusterPeers, peers) {
+		t.Fatalf("cluster-peers %q, want %q", cfg.clusterPeers, peers)
+	}
+	if cfg.readHeaderTimeout != 3*time.Second {
+		t.Fatalf("read-header-timeout %v, want 3s", cfg.readHeaderTimeout)
+	}
+
+	// A list set in the environment replaces the file's rather than adding
+	// to it.
+	t.Setenv("DECIDR_PROXY_ALLOWED_ORIGINS", "*")
+	cfg, err = loadConfig([]string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(cfg.allowedOrigins, []string{"*"}) {
+		t.Fatalf("allowed-origins %q, want only *", cfg.allowedOrigins)
+	}
+}
+
+func TestLoadConfigRejects(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"listen", []string{"-listen", "8080"}, "listen:"},
+		{"metrics listen", []string{"-metrics-listen", "localhost"}, "metrics-listen:"},
+		{"origin", []string{"-allowed-origins", "vote.example.org"}, "allowed-origins:"},
+		{"tls key", []string{"-tls-cert", "cert.pem"}, "tls-cert and tls-key"},
+		{
+			"tls both",
+			[]string{"-tls-self-signed", "-tls-cert", "cert.pem", "-tls-key", "key.pem"},
+			"tls-self-signed",
+		},
+		{"send queue", []string{"-send-queue", "0"}, "send-queue"},
+		{"message size", []string{"-max-message-size", "8"}, "max-message-size"},
+		{"write timeout", []string{"-write-timeout", "0s"}, "write-timeout"},
+		{"read header timeout", []string{"-read-header-timeout", "-1s"}, "read-header-timeout"},
+		{"idle timeout", []string{"-idle-timeout", "10s", "-ping-interval", "20s"}, "idle-timeout"},
+		{"rate", []string{"-client-rate", "-1"}, "client-rate"},
+		{"burst", []string{"-admin-rate", "5", "-admin-burst", "0"}, "admin-burst"},
+		{"pin burst", []string{"-pin-burst", "0"}, "pin-burst"},
+		{"connections", []string{"-max-connections-per-address", "-1"}, "max-connections"},
+		{"cluster node", []string{"-cluster-peers", "ws://two/cluster"}, "require cluster-node"},
+		{"cluster listen", []string{"-cluster-node", "one"}, "requires cluster-listen"},
+		{
+			"public cluster listen",
+			[]string{"-cluster-node", "one", "-cluster-listen", ":8080"},
+			"must not be listen",
+		},
+		{
+			"cluster peer",
+			[]string{
+				"-cluster-node", "one",
+				"-cluster-listen", ":8090",
+				"-cluster-peers", "http://two/cluster",
+			},
+			"cluster-peers:",
+		},
+		{"admin listen", []string{"-admin-listen", "/tmp/admin.sock"}, "admin-listen:"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadConfig(test.args)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("expected an error about %s, got %v", test.want, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileRejects(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"syntax", `{"listen": }`, "config file"},
+		{"unknown", `{"listne": ":8080"}`, `unknown setting "listne"`},
+		{"nested config", `{"config": "other.json"}`, `unknown setting "config"`},
+		{"value", `{"send-queue": "many"}`, "send-queue"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadConfig([]string{"-config", writeConfigFile(t, test.content)})
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("expected an error about %s, got %v", test.want, err)
+			}
+		})
+	}
+}
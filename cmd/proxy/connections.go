@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// trackedPeer is a WebSocketPeer, an SSEPeer or a StreamPeer.
+type trackedPeer interface {
+	CloseWithCode(code int, reason string) error
+	Queued() int
+}
+
+// connectionSet tracks the open WebSocket, SSE and stream peers so that they
+// can be closed properly when the proxy shuts down.
+type connectionSet struct {
+	peers  map[trackedPeer]struct{}
+	closed bool
+	code   int
+	reason string
+	mutex  sync.Mutex
+}
+
+func newConnectionSet() *connectionSet {
+	return &connectionSet{peers: make(map[trackedPeer]struct{})}
+}
+
+// add tracks peer. A peer added after closeAll started is closed right away.
+func (set *connectionSet) add(peer trackedPeer) {
+	set.mutex.Lock()
+	if set.closed {
+		set.mutex.Unlock()
+		_ = peer.CloseWithCode(set.code, set.reason)
+		return
+	}
+	set.peers[peer] = struct{}{}
+	set.mutex.Unlock()
+}
+
+func (set *connectionSet) remove(peer trackedPeer) {
+	set.mutex.Lock()
+	delete(set.peers, peer)
+	set.mutex.Unlock()
+}
+
+// closeAll closes every peer with code and reason once it has written the
+// frames queued for it. It returns when all peers are closed, or with the
+// context's error when ctx is done first.
+func (set *connectionSet) closeAll(ctx context.Context, code int, reason string) error {
+	set.mutex.Lock()
+	set.closed = true
+	set.code = code
+	set.reason = reason
+	peers := make([]trackedPeer, 0, len(set.peers))
+	for peer := range set.peers {
+		peers = append(peers, peer)
+	}
+	set.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Go(func() {
+			_ = peer.CloseWithCode(code, reason)
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (set *connectionSet) len() int {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	return len(set.peers)
+}
+
+// queued returns the number of frames waiting in the send queues of all
+// peers.
+func (set *connectionSet) queued() int {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	queued := 0
+	for peer := range set.peers {
+		queued += peer.Queued()
+	}
+	return queued
+}
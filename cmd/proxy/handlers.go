@@ -1,19 +1,44 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto/handshake"
+	"github.com/Dsek-LTH/decidr/internal/envelope"
+	"github.com/Dsek-LTH/decidr/internal/transport"
+	"github.com/gorilla/websocket"
 )
 
+// adminChallengeTimeout bounds how long a new admin connection may take to
+// answer the registration challenge.
+const adminChallengeTimeout = 10 * time.Second
+
+// clientHandler connects a client to the admin named by ?admin=. New clients
+// are assigned an ID by the router; a client that presents the resumption
+// token it was given with ?token= gets its ID back.
 func clientHandler(w http.ResponseWriter, r *http.Request) {
-	clientID := r.URL.Query().Get("id")
 	adminID := r.URL.Query().Get("admin")
-	log.Println("New client connection:", clientID, "->", adminID)
+	token := r.URL.Query().Get("token")
+
+	if adminID == "" {
+		http.Error(w, "missing admin", http.StatusBadRequest)
+		return
+	}
+	if !handshake.ValidAdminID(adminID) {
+		http.Error(w, "invalid admin id", http.StatusBadRequest)
+		return
+	}
 
-	if clientID == "" || adminID == "" {
-		http.Error(w, "missing id or admin", http.StatusBadRequest)
+	address := remoteAddress(r)
+	if !limits.connections.Acquire(address) {
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
 		return
 	}
+	defer limits.connections.Release(address)
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -21,22 +46,53 @@ func clientHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	peer := newWebSocketPeer(conn)
-	router.RegisterClient(clientID, peer)
-	defer router.RemoveClient(clientID)
-
 	ctx := r.Context()
 
+	peer := transport.NewWebSocketPeer(conn, peerOptions...)
+	defer peer.CloseWithCode(websocket.CloseNormalClosure, "")
+	connections.add(peer)
+	defer connections.remove(peer)
+
+	serveClient(ctx, peer, adminID, token, address)
+}
+
+// serveClient joins or resumes a client connected over peer from address and
+// routes its frames until it disconnects.
+func serveClient(ctx context.Context, peer handshake.Peer, adminID, token, address string) {
+	var session handshake.ClientSession
+	var err error
+	if token != "" {
+		session, err = router.ResumeClient(ctx, token, adminID, peer)
+		instruments.handshake("client_resume", err)
+	} else {
+		session, err = router.JoinClient(ctx, adminID, peer)
+		instruments.handshake("client_join", err)
+	}
+	if err != nil {
+		log.Println("register client:", err)
+		reportError(ctx, peer, "", nil, err, true)
+		return
+	}
+	defer router.LeaveClient(session)
+	clientID := session.ID
+	log.Println("New client connection:", clientID, "->", adminID)
+
 	for {
 		msg, err := peer.Receive(ctx)
 		if err != nil {
 			return
 		}
-		log.Println("client msg:", string(msg))
+
+		if err := limits.admitClientFrame(clientID, address); err != nil {
+			instruments.FrameRejected(handshake.ToAdmin, err)
+			reportError(ctx, peer, clientID, msg, err, false)
+			continue
+		}
 
 		// Forward client → admin
-		if err := router.RouteToAdmin(ctx, adminID, msg); err != nil {
+		if err := router.RouteFromClient(ctx, clientID, msg); err != nil {
 			log.Println("route error:", err)
+			reportError(ctx, peer, clientID, msg, err, false)
 		}
 	}
 }
@@ -47,45 +103,144 @@ func adminHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing admin id", http.StatusBadRequest)
 		return
 	}
+	if !handshake.ValidAdminID(adminID) {
+		http.Error(w, "invalid admin id", http.StatusBadRequest)
+		return
+	}
 	log.Println("New admin connection:", adminID)
 
+	address := remoteAddress(r)
+	if !limits.connections.Acquire(address) {
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+	defer limits.connections.Release(address)
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return
 	}
 	defer conn.Close()
 
-	peer := newWebSocketPeer(conn)
-	router.RegisterAdmin(adminID, peer)
-	defer router.RemoveAdmin(adminID)
-
 	ctx := r.Context()
 
+	peer := transport.NewWebSocketPeer(conn, peerOptions...)
+	defer peer.CloseWithCode(websocket.CloseNormalClosure, "")
+	connections.add(peer)
+	defer connections.remove(peer)
+
+	serveAdmin(ctx, peer, adminID, address)
+}
+
+// serveAdmin authenticates an admin connected over peer from address, which
+// is empty for a Unix socket, and routes its frames until it disconnects.
+func serveAdmin(ctx context.Context, peer handshake.Peer, adminID, address string) {
+	// Only the holder of the key bound to adminID may take over its routes.
+	err := limits.admitAdmin(adminID, address)
+	if err == nil {
+		challengeCtx, cancel := context.WithTimeout(ctx, adminChallengeTimeout)
+		err = handshake.AuthenticateAdmin(challengeCtx, peer, admins, adminID)
+		cancel()
+	}
+	instruments.handshake("admin_challenge", err)
+	if err != nil {
+		log.Println("authenticate admin:", adminID, err)
+		reportError(ctx, peer, adminID, nil, err, true)
+		return
+	}
+	defer admins.Release(adminID)
+
+	session := router.RegisterAdmin(adminID, peer)
+	defer router.LeaveAdmin(session)
+	if err := router.SendClientList(ctx, adminID); err != nil {
+		log.Println("send client list:", adminID, err)
+	}
+
 	for {
 		msg, err := peer.Receive(ctx)
 		if err != nil {
 			return
 		}
 
-		// Example protocol:
-		// "<client-id>\n<payload>"
-		clientID, payload := split(msg)
-		if clientID == "" {
+		if err := limits.admitAdminFrame(adminID); err != nil {
+			instruments.FrameRejected(handshake.ToClient, err)
+			reportError(ctx, peer, adminID, msg, err, false)
 			continue
 		}
-		log.Println("admin msg:", string(payload))
 
-		if err := router.RouteToClient(ctx, clientID, payload); err != nil {
+		// Forward admin → client named in the envelope destination
+		if err := router.RouteFromAdmin(ctx, adminID, msg); err != nil {
 			log.Println("route error:", err)
+			reportError(ctx, peer, adminID, msg, err, false)
 		}
 	}
 }
 
-func split(msg []byte) (string, []byte) {
-	for i, b := range msg {
-		if b == '\n' {
-			return string(msg[:i]), msg[i+1:]
+// reportError tells the sender of a rejected frame why it was not forwarded,
+// and which destination the frame was for if it can be decoded. With fatal
+// set, the sender is told that the connection is about to close.
+func reportError(
+	ctx context.Context,
+	peer handshake.Peer,
+	destination string,
+	rejected []byte,
+	err error,
+	fatal bool,
+) {
+	code := errorCode(err)
+	message := err.Error()
+	if code == envelope.CodeUnknownDestination {
+		message = code.String()
+	}
+
+	e := envelope.NewError(destination, code, message)
+	if rejected != nil {
+		if r, err := envelope.Unmarshal(rejected); err == nil {
+			e.Source = r.Destination
 		}
 	}
-	return "", nil
+	if fatal {
+		e.Flags |= envelope.FlagFatal
+	}
+	frame, err := e.Marshal()
+	if err != nil {
+		log.Println("encode error frame:", err)
+		return
+	}
+	if err := peer.Send(ctx, frame); err != nil {
+		log.Println("send error frame:", err)
+	}
+}
+
+// errorCode classifies an error from the router for the error frame sent back
+// and for the metrics.
+func errorCode(err error) envelope.ErrorCode {
+	switch {
+	case errors.Is(err, handshake.ErrInvalidAdminID):
+		return envelope.CodeMalformedFrame
+	case errors.Is(err, handshake.ErrForeignDestination),
+		errors.Is(err, handshake.ErrForbiddenControl),
+		errors.Is(err, handshake.ErrNotRegistered),
+		errors.Is(err, handshake.ErrChallengeFailed),
+		errors.Is(err, handshake.ErrAdminKeyMismatch),
+		errors.Is(err, handshake.ErrTooManyAdmins),
+		errors.Is(err, handshake.ErrUnknownSession),
+		errors.Is(err, handshake.ErrClientIDTaken):
+		return envelope.CodeForbidden
+	case errors.Is(err, handshake.ErrUnknownDestination),
+		errors.Is(err, handshake.ErrForeignClient):
+		// Clients of other admins look like unknown IDs, so an admin cannot
+		// probe which IDs exist elsewhere.
+		return envelope.CodeUnknownDestination
+	case errors.Is(err, transport.ErrQueueFull):
+		return envelope.CodeDestinationBusy
+	case errors.Is(err, handshake.ErrDestinationDisconnected):
+		return envelope.CodeDestinationDisconnected
+	case errors.Is(err, handshake.ErrPayloadTooLarge):
+		return envelope.CodePayloadTooLarge
+	case errors.Is(err, handshake.ErrRateLimited):
+		return envelope.CodeRateLimited
+	default:
+		return envelope.CodeFor(err)
+	}
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto/handshake"
+	"github.com/Dsek-LTH/decidr/internal/ratelimit"
+)
+
+// proxyLimits bounds how fast each sender may send frames, how many
+// connections each remote address may open and how fast it may pin admin IDs.
+type proxyLimits struct {
+	clientFrames *ratelimit.Limiter
+	adminFrames  *ratelimit.Limiter
+	adminPins    *ratelimit.Limiter
+	// addressFrames counts the frames of all clients behind one address.
+	// Admins are exempt so that voters sharing the admin's network cannot
+	// starve it.
+	addressFrames *ratelimit.Limiter
+	connections   *ratelimit.ConnectionLimiter
+}
+
+func newProxyLimits(cfg config) *proxyLimits {
+	return &proxyLimits{
+		clientFrames:  ratelimit.NewLimiter(cfg.clientRate, cfg.clientBurst),
+		adminFrames:   ratelimit.NewLimiter(cfg.adminRate, cfg.adminBurst),
+		adminPins:     ratelimit.NewLimiter(cfg.pinRate, cfg.pinBurst),
+		addressFrames: ratelimit.NewLimiter(cfg.addressRate, cfg.addressBurst),
+		connections:   ratelimit.NewConnectionLimiter(cfg.maxConnectionsPerAddress),
+	}
+}
+
+// admitClientFrame checks a frame from clientID, connected from address,
+// against the client's and the address's limits.
+func (limits *proxyLimits) admitClientFrame(clientID, address string) error {
+	if !limits.clientFrames.Allow(clientID) {
+		return fmt.Errorf("%w: too many frames from this client", handshake.ErrRateLimited)
+	}
+	if !limits.addressFrames.Allow(address) {
+		return fmt.Errorf("%w: too many frames from this address", handshake.ErrRateLimited)
+	}
+	return nil
+}
+
+// admitAdminFrame checks a frame from adminID against the admin limit.
+func (limits *proxyLimits) admitAdminFrame(adminID string) error {
+	if !limits.adminFrames.Allow(adminID) {
+		return fmt.Errorf("%w: too many frames from this admin", handshake.ErrRateLimited)
+	}
+	return nil
+}
+
+// admitAdmin checks an admin connecting from address as adminID against the
+// limit on new pins, unless adminID is pinned already. Admins connected over
+// a Unix socket have no address and are not limited.
+func (limits *proxyLimits) admitAdmin(adminID, address string) error {
+	if address == "" || admins.Pinned(adminID) || limits.adminPins.Allow(address) {
+		return nil
+	}
+	return fmt.Errorf("%w: too many new admin ids from this address", handshake.ErrRateLimited)
+}
+
+// remoteAddress is the IP address a request came from.
+func remoteAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
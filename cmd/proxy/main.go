@@ -1,22 +1,232 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/Dsek-LTH/decidr/internal/crypto/handshake"
+	"github.com/Dsek-LTH/decidr/internal/transport"
 	"github.com/gorilla/websocket"
 )
 
+// restartRetryAfter is how long clients are told to wait before reconnecting
+// when the proxy shuts down.
+const restartRetryAfter = 5 * time.Second
+
 var (
-	router   = handshake.NewRouter()
-	upgrader = websocket.Upgrader{}
+	router      handshake.Router = handshake.NewMemoryRouter()
+	cluster     *handshake.ClusterRouter
+	admins      = handshake.NewAdminRegistry()
+	connections = newConnectionSet()
+	limits      = newProxyLimits(config{})
+	instruments = newProxyMetrics()
+	upgrader    = websocket.Upgrader{}
+	peerOptions []transport.WebSocketOption
 )
 
 func main() {
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.adminAllowlist != "" {
+		keys, err := loadAdminKeys(cfg.adminAllowlist)
+		if err != nil {
+			log.Fatal(err)
+		}
+		admins = handshake.NewAdminAllowlist(keys)
+		log.Println("Loaded", len(keys), "admins from", cfg.adminAllowlist)
+	} else {
+		pins, err := loadAdminPins(cfg.adminPins)
+		if err != nil {
+			log.Fatal(err)
+		}
+		admins = handshake.NewAdminRegistry(
+			handshake.WithPins(pins),
+			handshake.WithPinsChanged(func(pins map[string]handshake.AdminPin) {
+				if err := saveAdminPins(cfg.adminPins, pins); err != nil {
+					log.Println("save admin pins:", err)
+				}
+			}),
+		)
+	}
+
+	sessionKey, err := loadSessionKey(cfg.sessionKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	routerOptions := []handshake.RouterOption{
+		handshake.WithSessionKey(sessionKey),
+		handshake.WithMaxFrameSize(cfg.maxMessageSize),
+		handshake.WithObserver(instruments),
+	}
+	if cfg.clusterNode != "" {
+		cluster = handshake.NewClusterRouter(
+			cfg.clusterNode,
+			append(routerOptions, handshake.WithAdminRegistry(admins))...,
+		)
+		router = cluster
+	} else {
+		router = handshake.NewMemoryRouter(routerOptions...)
+	}
+	upgrader = websocket.Upgrader{
+		ReadBufferSize:  cfg.readBufferSize,
+		WriteBufferSize: cfg.writeBufferSize,
+		CheckOrigin:     cfg.checkOrigin(),
+	}
+	peerOptions = append(cfg.peerOptions(), transport.WithObserver(instruments))
+	clusterPeerOptions = append(
+		cfg.peerOptions(),
+		transport.WithSendQueue(clusterSendQueue),
+		transport.WithReadLimit(int64(cfg.maxMessageSize+handshake.ClusterFrameOverhead)),
+	)
+	streamOptions = append(cfg.streamOptions(), transport.WithStreamObserver(instruments))
+	sseSessions = transport.NewSSESessions(
+		append(cfg.sseOptions(), transport.WithSSEObserver(instruments))...,
+	)
+	limits = newProxyLimits(cfg)
+
+	tlsConfig, err := loadTLSConfig(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	http.HandleFunc("/ws/client", clientHandler)
 	http.HandleFunc("/ws/admin", adminHandler)
+	http.HandleFunc("GET /sse/client", sseClientHandler)
+	http.HandleFunc("POST /sse/client", sseUpstreamHandler)
+	http.HandleFunc("OPTIONS /sse/client", sseUpstreamHandler)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if cluster != nil {
+		clusterServer := serveCluster(cfg, tlsConfig)
+		defer clusterServer.Close()
+		for _, peerURL := range cfg.clusterPeers {
+			go linkClusterPeer(ctx, peerURL)
+		}
+		log.Println("Running as cluster node", cfg.clusterNode)
+	}
+
+	if cfg.adminListen != "" {
+		network, address, _ := cfg.adminListenAddress()
+		listener, err := listenAdminStreams(ctx, network, address)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Admins may also connect to", cfg.adminListen)
+		go serveAdminStreams(ctx, listener)
+	}
+
+	if cfg.metricsListen != "" {
+		metricsServer := serveMetrics(cfg)
+		defer metricsServer.Close()
+	}
+
+	server := &http.Server{
+		Addr:              cfg.listen,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: cfg.readHeaderTimeout,
+	}
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			log.Println("Proxy server listening on", cfg.listen, "with TLS")
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			log.Println("Proxy server listening on", cfg.listen)
+			err = server.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	log.Println("Shutting down, press Ctrl+C again to exit immediately")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
+	defer cancel()
+
+	// Stop accepting connections first, then tell every connection to come
+	// back later. Clients resume their sessions with the tokens they hold.
+	// SSE streams are requests the server waits for, so they are closed while
+	// it does.
+	reason := fmt.Sprintf("server restarting, retry in %s", restartRetryAfter)
+	closed := make(chan error, 1)
+	server.RegisterOnShutdown(func() {
+		closed <- connections.closeAll(shutdownCtx, websocket.CloseServiceRestart, reason)
+	})
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println("shutdown:", err)
+	}
+	if err := <-closed; err != nil {
+		log.Println("close connections:", err)
+	}
+}
+
+// serveMetrics serves /metrics on metrics-listen, apart from the public
+// listener, as anyone able to scrape it could watch how the proxy is used.
+func serveMetrics(cfg config) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", instruments.registry)
+	server := &http.Server{
+		Addr:              cfg.metricsListen,
+		Handler:           mux,
+		ReadHeaderTimeout: cfg.readHeaderTimeout,
+	}
+	go func() {
+		log.Println("Metrics served on", cfg.metricsListen)
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	return server
+}
+
+// loadTLSConfig returns the TLS settings the proxy serves with, or nil when
+// it serves plain HTTP.
+func loadTLSConfig(cfg config) (*tls.Config, error) {
+	if !cfg.usesTLS() {
+		return nil, nil
+	}
+
+	var certificate tls.Certificate
+	if cfg.tlsSelfSigned {
+		host, _, _ := net.SplitHostPort(cfg.listen)
+		var fingerprint string
+		var err error
+		certificate, fingerprint, err = selfSignedCertificate(host)
+		if err != nil {
+			return nil, fmt.Errorf("generate self-signed certificate: %w", err)
+		}
+		log.Println("Generated self-signed certificate, SHA-256 fingerprint:", fingerprint)
+	} else {
+		var err error
+		certificate, err = tls.LoadX509KeyPair(cfg.tlsCert, cfg.tlsKey)
+		if err != nil {
+			return nil, fmt.Errorf("load TLS certificate: %w", err)
+		}
+	}
 
-	log.Println("Proxy server listening on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
 }
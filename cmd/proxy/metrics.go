@@ -0,0 +1,142 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto/handshake"
+	"github.com/Dsek-LTH/decidr/internal/metrics"
+	"github.com/Dsek-LTH/decidr/internal/transport"
+)
+
+// proxyMetrics is what the proxy serves at /metrics. It observes the router
+// and every WebSocket, SSE and stream peer; the gauges are read from them when
+// scraped.
+type proxyMetrics struct {
+	registry *metrics.Registry
+
+	frames       *metrics.Counter
+	bytes        *metrics.Counter
+	routeErrors  *metrics.Counter
+	handshakes   *metrics.Counter
+	queueWait    *metrics.Histogram
+	writeLatency *metrics.Histogram
+}
+
+var (
+	_ handshake.RouterObserver = (*proxyMetrics)(nil)
+	_ transport.PeerObserver   = (*proxyMetrics)(nil)
+)
+
+func newProxyMetrics() *proxyMetrics {
+	registry := metrics.NewRegistry()
+	m := &proxyMetrics{
+		registry: registry,
+		frames: registry.Counter(
+			"decidr_proxy_frames_routed_total",
+			"Frames sent or queued to a destination.",
+			"direction",
+		),
+		bytes: registry.Counter(
+			"decidr_proxy_bytes_routed_total",
+			"Bytes of the frames sent or queued to a destination.",
+			"direction",
+		),
+		routeErrors: registry.Counter(
+			"decidr_proxy_routing_errors_total",
+			"Frames from admins and clients that were not routed, by error code.",
+			"direction",
+			"kind",
+		),
+		handshakes: registry.Counter(
+			"decidr_proxy_handshakes_total",
+			"Admin registrations and client joins and resumptions.",
+			"kind",
+			"result",
+		),
+		queueWait: registry.Histogram(
+			"decidr_proxy_send_queue_wait_seconds",
+			"How long frames waited in a connection's send queue.",
+			metrics.DefaultLatencyBuckets,
+		),
+		writeLatency: registry.Histogram(
+			"decidr_proxy_write_duration_seconds",
+			"How long writing a frame to a WebSocket, SSE stream or admin stream took.",
+			metrics.DefaultLatencyBuckets,
+		),
+	}
+
+	registry.GaugeFunc(
+		"decidr_proxy_admins_connected",
+		"Admins connected now.",
+		func() float64 { return float64(router.Gauges().Admins) },
+	)
+	registry.GaugeFunc(
+		"decidr_proxy_clients_connected",
+		"Clients connected now.",
+		func() float64 { return float64(router.Gauges().Clients) },
+	)
+	registry.GaugeFunc(
+		"decidr_proxy_connections_open",
+		"WebSocket, SSE and admin stream connections open now, including those still registering.",
+		func() float64 { return float64(connections.len()) },
+	)
+	registry.GaugeFunc(
+		"decidr_proxy_router_queued_frames",
+		"Frames held for destinations that disconnected.",
+		func() float64 { return float64(router.Gauges().QueuedFrames) },
+	)
+	registry.GaugeFunc(
+		"decidr_proxy_send_queued_frames",
+		"Frames waiting in the send queues of all connections.",
+		func() float64 { return float64(connections.queued()) },
+	)
+	registry.GaugeFunc(
+		"decidr_proxy_cluster_nodes",
+		"Other cluster instances this one is linked to.",
+		func() float64 {
+			if cluster == nil {
+				return 0
+			}
+			return float64(len(cluster.Nodes()))
+		},
+	)
+	registry.CounterFunc(
+		"decidr_proxy_router_flushed_total",
+		"Queued frames delivered after their destination reconnected.",
+		func() float64 { return float64(router.Stats().Flushed) },
+	)
+	registry.CounterFunc(
+		"decidr_proxy_router_dropped_expired_total",
+		"Queued frames dropped because their destination stayed away too long.",
+		func() float64 { return float64(router.Stats().DroppedExpired) },
+	)
+	registry.CounterFunc(
+		"decidr_proxy_router_dropped_full_total",
+		"Frames dropped because their absent destination's queue was full.",
+		func() float64 { return float64(router.Stats().DroppedFull) },
+	)
+	return m
+}
+
+func (m *proxyMetrics) FrameRouted(direction handshake.Direction, size int) {
+	m.frames.Inc(direction.String())
+	m.bytes.Add(float64(size), direction.String())
+}
+
+func (m *proxyMetrics) FrameRejected(direction handshake.Direction, err error) {
+	m.routeErrors.Inc(direction.String(), errorCode(err).String())
+}
+
+func (m *proxyMetrics) FrameWritten(_ int, queued, write time.Duration) {
+	m.queueWait.Observe(queued.Seconds())
+	m.writeLatency.Observe(write.Seconds())
+}
+
+// handshake counts a registration of the given kind, failed unless err is nil.
+func (m *proxyMetrics) handshake(kind string, err error) {
+	result := "ok"
+	if err != nil {
+		result = "failed"
+	}
+	m.handshakes.Inc(kind, result)
+}
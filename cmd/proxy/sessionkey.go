@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto/handshake"
+)
+
+// loadSessionKey reads the key resumption tokens are signed with from path,
+// creating it on first start. Keeping the key across restarts lets clients
+// reclaim their IDs from the restarted proxy.
+func loadSessionKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		key = make([]byte, handshake.SessionKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, key, 0o600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != handshake.SessionKeySize {
+		return nil, fmt.Errorf(
+			"session key %s must be %d bytes, got %d",
+			path,
+			handshake.SessionKeySize,
+			len(key),
+		)
+	}
+	return key, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto/handshake"
+	"github.com/Dsek-LTH/decidr/internal/transport"
+	"github.com/gorilla/websocket"
+)
+
+var sseSessions = transport.NewSSESessions()
+
+// sseClientHandler connects a client that cannot open a WebSocket, with the
+// same query as clientHandler. Frames reach the client as Server-Sent Events
+// and the client posts its own to sseUpstreamHandler.
+func sseClientHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowOrigin(w, r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	adminID := r.URL.Query().Get("admin")
+	token := r.URL.Query().Get("token")
+	if adminID == "" {
+		http.Error(w, "missing admin", http.StatusBadRequest)
+		return
+	}
+	if !handshake.ValidAdminID(adminID) {
+		http.Error(w, "invalid admin id", http.StatusBadRequest)
+		return
+	}
+
+	address := remoteAddress(r)
+	if !limits.connections.Acquire(address) {
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+	defer limits.connections.Release(address)
+
+	peer, err := sseSessions.Open(w, r)
+	if err != nil {
+		return
+	}
+	defer peer.CloseWithCode(websocket.CloseNormalClosure, "")
+	connections.add(peer)
+	defer connections.remove(peer)
+
+	serveClient(r.Context(), peer, adminID, token, address)
+}
+
+// sseUpstreamHandler takes the frames SSE clients post, and answers the
+// preflight requests browsers send before posting cross-origin.
+func sseUpstreamHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowOrigin(w, r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	sseSessions.ServeHTTP(w, r)
+}
+
+// allowOrigin applies the origin check WebSockets get to SSE requests, and
+// lets the browser read the answer to an allowed cross-origin request.
+func allowOrigin(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	check := upgrader.CheckOrigin
+	if check == nil {
+		check = sameOrigin
+	}
+	if !check(r) {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Add("Vary", "Origin")
+	return true
+}
+
+// sameOrigin is the WebSocket upgrader's default origin check.
+func sameOrigin(r *http.Request) bool {
+	u, err := url.Parse(r.Header.Get("Origin"))
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
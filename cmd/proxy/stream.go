@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto/handshake"
+	"github.com/Dsek-LTH/decidr/internal/transport"
+)
+
+// acceptRetryInterval is how long to wait after accepting a connection
+// failed, e.g. because the process ran out of file descriptors.
+const acceptRetryInterval = 100 * time.Millisecond
+
+var streamOptions []transport.StreamOption
+
+// listenAdminStreams opens the listener admins connect to without a
+// WebSocket. A Unix socket left behind by a proxy that did not shut down
+// cleanly is replaced.
+func listenAdminStreams(ctx context.Context, network, address string) (net.Listener, error) {
+	if network == "unix" {
+		if err := removeStaleSocket(ctx, address); err != nil {
+			return nil, err
+		}
+	}
+	var listenConfig net.ListenConfig
+	return listenConfig.Listen(ctx, network, address)
+}
+
+// removeStaleSocket removes the Unix socket at path unless something still
+// accepts connections on it.
+func removeStaleSocket(ctx context.Context, path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	var dialer net.Dialer
+	if conn, err := dialer.DialContext(ctx, "unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	return os.Remove(path)
+}
+
+// serveAdminStreams accepts admins on listener until ctx is done. The admins
+// already connected stay until the proxy closes them with the other
+// connections when it shuts down.
+func serveAdminStreams(ctx context.Context, listener net.Listener) {
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+	connCtx := context.WithoutCancel(ctx)
+
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Println("accept admin stream:", err)
+			time.Sleep(acceptRetryInterval)
+			continue
+		}
+		go streamAdminHandler(connCtx, conn)
+	}
+}
+
+// streamAdminHandler serves an admin connected to admin-listen. Its first
+// frame holds its ID, which WebSocket admins give with ?id=.
+func streamAdminHandler(ctx context.Context, conn net.Conn) {
+	// Connections over a Unix socket come from this machine and are not
+	// limited.
+	var address string
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		address = addr.IP.String()
+		if !limits.connections.Acquire(address) {
+			conn.Close()
+			return
+		}
+		defer limits.connections.Release(address)
+	}
+
+	peer := transport.NewStreamPeer(conn, streamOptions...)
+	defer peer.Close("")
+	connections.add(peer)
+	defer connections.remove(peer)
+
+	helloCtx, cancel := context.WithTimeout(ctx, adminChallengeTimeout)
+	id, err := peer.Receive(helloCtx)
+	cancel()
+	if err != nil {
+		log.Println("admin stream closed before sending its id:", err)
+		return
+	}
+	adminID := string(id)
+	if !handshake.ValidAdminID(adminID) {
+		err := fmt.Errorf("%w: %q", handshake.ErrInvalidAdminID, adminID)
+		reportError(ctx, peer, "", nil, err, true)
+		return
+	}
+	log.Println("New admin stream connection:", adminID)
+
+	serveAdmin(ctx, peer, adminID, address)
+}
@@ -0,0 +1,230 @@
+package handshake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto"
+	"github.com/flynn/noise"
+)
+
+// ErrDecryptionFailed is matched by every DecryptionError returned from a SecureChannel.
+var ErrDecryptionFailed = errors.New("handshake: decryption failed")
+
+// ErrInvalidRecord is returned when a message decrypts correctly but does not
+// contain a record this implementation understands.
+var ErrInvalidRecord = errors.New("handshake: invalid record")
+
+// DecryptionError reports a ciphertext that could not be authenticated by the
+// receiving cipher state, typically because it was corrupted, replayed or
+// reordered by the transport.
+type DecryptionError struct {
+	// Nonce is the receive nonce the ciphertext was expected to use.
+	Nonce uint64
+	Err   error
+}
+
+func (e *DecryptionError) Error() string {
+	return fmt.Sprintf("handshake: decrypt message with nonce %d: %v", e.Nonce, e.Err)
+}
+
+func (e *DecryptionError) Unwrap() []error { return []error{ErrDecryptionFailed, e.Err} }
+
+// Every plaintext sent over a SecureChannel starts with one of these record types.
+const (
+	recordData byte = iota
+	recordRekey
+)
+
+// SecureChannel is a Peer that encrypts outbound and decrypts inbound messages
+// using the cipher states produced by a completed handshake.
+//
+// Send and Receive may be called concurrently; concurrent calls to Send are
+// serialised so that the order on the transport matches the nonce order.
+type SecureChannel struct {
+	transport      Peer
+	transportMutex sync.RWMutex
+
+	sendMutex       sync.Mutex
+	sendCipherState *noise.CipherState
+	sendEpoch       uint32
+	rekey           rekeySchedule
+
+	receiveMutex       sync.Mutex
+	receiveCipherState *noise.CipherState
+
+	// explicitReceiver is set when the session uses explicit nonces.
+	explicitReceiver *explicitReceiver
+
+	channelBinding  []byte
+	peerStatic      []byte
+	remoteHello     Hello
+	protocolVersion uint16
+}
+
+// NewSecureChannel wraps transport with the cipher states returned by Perform.
+// The channel takes ownership of both cipher states; they must not be used
+// directly afterwards.
+//
+// Channels created this way only rekey when their peer asks for it; use
+// Establish to negotiate a rekey schedule.
+func NewSecureChannel(
+	transport Peer,
+	sendCipherState *noise.CipherState,
+	receiveCipherState *noise.CipherState,
+	handshakeState *noise.HandshakeState,
+) *SecureChannel {
+	return &SecureChannel{
+		transport:          transport,
+		sendCipherState:    sendCipherState,
+		rekey:              newRekeySchedule(RekeyPolicy{}, time.Now),
+		receiveCipherState: receiveCipherState,
+		channelBinding:     handshakeState.ChannelBinding(),
+		peerStatic:         handshakeState.PeerStatic(),
+		protocolVersion:    ProtocolVersion,
+	}
+}
+
+// Send encrypts plaintext and writes it to the underlying transport, rekeying
+// first if the negotiated schedule says so.
+func (c *SecureChannel) Send(ctx context.Context, plaintext []byte) error {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	if c.rekey.due() {
+		// With implicit nonces the rekey record is the last message encrypted
+		// with the old key; with explicit nonces the epoch in the header signals it.
+		if c.explicitReceiver == nil {
+			if err := c.sendRecord(ctx, recordRekey, nil); err != nil {
+				return err
+			}
+		} else {
+			c.sendEpoch++
+		}
+		c.sendCipherState.Rekey()
+		c.rekey.reset()
+	}
+
+	if err := c.sendRecord(ctx, recordData, plaintext); err != nil {
+		return err
+	}
+	c.rekey.sent++
+	return nil
+}
+
+func (c *SecureChannel) sendRecord(ctx context.Context, recordType byte, body []byte) error {
+	nonce := c.sendCipherState.Nonce()
+	if nonce >= maxSendNonce {
+		return ErrNonceExhausted
+	}
+
+	var header []byte
+	if c.explicitReceiver != nil {
+		header = appendExplicitHeader(nil, c.sendEpoch, nonce)
+	}
+
+	record := append([]byte{recordType}, body...)
+	ciphertext, err := c.sendCipherState.Encrypt(nil, header, record)
+	if err != nil {
+		return fmt.Errorf("handshake: encrypt: %w", err)
+	}
+
+	return c.currentTransport().Send(ctx, append(header, ciphertext...))
+}
+
+// Receive reads the next message from the underlying transport and decrypts it.
+// Messages that fail authentication are reported as a *DecryptionError.
+//
+// With explicit nonces, a *DecryptionError, ErrReplayed or ErrInvalidFrame
+// only affects the offending frame and the caller may keep receiving.
+func (c *SecureChannel) Receive(ctx context.Context) ([]byte, error) {
+	c.receiveMutex.Lock()
+	defer c.receiveMutex.Unlock()
+
+	for {
+		frame, err := c.currentTransport().Receive(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		record, err := c.open(frame)
+		if err != nil {
+			return nil, err
+		}
+		if len(record) == 0 {
+			return nil, ErrInvalidRecord
+		}
+
+		switch {
+		case record[0] == recordData:
+			return record[1:], nil
+		case record[0] == recordRekey && c.explicitReceiver == nil:
+			c.receiveCipherState.Rekey()
+		default:
+			return nil, fmt.Errorf("%w: unexpected type %d", ErrInvalidRecord, record[0])
+		}
+	}
+}
+
+func (c *SecureChannel) open(frame []byte) ([]byte, error) {
+	if c.explicitReceiver != nil {
+		return c.explicitReceiver.open(frame)
+	}
+
+	nonce := c.receiveCipherState.Nonce()
+	record, err := c.receiveCipherState.Decrypt(nil, nil, frame)
+	if err != nil {
+		return nil, &DecryptionError{Nonce: nonce, Err: err}
+	}
+	return record, nil
+}
+
+// SetTransport replaces the transport the channel runs over, e.g. after
+// reconnecting on a new socket. Without explicit nonces this only works if no
+// message was lost or duplicated in between. A Receive already blocked on the
+// old transport keeps waiting on it.
+func (c *SecureChannel) SetTransport(transport Peer) {
+	c.transportMutex.Lock()
+	defer c.transportMutex.Unlock()
+	c.transport = transport
+}
+
+func (c *SecureChannel) currentTransport() Peer {
+	c.transportMutex.RLock()
+	defer c.transportMutex.RUnlock()
+	return c.transport
+}
+
+// ChannelBinding returns the handshake hash that uniquely identifies this session.
+func (c *SecureChannel) ChannelBinding() []byte { return c.channelBinding }
+
+// VerificationWords returns the words both parties compare aloud to confirm
+// they share this session. They are derived from the channel binding, so they
+// differ for every handshake, even between the same keys.
+func (c *SecureChannel) VerificationWords() []string {
+	return crypto.GetSessionVerificationWords(
+		c.channelBinding,
+		crypto.SessionVerificationWordCount,
+	)
+}
+
+// PeerStatic returns the static public key of the remote party, if the
+// handshake pattern transmitted or pre-shared one.
+func (c *SecureChannel) PeerStatic() []byte { return c.peerStatic }
+
+// RemoteHello returns the payload the peer announced during the handshake.
+// It is only populated for channels created by Establish.
+func (c *SecureChannel) RemoteHello() Hello { return c.remoteHello }
+
+// ProtocolVersion returns the highest protocol version both parties support.
+func (c *SecureChannel) ProtocolVersion() uint16 { return c.protocolVersion }
+
+// RekeyPolicy returns the rekey schedule this channel applies to its own sends.
+func (c *SecureChannel) RekeyPolicy() RekeyPolicy {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	return c.rekey.policy
+}
@@ -0,0 +1,178 @@
+package handshake
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto"
+)
+
+func establishPair(
+	ctx context.Context,
+	t *testing.T,
+	clientTransport, adminTransport Peer,
+	clientIdentity, adminIdentity handshakeIdentity,
+) (client, admin *SecureChannel) {
+	t.Helper()
+
+	type result struct {
+		channel *SecureChannel
+		err     error
+	}
+
+	clientCh := make(chan result, 1)
+	adminCh := make(chan result, 1)
+
+	go func() {
+		channel, err := Establish(ctx, clientTransport, clientIdentity)
+		clientCh <- result{channel, err}
+	}()
+	go func() {
+		channel, err := Establish(ctx, adminTransport, adminIdentity)
+		adminCh <- result{channel, err}
+	}()
+
+	clientRes, adminRes := <-clientCh, <-adminCh
+	if clientRes.err != nil || adminRes.err != nil {
+		t.Fatalf("Establish failed: client=%v, admin=%v", clientRes.err, adminRes.err)
+	}
+
+	return clientRes.channel, adminRes.channel
+}
+
+func TestSecureChannelRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	clientSide, adminSide := newInMemoryPeers()
+	clientIdentity, adminIdentity := getIdentityPair(t)
+	client, admin := establishPair(ctx, t, clientSide, adminSide, clientIdentity, adminIdentity)
+
+	if !bytes.Equal(client.ChannelBinding(), admin.ChannelBinding()) {
+		t.Fatal("channel bindings do not match")
+	}
+	if !bytes.Equal(client.PeerStatic(), adminIdentity.GetPublicKey()) {
+		t.Fatal("client does not see the admin static key")
+	}
+
+	for _, plaintext := range []string{"secret vote cast", "", "second message"} {
+		go func() { _ = client.Send(ctx, []byte(plaintext)) }()
+
+		received, err := admin.Receive(ctx)
+		if err != nil {
+			t.Fatalf("admin receive: %v", err)
+		}
+		if string(received) != plaintext {
+			t.Fatalf("got %q, want %q", received, plaintext)
+		}
+	}
+
+	go func() { _ = admin.Send(ctx, []byte("confirmation: received")) }()
+
+	received, err := client.Receive(ctx)
+	if err != nil {
+		t.Fatalf("client receive: %v", err)
+	}
+	if string(received) != "confirmation: received" {
+		t.Fatalf("got %q", received)
+	}
+}
+
+func TestSecureChannelConcurrentSends(t *testing.T) {
+	const n = 50
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientSide, adminSide := newInMemoryPeers()
+	clientIdentity, adminIdentity := getIdentityPair(t)
+	client, admin := establishPair(ctx, t, clientSide, adminSide, clientIdentity, adminIdentity)
+
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Go(func() {
+			if err := client.Send(ctx, fmt.Appendf(nil, "message %d", i)); err != nil {
+				t.Errorf("send %d: %v", i, err)
+			}
+		})
+	}
+
+	seen := make(map[string]bool, n)
+	for range n {
+		msg, err := admin.Receive(ctx)
+		if err != nil {
+			t.Fatalf("receive: %v", err)
+		}
+		seen[string(msg)] = true
+	}
+	wg.Wait()
+
+	if len(seen) != n {
+		t.Fatalf("received %d distinct messages, want %d", len(seen), n)
+	}
+}
+
+func TestSecureChannelDecryptionError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	clientSide, adminSide := newInMemoryPeers()
+	clientIdentity, adminIdentity := getIdentityPair(t)
+	_, admin := establishPair(ctx, t, clientSide, adminSide, clientIdentity, adminIdentity)
+
+	go func() { _ = clientSide.Send(ctx, []byte("not a valid ciphertext")) }()
+
+	_, err := admin.Receive(ctx)
+	if !errors.Is(err, ErrDecryptionFailed) {
+		t.Fatalf("expected ErrDecryptionFailed, got %v", err)
+	}
+
+	var decryptionErr *DecryptionError
+	if !errors.As(err, &decryptionErr) {
+		t.Fatalf("expected *DecryptionError, got %T", err)
+	}
+	if decryptionErr.Nonce != 0 {
+		t.Fatalf("expected nonce 0, got %d", decryptionErr.Nonce)
+	}
+}
+
+func TestSecureChannelVerificationWords(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	clientIdentity, adminIdentity := getIdentityPair(t)
+
+	clientSide, adminSide := newInMemoryPeers()
+	client, admin := establishPair(ctx, t, clientSide, adminSide, clientIdentity, adminIdentity)
+
+	clientWords := client.VerificationWords()
+	if len(clientWords) != crypto.SessionVerificationWordCount {
+		t.Fatalf("got %d words, want %d", len(clientWords), crypto.SessionVerificationWordCount)
+	}
+	if !slices.Equal(clientWords, admin.VerificationWords()) {
+		t.Fatalf("verification words differ:\nclient: %v\nadmin:  %v",
+			clientWords, admin.VerificationWords())
+	}
+
+	// A second session between the same keys must yield different words,
+	// otherwise the words would only vouch for the keys and not the session.
+	clientSide, adminSide = newInMemoryPeers()
+	again, _ := establishPair(ctx, t, clientSide, adminSide, clientIdentity, adminIdentity)
+	if slices.Equal(clientWords, again.VerificationWords()) {
+		t.Fatal("verification words repeat across sessions")
+	}
+
+	keyWords := crypto.GetVerificationWords(
+		client.ChannelBinding(),
+		crypto.SessionVerificationWordCount,
+	)
+	if slices.Equal(clientWords, keyWords) {
+		t.Fatal("session words are not domain separated from the raw channel binding")
+	}
+}
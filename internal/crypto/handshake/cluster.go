@@ -0,0 +1,754 @@
+package handshake
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/envelope"
+)
+
+// ClusterFrameOverhead is the most a cluster link adds to a forwarded frame.
+// Links must accept frames of the router's maximum frame size plus this.
+const ClusterFrameOverhead = 3 + 2*(2+envelope.MaxIDLength) + clusterSealSize
+
+const (
+	// clusterNonceSize is the size of the challenge each end of a link sends.
+	clusterNonceSize = 32
+
+	// clusterSealSize is what is appended to each message after the
+	// handshake: its sequence number and its MAC under the link key.
+	clusterSealSize = 8 + sha256.Size
+
+	// clusterAuthTimeout bounds how long the two ends of a new link may take
+	// to prove that they hold the cluster key.
+	clusterAuthTimeout = 10 * time.Second
+
+	// maxForwardHops is how often a frame may be forwarded between nodes
+	// before it is dropped. A frame normally takes one hop; a second one is
+	// needed when the destination moved before the sender heard about it.
+	maxForwardHops = 3
+
+	// clusterLinkDomain separates link proofs and keys from resumption
+	// tokens, which are signed with the same key.
+	clusterLinkDomain = "decidr cluster link v2\x00"
+)
+
+// Labels of the MACs over a link transcript, which separate the proofs of
+// the two ends from each other and from the link key.
+const (
+	linkDialerProof   = "dialer proof\x00"
+	linkAcceptorProof = "acceptor proof\x00"
+	linkKeyLabel      = "link key\x00"
+)
+
+var (
+	// ErrClusterAuth is returned when the other end of a link does not prove
+	// that it holds the session key of this node.
+	ErrClusterAuth = errors.New("handshake: cluster link authentication failed")
+
+	// ErrDuplicateLink is returned for a link to a node this node is already
+	// linked to, when the existing link is kept.
+	ErrDuplicateLink = errors.New("handshake: already linked to node")
+
+	// ErrLinkReplaced is returned for a link that was replaced by a newer
+	// link to the same node.
+	ErrLinkReplaced = errors.New("handshake: link replaced")
+
+	// ErrNodeUnreachable is returned when a frame is forwarded to a node this
+	// node has no link to.
+	ErrNodeUnreachable = errors.New("handshake: cluster node unreachable")
+
+	errMalformedClusterMessage = errors.New("handshake: malformed cluster message")
+	errForwardLoop             = errors.New("handshake: frame forwarded too often")
+)
+
+// ClusterRouter is a Router for one of several proxy instances, or nodes.
+// Each node tells the others which admins and clients are connected to it and
+// forwards frames for them over a link to the node holding their peer, so an
+// admin and its clients may connect to any node.
+//
+// Every node must be linked to every other, with ConnectNode on one end and
+// AcceptNode on the other, and all nodes must share the session key (see
+// WithSessionKey), which both authenticates links and lets clients resume
+// their sessions on any node. Each link derives its own key from it, with
+// which every message on the link is authenticated. Nodes that authenticate
+// their admins must pass their AdminRegistry with WithAdminRegistry, so that
+// an admin ID bound to a key on one node cannot be taken over on another.
+// Errors are only reported for the first hop: a frame forwarded to another
+// node that cannot deliver it is dropped, unless it is queued there.
+type ClusterRouter struct {
+	*MemoryRouter
+	node string
+
+	links      map[string]*clusterLink
+	linksMutex sync.Mutex
+
+	// remotes records which node each remote route was announced by, and
+	// serializes changes to remote routes.
+	remotes      map[remoteKey]remoteRoute
+	remotesMutex sync.Mutex
+}
+
+var _ Router = (*ClusterRouter)(nil)
+
+type remoteKey struct {
+	table *routingTable
+	id    string
+}
+
+type remoteRoute struct {
+	node       string
+	generation uint64
+	// pinned is set for admins that hold their pin in the admin registry
+	// until the route is forgotten.
+	pinned bool
+}
+
+// clusterLink is a connection to another node.
+type clusterLink struct {
+	node string
+	peer Peer
+	// dialed is set on the end that dialled the link.
+	dialed bool
+	// canonical links were dialled by the node with the smaller name. When
+	// two nodes dial each other at once, both keep the canonical link.
+	canonical bool
+	cancel    context.CancelCauseFunc
+
+	// key authenticates the messages on the link (see seal).
+	key []byte
+	// sent numbers the messages sent, and sendMutex keeps them in the
+	// order they are numbered in.
+	sent      uint64
+	sendMutex sync.Mutex
+	// received is the number of the last message received. It is only used
+	// by the loop receiving them.
+	received uint64
+}
+
+// WithAdminRegistry makes a ClusterRouter announce its admins to the other
+// nodes with the keys registry binds to them, and refuse the admins other
+// nodes announce with a key that registry does not accept. A MemoryRouter
+// does not use it.
+func WithAdminRegistry(registry *AdminRegistry) RouterOption {
+	return func(router *MemoryRouter) {
+		router.adminRegistry = registry
+	}
+}
+
+// NewClusterRouter returns the router of the node called node, which must be
+// unique in the cluster.
+func NewClusterRouter(node string, options ...RouterOption) *ClusterRouter {
+	cluster := &ClusterRouter{
+		MemoryRouter: NewMemoryRouter(options...),
+		node:         node,
+		links:        make(map[string]*clusterLink),
+		remotes:      make(map[remoteKey]remoteRoute),
+	}
+	cluster.hooks = routerHooks{
+		registered: cluster.announce,
+		removed:    cluster.withdraw,
+	}
+	return cluster
+}
+
+// Nodes returns the sorted names of the nodes this node is linked to.
+func (cluster *ClusterRouter) Nodes() []string {
+	cluster.linksMutex.Lock()
+	defer cluster.linksMutex.Unlock()
+
+	nodes := make([]string, 0, len(cluster.links))
+	for node := range cluster.links {
+		nodes = append(nodes, node)
+	}
+	slices.Sort(nodes)
+	return nodes
+}
+
+// JoinClient is MemoryRouter.JoinClient, except that the admin may be one
+// this node has not heard of yet; frames for it are queued until it is
+// announced.
+func (cluster *ClusterRouter) JoinClient(
+	ctx context.Context,
+	adminID string,
+	peer Peer,
+) (ClientSession, error) {
+	cluster.expect(cluster.admins, adminID)
+	return cluster.MemoryRouter.JoinClient(ctx, adminID, peer)
+}
+
+// ResumeClient is MemoryRouter.ResumeClient, except that the admin may be one
+// this node has not heard of yet, like in JoinClient.
+func (cluster *ClusterRouter) ResumeClient(
+	ctx context.Context,
+	token, adminID string,
+	peer Peer,
+) (ClientSession, error) {
+	cluster.expect(cluster.admins, adminID)
+	return cluster.MemoryRouter.ResumeClient(ctx, token, adminID, peer)
+}
+
+// expect adds an absent route for id unless there is one, so that frames for
+// id are queued rather than rejected as for an unknown destination. A client
+// may join an admin that registered on another node a moment ago. Like any
+// absent route, it is forgotten if id is not announced within the queue TTL.
+func (cluster *ClusterRouter) expect(table *routingTable, id string) {
+	table.routesMutex.Lock()
+	defer table.routesMutex.Unlock()
+
+	if _, ok := table.routes[id]; !ok {
+		table.routes[id] = &route{left: cluster.now()}
+	}
+}
+
+// ConnectNode runs a link over peer, a connection this node dialled to
+// another node. It returns when the link fails, ctx is done or the link is
+// replaced, with the reason.
+func (cluster *ClusterRouter) ConnectNode(ctx context.Context, peer Peer) error {
+	return cluster.serveLink(ctx, peer, true)
+}
+
+// AcceptNode runs a link over peer, a connection another node dialled to
+// this one. It returns like ConnectNode.
+func (cluster *ClusterRouter) AcceptNode(ctx context.Context, peer Peer) error {
+	return cluster.serveLink(ctx, peer, false)
+}
+
+func (cluster *ClusterRouter) serveLink(ctx context.Context, peer Peer, dialed bool) error {
+	authCtx, cancel := context.WithTimeout(ctx, clusterAuthTimeout)
+	node, key, err := cluster.authenticateLink(authCtx, peer, dialed)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	linkCtx, cancelLink := context.WithCancelCause(ctx)
+	defer cancelLink(nil)
+	link := &clusterLink{
+		node:      node,
+		peer:      peer,
+		dialed:    dialed,
+		canonical: (cluster.node < node) == dialed,
+		cancel:    cancelLink,
+		key:       key,
+	}
+	if err := cluster.addLink(link); err != nil {
+		return err
+	}
+	defer cluster.removeLink(link)
+
+	for {
+		frame, err := peer.Receive(linkCtx)
+		if err != nil {
+			if cause := context.Cause(linkCtx); cause != nil {
+				return cause
+			}
+			return err
+		}
+		message, err := link.open(frame)
+		if err != nil {
+			return err
+		}
+		cluster.handle(linkCtx, link, message)
+	}
+}
+
+// authenticateLink exchanges node names and nonces with the other end of a
+// link, proves to each other that both hold the session key and returns the
+// other node's name and the key of the link. Both proofs and the key cover
+// both names and both nonces in the order of dialler and acceptor, so a node
+// without the session key can neither relay the proofs between two other
+// links nor reflect one back.
+func (cluster *ClusterRouter) authenticateLink(
+	ctx context.Context,
+	peer Peer,
+	dialed bool,
+) (string, []byte, error) {
+	nonce := make([]byte, clusterNonceSize)
+	// crypto/rand.Read never fails.
+	_, _ = rand.Read(nonce)
+	hello := clusterMessage{kind: clusterHello, id: cluster.node, data: nonce}
+	if err := peer.Send(ctx, hello.marshal()); err != nil {
+		return "", nil, err
+	}
+	theirs, err := receiveClusterMessage(ctx, peer, clusterHello)
+	if err != nil {
+		return "", nil, err
+	}
+	if theirs.id == "" || theirs.id == cluster.node || len(theirs.data) != clusterNonceSize {
+		return "", nil, fmt.Errorf("%w: bad hello", ErrClusterAuth)
+	}
+
+	ours, expected := linkDialerProof, linkAcceptorProof
+	transcript := linkTranscript(cluster.node, theirs.id, nonce, theirs.data)
+	if !dialed {
+		ours, expected = expected, ours
+		transcript = linkTranscript(theirs.id, cluster.node, theirs.data, nonce)
+	}
+
+	proof := clusterMessage{kind: clusterProof, data: cluster.linkMAC(ours, transcript)}
+	if err := peer.Send(ctx, proof.marshal()); err != nil {
+		return "", nil, err
+	}
+	theirProof, err := receiveClusterMessage(ctx, peer, clusterProof)
+	if err != nil {
+		return "", nil, err
+	}
+	if !hmac.Equal(theirProof.data, cluster.linkMAC(expected, transcript)) {
+		return "", nil, fmt.Errorf("%w: node %s", ErrClusterAuth, theirs.id)
+	}
+	return theirs.id, cluster.linkMAC(linkKeyLabel, transcript), nil
+}
+
+// linkTranscript is what the proofs and the key of a link cover: the domain,
+// the names of the dialler and the acceptor, and their nonces.
+func linkTranscript(dialer, acceptor string, dialerNonce, acceptorNonce []byte) []byte {
+	transcript := []byte(clusterLinkDomain)
+	for _, node := range []string{dialer, acceptor} {
+		transcript = binary.BigEndian.AppendUint32(transcript, uint32(len(node)))
+		transcript = append(transcript, node...)
+	}
+	transcript = append(transcript, dialerNonce...)
+	return append(transcript, acceptorNonce...)
+}
+
+// linkMAC is the MAC of a link transcript under the session key.
+func (cluster *ClusterRouter) linkMAC(label string, transcript []byte) []byte {
+	mac := hmac.New(sha256.New, cluster.sessionKey)
+	mac.Write([]byte(label))
+	mac.Write(transcript)
+	return mac.Sum(nil)
+}
+
+// addLink makes link the link to its node and announces the local peers over
+// it. The tables stay locked until the announcements are sent, so that every
+// later change reaches the node after them.
+func (cluster *ClusterRouter) addLink(link *clusterLink) error {
+	cluster.admins.routesMutex.Lock()
+	defer cluster.admins.routesMutex.Unlock()
+	cluster.clients.routesMutex.Lock()
+	defer cluster.clients.routesMutex.Unlock()
+
+	cluster.linksMutex.Lock()
+	existing := cluster.links[link.node]
+	if existing != nil && existing.canonical && !link.canonical {
+		cluster.linksMutex.Unlock()
+		return fmt.Errorf("%w: %s", ErrDuplicateLink, link.node)
+	}
+	cluster.links[link.node] = link
+	cluster.linksMutex.Unlock()
+	if existing != nil {
+		existing.cancel(ErrLinkReplaced)
+	}
+
+	for _, table := range []*routingTable{cluster.admins, cluster.clients} {
+		for id, r := range table.routes {
+			if _, remote := r.peer.(*remotePeer); r.peer == nil || remote {
+				continue
+			}
+			link.sendState(cluster.announcement(table, id, r.adminID))
+		}
+	}
+	return nil
+}
+
+// removeLink forgets link and the routes its node announced, unless link was
+// replaced. Frames for those routes are queued until they are announced again.
+func (cluster *ClusterRouter) removeLink(link *clusterLink) {
+	cluster.linksMutex.Lock()
+	current := cluster.links[link.node] == link
+	if current {
+		delete(cluster.links, link.node)
+	}
+	cluster.linksMutex.Unlock()
+
+	if current {
+		cluster.dropNode(link.node)
+	}
+}
+
+func (cluster *ClusterRouter) dropNode(node string) {
+	var pinned []string
+	cluster.remotesMutex.Lock()
+	for key, r := range cluster.remotes {
+		if r.node == node {
+			cluster.remove(key.table, key.id, r.generation)
+			delete(cluster.remotes, key)
+			if r.pinned {
+				pinned = append(pinned, key.id)
+			}
+		}
+	}
+	cluster.remotesMutex.Unlock()
+
+	for _, adminID := range pinned {
+		cluster.adminRegistry.Release(adminID)
+	}
+}
+
+// handle applies a message from the node at the other end of link.
+func (cluster *ClusterRouter) handle(
+	ctx context.Context,
+	link *clusterLink,
+	message clusterMessage,
+) {
+	table := cluster.tableFor(message.table)
+	if table == nil {
+		return
+	}
+	key := remoteKey{table: table, id: message.id}
+
+	switch message.kind {
+	case clusterAnnounce:
+		pinned := table == cluster.admins && cluster.adminRegistry != nil
+		if table == cluster.admins && !cluster.acceptsAdmin(message.id, message.data) {
+			return
+		}
+		peer := &remotePeer{
+			cluster: cluster,
+			node:    link.node,
+			table:   message.table,
+			id:      message.id,
+			owner:   message.adminID,
+		}
+		cluster.remotesMutex.Lock()
+		generation, replaced, err := cluster.register(
+			table,
+			message.id,
+			message.adminID,
+			peer,
+			true,
+		)
+		previous, known := cluster.remotes[key]
+		if err == nil {
+			cluster.remotes[key] = remoteRoute{
+				node:       link.node,
+				generation: generation,
+				pinned:     pinned,
+			}
+		}
+		cluster.remotesMutex.Unlock()
+		// The pin is held once per remembered route.
+		if err != nil && pinned {
+			cluster.adminRegistry.Release(message.id)
+		}
+		if err == nil && known && previous.pinned {
+			cluster.adminRegistry.Release(message.id)
+		}
+
+		// A local connection of the same admin or client was superseded by
+		// one on another node. Closing it may wait for its queue to drain,
+		// which must not hold up the link.
+		if _, remote := replaced.(*remotePeer); replaced != nil && !remote {
+			reason := "client connected elsewhere"
+			if table == cluster.admins {
+				reason = "admin connected elsewhere"
+			}
+			go evict(replaced, reason)
+		}
+
+	case clusterWithdraw:
+		cluster.remotesMutex.Lock()
+		r, ok := cluster.remotes[key]
+		if ok && r.node == link.node {
+			cluster.remove(table, message.id, r.generation)
+			delete(cluster.remotes, key)
+		}
+		cluster.remotesMutex.Unlock()
+		if ok && r.node == link.node && r.pinned {
+			cluster.adminRegistry.Release(message.id)
+		}
+
+	case clusterForward:
+		// Errors cannot be reported to the sender on the other node.
+		ctx = context.WithValue(ctx, forwardHopsKey{}, int(message.hops))
+		if table == cluster.admins {
+			_ = cluster.RouteToAdmin(ctx, message.id, message.data)
+		} else {
+			_ = cluster.RouteToClient(ctx, message.adminID, message.id, message.data)
+		}
+	}
+}
+
+// announce is the registered hook; it tells the other nodes about a peer
+// connected to this one.
+func (cluster *ClusterRouter) announce(table *routingTable, id, adminID string, peer Peer) {
+	if _, remote := peer.(*remotePeer); remote {
+		return
+	}
+	cluster.broadcast(cluster.announcement(table, id, adminID))
+}
+
+// announcement tells the other nodes that id is connected to this one. An
+// admin is announced with the key it registered with, if it authenticated.
+func (cluster *ClusterRouter) announcement(
+	table *routingTable,
+	id, adminID string,
+) clusterMessage {
+	message := clusterMessage{
+		kind:    clusterAnnounce,
+		table:   cluster.tableCode(table),
+		id:      id,
+		adminID: adminID,
+	}
+	if table == cluster.admins && cluster.adminRegistry != nil {
+		message.data = cluster.adminRegistry.key(id)
+	}
+	return message
+}
+
+// acceptsAdmin reports whether an admin another node announced with key may
+// take over adminID here. The key is bound to adminID unless it is bound to
+// another key already, so that this node refuses other keys for it too, and
+// the pin is held like for an admin connected here until the route is
+// forgotten.
+func (cluster *ClusterRouter) acceptsAdmin(adminID string, key []byte) bool {
+	if cluster.adminRegistry == nil {
+		return true
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	return cluster.adminRegistry.bind(adminID, key, true) == nil
+}
+
+// withdraw is the removed hook; it tells the other nodes that a peer
+// connected to this one has gone.
+func (cluster *ClusterRouter) withdraw(table *routingTable, id string, peer Peer) {
+	if _, remote := peer.(*remotePeer); remote {
+		return
+	}
+	cluster.broadcast(
+		clusterMessage{kind: clusterWithdraw, table: cluster.tableCode(table), id: id},
+	)
+}
+
+func (cluster *ClusterRouter) broadcast(message clusterMessage) {
+	cluster.linksMutex.Lock()
+	links := make([]*clusterLink, 0, len(cluster.links))
+	for _, link := range cluster.links {
+		links = append(links, link)
+	}
+	cluster.linksMutex.Unlock()
+
+	for _, link := range links {
+		link.sendState(message)
+	}
+}
+
+// sendState sends an announcement or withdrawal. Other nodes would route to
+// stale peers if one was lost, so a link that fails to send one is closed;
+// the nodes announce their peers again when they reconnect.
+func (link *clusterLink) sendState(message clusterMessage) {
+	if err := link.send(context.Background(), message); err != nil {
+		link.cancel(fmt.Errorf("send to node %s: %w", link.node, err))
+	}
+}
+
+// send seals message and sends it over the link.
+func (link *clusterLink) send(ctx context.Context, message clusterMessage) error {
+	link.sendMutex.Lock()
+	defer link.sendMutex.Unlock()
+
+	link.sent++
+	return link.peer.Send(ctx, link.seal(message.marshal(), link.sent, link.dialed))
+}
+
+// seal appends to a message the number it was sent as and a MAC under the
+// link key over the number, which end sent it and the message. A message
+// that was dropped leaves a gap in the numbers, which is allowed, but one
+// that was replayed, reordered or sent back to its sender is refused.
+func (link *clusterLink) seal(buf []byte, sequence uint64, fromDialer bool) []byte {
+	mac := hmac.New(sha256.New, link.key)
+	mac.Write([]byte{linkDirection(fromDialer)})
+	mac.Write(binary.BigEndian.AppendUint64(nil, sequence))
+	mac.Write(buf)
+	buf = binary.BigEndian.AppendUint64(buf, sequence)
+	return mac.Sum(buf)
+}
+
+// open checks the seal of a frame received over the link and returns its
+// message.
+func (link *clusterLink) open(frame []byte) (clusterMessage, error) {
+	if len(frame) < clusterSealSize {
+		return clusterMessage{}, fmt.Errorf("%w: unsealed message from node %s",
+			ErrClusterAuth, link.node)
+	}
+	buf := frame[:len(frame)-clusterSealSize]
+	sequence := binary.BigEndian.Uint64(frame[len(buf):])
+	if sequence <= link.received ||
+		!hmac.Equal(frame, link.seal(bytes.Clone(buf), sequence, !link.dialed)) {
+		return clusterMessage{}, fmt.Errorf("%w: bad seal from node %s", ErrClusterAuth, link.node)
+	}
+	link.received = sequence
+	return unmarshalClusterMessage(buf)
+}
+
+// linkDirection tells the messages the two ends of a link send apart.
+func linkDirection(fromDialer bool) byte {
+	if fromDialer {
+		return 1
+	}
+	return 2
+}
+
+const (
+	tableAdmins byte = iota + 1
+	tableClients
+)
+
+func (cluster *ClusterRouter) tableCode(table *routingTable) byte {
+	if table == cluster.admins {
+		return tableAdmins
+	}
+	return tableClients
+}
+
+func (cluster *ClusterRouter) tableFor(code byte) *routingTable {
+	switch code {
+	case tableAdmins:
+		return cluster.admins
+	case tableClients:
+		return cluster.clients
+	default:
+		return nil
+	}
+}
+
+// forwardHopsKey is the context key of the number of times the frame being
+// routed was forwarded between nodes.
+type forwardHopsKey struct{}
+
+// remotePeer stands in for an admin or client connected to another node.
+// Frames sent to it are forwarded to that node.
+type remotePeer struct {
+	cluster *ClusterRouter
+	node    string
+	table   byte
+	id      string
+	// owner is the admin of a client.
+	owner string
+}
+
+func (peer *remotePeer) Send(ctx context.Context, frame []byte) error {
+	hops, _ := ctx.Value(forwardHopsKey{}).(int)
+	if hops >= maxForwardHops {
+		return errForwardLoop
+	}
+
+	peer.cluster.linksMutex.Lock()
+	link := peer.cluster.links[peer.node]
+	peer.cluster.linksMutex.Unlock()
+	if link == nil {
+		return fmt.Errorf("%w: %s", ErrNodeUnreachable, peer.node)
+	}
+
+	return link.send(ctx, clusterMessage{
+		kind:    clusterForward,
+		table:   peer.table,
+		hops:    byte(hops + 1),
+		id:      peer.id,
+		adminID: peer.owner,
+		data:    frame,
+	})
+}
+
+func (peer *remotePeer) Receive(context.Context) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+type clusterMessageKind byte
+
+const (
+	clusterHello clusterMessageKind = iota + 1
+	clusterProof
+	clusterAnnounce
+	clusterWithdraw
+	clusterForward
+)
+
+// clusterMessage is a frame on a link between nodes: the kind, table and hop
+// count bytes, the length-prefixed id and adminID, then data. Messages after
+// the hello and the proof are sealed (see clusterLink.seal).
+type clusterMessage struct {
+	kind  clusterMessageKind
+	table byte
+	hops  byte
+	// id is the admin or client ID, or the sender's node in a hello.
+	id string
+	// adminID is the admin of an announced client or the owner of a client
+	// a frame is forwarded to.
+	adminID string
+	// data is the nonce of a hello, the MAC of a proof, the signing key of
+	// an announced admin or a forwarded frame.
+	data []byte
+}
+
+func (message clusterMessage) marshal() []byte {
+	buf := make([]byte, 0, 3+2+len(message.id)+2+len(message.adminID)+len(message.data))
+	buf = append(buf, byte(message.kind), message.table, message.hops)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(message.id)))
+	buf = append(buf, message.id...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(message.adminID)))
+	buf = append(buf, message.adminID...)
+	return append(buf, message.data...)
+}
+
+func unmarshalClusterMessage(buf []byte) (clusterMessage, error) {
+	if len(buf) < 3 {
+		return clusterMessage{}, errMalformedClusterMessage
+	}
+	message := clusterMessage{
+		kind:  clusterMessageKind(buf[0]),
+		table: buf[1],
+		hops:  buf[2],
+	}
+	buf = buf[3:]
+	for _, field := range []*string{&message.id, &message.adminID} {
+		if len(buf) < 2 {
+			return clusterMessage{}, errMalformedClusterMessage
+		}
+		n := int(binary.BigEndian.Uint16(buf))
+		if len(buf) < 2+n || n > envelope.MaxIDLength {
+			return clusterMessage{}, errMalformedClusterMessage
+		}
+		*field = string(buf[2 : 2+n])
+		buf = buf[2+n:]
+	}
+	message.data = buf
+	return message, nil
+}
+
+func receiveClusterMessage(
+	ctx context.Context,
+	peer Peer,
+	kind clusterMessageKind,
+) (clusterMessage, error) {
+	frame, err := peer.Receive(ctx)
+	if err != nil {
+		return clusterMessage{}, err
+	}
+	message, err := unmarshalClusterMessage(frame)
+	if err != nil {
+		return clusterMessage{}, err
+	}
+	if message.kind != kind {
+		return clusterMessage{}, fmt.Errorf(
+			"%w: expected kind %d, got %d",
+			errMalformedClusterMessage,
+			kind,
+			message.kind,
+		)
+	}
+	return message, nil
+}
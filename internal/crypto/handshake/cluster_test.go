@@ -0,0 +1,498 @@
+package handshake
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto"
+	"github.com/Dsek-LTH/decidr/internal/envelope"
+)
+
+// newBufferedPeers returns connected peers whose sends do not wait for the
+// other end, like a WebSocketPeer.
+func newBufferedPeers() (a, b inMemoryPeer) {
+	aToB := make(chan []byte, 1024)
+	bToA := make(chan []byte, 1024)
+	return inMemoryPeer{sendCh: aToB, receiveCh: bToA}, inMemoryPeer{sendCh: bToA, receiveCh: aToB}
+}
+
+// linkNodes links every pair of nodes until ctx is done and waits until all
+// links are up.
+func linkNodes(ctx context.Context, t *testing.T, nodes ...*ClusterRouter) {
+	t.Helper()
+
+	for i, dialer := range nodes {
+		for _, acceptor := range nodes[i+1:] {
+			dialSide, acceptSide := newBufferedPeers()
+			go dialer.ConnectNode(ctx, dialSide)
+			go acceptor.AcceptNode(ctx, acceptSide)
+		}
+	}
+	waitFor(ctx, t, "links", func() bool {
+		for _, node := range nodes {
+			if len(node.Nodes()) != len(nodes)-1 {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func waitFor(ctx context.Context, t *testing.T, what string, done func() bool) {
+	t.Helper()
+
+	for !done() {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("gave up waiting for %s", what)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// knows reports whether a route to id is connected, locally or on another
+// node.
+func knows(table *routingTable, id string) bool {
+	table.routesMutex.Lock()
+	defer table.routesMutex.Unlock()
+	r, ok := table.routes[id]
+	return ok && r.peer != nil
+}
+
+func dataFrame(t *testing.T, destination, payload string) []byte {
+	t.Helper()
+
+	frame, err := envelope.Envelope{
+		Type:        envelope.TypeData,
+		Destination: destination,
+		Payload:     []byte(payload),
+	}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func receiveData(ctx context.Context, t *testing.T, peer Peer) envelope.Envelope {
+	t.Helper()
+
+	frame, err := peer.Receive(ctx)
+	if err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	e, err := envelope.Unmarshal(frame)
+	if err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	return e
+}
+
+func TestClusterRoutesBetweenNodes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	key := make([]byte, SessionKeySize)
+	a := NewClusterRouter("a", WithSessionKey(key))
+	b := NewClusterRouter("b", WithSessionKey(key))
+	c := NewClusterRouter("c", WithSessionKey(key))
+	linkNodes(ctx, t, a, b, c)
+
+	adminSide, proxySideAdmin := newBufferedPeers()
+	a.RegisterAdmin("admin-1", proxySideAdmin)
+	waitFor(ctx, t, "admin announcement", func() bool {
+		return knows(b.admins, "admin-1") && knows(c.admins, "admin-1")
+	})
+
+	// The client joins on another node than its admin.
+	firstTab, proxySideFirst := newClosingPeers()
+	session, err := b.JoinClient(ctx, "admin-1", proxySideFirst)
+	if err != nil {
+		t.Fatalf("JoinClient: %v", err)
+	}
+	if _, err := ReceiveClientSession(ctx, firstTab); err != nil {
+		t.Fatalf("ReceiveClientSession: %v", err)
+	}
+	if control := receiveControl(ctx, t, adminSide); control.Kind !=
+		envelope.ControlClientConnected ||
+		!slices.Equal(control.ClientIDs, []string{session.ID}) {
+		t.Fatalf("admin got %+v, want %s connected", control, session.ID)
+	}
+	if clients := a.ClientsOf("admin-1"); !slices.Equal(clients, []string{session.ID}) {
+		t.Fatalf("ClientsOf(admin-1) on the admin's node = %v", clients)
+	}
+	if gauges := a.Gauges(); gauges.Admins != 1 || gauges.Clients != 0 {
+		t.Fatalf("gauges of node a = %+v, want only its own admin", gauges)
+	}
+
+	if err := b.RouteFromClient(ctx, session.ID, dataFrame(t, "", "ballot")); err != nil {
+		t.Fatalf("RouteFromClient: %v", err)
+	}
+	if e := receiveData(ctx, t, adminSide); e.Source != session.ID ||
+		string(e.Payload) != "ballot" {
+		t.Fatalf("admin got %+v", e)
+	}
+	if err := a.RouteFromAdmin(ctx, "admin-1", dataFrame(t, session.ID, "receipt")); err != nil {
+		t.Fatalf("RouteFromAdmin: %v", err)
+	}
+	if e := receiveData(ctx, t, firstTab); e.Source != "admin-1" ||
+		string(e.Payload) != "receipt" {
+		t.Fatalf("client got %+v", e)
+	}
+
+	// Resuming on a third node evicts the first connection.
+	waitFor(ctx, t, "client announcement", func() bool { return knows(c.clients, session.ID) })
+	secondTab, proxySideSecond := newBufferedPeers()
+	resumed, err := c.ResumeClient(ctx, session.Token, "admin-1", proxySideSecond)
+	if err != nil {
+		t.Fatalf("ResumeClient: %v", err)
+	}
+	if _, err := ReceiveClientSession(ctx, secondTab); err != nil {
+		t.Fatalf("ReceiveClientSession: %v", err)
+	}
+	select {
+	case reason := <-proxySideFirst.reasons:
+		if reason != "client connected elsewhere" {
+			t.Fatalf("evicted with reason %q", reason)
+		}
+	case <-ctx.Done():
+		t.Fatal("the first connection was not evicted")
+	}
+	receiveControl(ctx, t, adminSide)
+
+	if err := a.RouteFromAdmin(ctx, "admin-1", dataFrame(t, session.ID, "again")); err != nil {
+		t.Fatalf("RouteFromAdmin after resuming: %v", err)
+	}
+	if e := receiveData(ctx, t, secondTab); string(e.Payload) != "again" {
+		t.Fatalf("resumed client got %+v", e)
+	}
+
+	// The evicted connection leaving changes nothing; the new one leaving
+	// tells the admin.
+	b.LeaveClient(session)
+	c.LeaveClient(resumed)
+	if control := receiveControl(ctx, t, adminSide); control.Kind !=
+		envelope.ControlClientDisconnected {
+		t.Fatalf("admin got %+v, want disconnected", control)
+	}
+	if clients := a.ClientsOf("admin-1"); len(clients) != 0 {
+		t.Fatalf("ClientsOf(admin-1) = %v after the client left", clients)
+	}
+}
+
+func TestClusterQueuesWhileUnlinked(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	key := make([]byte, SessionKeySize)
+	a := NewClusterRouter("a", WithSessionKey(key))
+	b := NewClusterRouter("b", WithSessionKey(key))
+	linkCtx, unlink := context.WithCancel(ctx)
+	linkNodes(linkCtx, t, a, b)
+
+	_, proxySideAdmin := newBufferedPeers()
+	a.RegisterAdmin("admin-1", proxySideAdmin)
+	waitFor(ctx, t, "admin announcement", func() bool { return knows(b.admins, "admin-1") })
+
+	clientSide, proxySideClient := newBufferedPeers()
+	session, err := b.JoinClient(ctx, "admin-1", proxySideClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(ctx, t, "client announcement", func() bool { return knows(a.clients, session.ID) })
+
+	unlink()
+	waitFor(ctx, t, "link loss", func() bool { return !knows(a.clients, session.ID) })
+
+	// The client's node is unreachable, so the frame waits on the admin's.
+	if err := a.RouteFromAdmin(ctx, "admin-1", dataFrame(t, session.ID, "ballot")); err != nil {
+		t.Fatalf("RouteFromAdmin while unlinked: %v", err)
+	}
+
+	linkNodes(ctx, t, a, b)
+	if _, err := ReceiveClientSession(ctx, clientSide); err != nil {
+		t.Fatal(err)
+	}
+	if e := receiveData(ctx, t, clientSide); string(e.Payload) != "ballot" {
+		t.Fatalf("client got %+v", e)
+	}
+}
+
+func TestClusterLinks(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	key := make([]byte, SessionKeySize)
+	a := NewClusterRouter("a", WithSessionKey(key))
+	b := NewClusterRouter("b", WithSessionKey(key))
+
+	serve := func(dialer, acceptor *ClusterRouter) (dialed, accepted chan error) {
+		dialed, accepted = make(chan error, 1), make(chan error, 1)
+		dialSide, acceptSide := newBufferedPeers()
+		go func() { dialed <- dialer.ConnectNode(ctx, dialSide) }()
+		go func() { accepted <- acceptor.AcceptNode(ctx, acceptSide) }()
+		return dialed, accepted
+	}
+
+	first, _ := serve(a, b)
+	waitFor(ctx, t, "first link", func() bool { return len(a.Nodes()) == 1 })
+
+	// b dialling a as well is refused by both ends in favour of the link
+	// dialled by the node with the smaller name.
+	dialed, accepted := serve(b, a)
+	for _, result := range []chan error{dialed, accepted} {
+		if err := <-result; !errors.Is(err, ErrDuplicateLink) {
+			t.Fatalf("expected ErrDuplicateLink, got %v", err)
+		}
+	}
+
+	// a dialling b again, e.g. after a network failure, replaces the link.
+	serve(a, b)
+	if err := <-first; !errors.Is(err, ErrLinkReplaced) {
+		t.Fatalf("expected ErrLinkReplaced, got %v", err)
+	}
+	if nodes := a.Nodes(); !slices.Equal(nodes, []string{"b"}) {
+		t.Fatalf("a.Nodes() = %v", nodes)
+	}
+
+	// A node with another key cannot join.
+	stranger := NewClusterRouter("stranger")
+	dialed, accepted = serve(stranger, a)
+	for _, result := range []chan error{dialed, accepted} {
+		if err := <-result; !errors.Is(err, ErrClusterAuth) {
+			t.Fatalf("expected ErrClusterAuth, got %v", err)
+		}
+	}
+}
+
+// relay forwards the frames from one peer to another until ctx is done. The
+// hello and the proof are passed on as they are, and every later frame is
+// passed through tamper.
+func relay(ctx context.Context, from, to Peer, tamper func(frame []byte) [][]byte) {
+	for handshake := 2; ; handshake-- {
+		frame, err := from.Receive(ctx)
+		if err != nil {
+			return
+		}
+		frames := [][]byte{frame}
+		if handshake <= 0 {
+			frames = tamper(frame)
+		}
+		for _, frame := range frames {
+			if err := to.Send(ctx, frame); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestClusterLinksRefuseRelays(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	key := make([]byte, SessionKeySize)
+	a := NewClusterRouter("a", WithSessionKey(key))
+	b := NewClusterRouter("b", WithSessionKey(key))
+	unchanged := func(frame []byte) [][]byte { return [][]byte{frame} }
+
+	// x dials both a and b and passes each one's messages to the other, so
+	// that each would take x for the other if the proofs did not cover who
+	// dialled whom.
+	xToA, aSide := newBufferedPeers()
+	xToB, bSide := newBufferedPeers()
+	accepted := make(chan error, 2)
+	go func() { accepted <- a.AcceptNode(ctx, aSide) }()
+	go func() { accepted <- b.AcceptNode(ctx, bSide) }()
+	go relay(ctx, xToA, xToB, unchanged)
+	go relay(ctx, xToB, xToA, unchanged)
+	for range 2 {
+		if err := <-accepted; !errors.Is(err, ErrClusterAuth) {
+			t.Fatalf("expected ErrClusterAuth for a relayed link, got %v", err)
+		}
+	}
+
+	// A link a dialled to x that x passes on to b is a link between a and b,
+	// but x can neither add messages of its own to it nor replay or reflect
+	// theirs. Both announce an admin, so that each sends a sealed message.
+	_, proxySideAdminA := newBufferedPeers()
+	a.RegisterAdmin("admin-1", proxySideAdminA)
+	_, proxySideAdminB := newBufferedPeers()
+	b.RegisterAdmin("admin-2", proxySideAdminB)
+	forged := clusterMessage{kind: clusterAnnounce, table: tableAdmins, id: "admin-3"}
+	for _, test := range []struct {
+		name    string
+		reflect bool
+		fromB   func(frame []byte) [][]byte
+	}{
+		{
+			"forged",
+			false,
+			func(frame []byte) [][]byte {
+				seal := make([]byte, clusterSealSize)
+				seal[7] = 100
+				return [][]byte{frame, append(forged.marshal(), seal...)}
+			},
+		},
+		{"replayed", false, func(frame []byte) [][]byte { return [][]byte{frame, frame} }},
+		{"reflected", true, func([]byte) [][]byte { return nil }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			aToX, xFromA := newBufferedPeers()
+			xToB, bSide := newBufferedPeers()
+			dialed := make(chan error, 1)
+			go func() { dialed <- a.ConnectNode(ctx, aToX) }()
+			go b.AcceptNode(ctx, bSide)
+			go relay(ctx, xToB, xFromA, test.fromB)
+			go relay(ctx, xFromA, xToB, func(frame []byte) [][]byte {
+				if test.reflect {
+					_ = xFromA.Send(ctx, frame)
+				}
+				return [][]byte{frame}
+			})
+
+			if err := <-dialed; !errors.Is(err, ErrClusterAuth) {
+				t.Fatalf("expected ErrClusterAuth, got %v", err)
+			}
+			if knows(a.admins, "admin-3") {
+				t.Fatal("a accepted an admin x announced")
+			}
+		})
+	}
+}
+
+func TestClusterClientJoinsBeforeAdminIsAnnounced(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	key := make([]byte, SessionKeySize)
+	a := NewClusterRouter("a", WithSessionKey(key))
+	b := NewClusterRouter("b", WithSessionKey(key))
+
+	adminSide, proxySideAdmin := newBufferedPeers()
+	a.RegisterAdmin("admin-1", proxySideAdmin)
+	_, proxySideClient := newBufferedPeers()
+	session, err := b.JoinClient(ctx, "admin-1", proxySideClient)
+	if err != nil {
+		t.Fatalf("JoinClient for an admin not announced yet: %v", err)
+	}
+	if err := b.RouteFromClient(ctx, session.ID, dataFrame(t, "", "ballot")); err != nil {
+		t.Fatalf("RouteFromClient before the admin was announced: %v", err)
+	}
+
+	linkNodes(ctx, t, a, b)
+	if control := receiveControl(ctx, t, adminSide); control.Kind !=
+		envelope.ControlClientConnected {
+		t.Fatalf("admin got %+v, want connected", control)
+	}
+	if e := receiveData(ctx, t, adminSide); string(e.Payload) != "ballot" {
+		t.Fatalf("admin got %+v", e)
+	}
+}
+
+func TestClusterForgetsAdminsNeverAnnounced(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	b := NewClusterRouter("b", WithQueue(4, time.Minute), WithClock(clock.Now))
+
+	_, proxySideClient := newBufferedPeers()
+	session, err := b.JoinClient(ctx, "nobody", proxySideClient)
+	if err != nil {
+		t.Fatalf("JoinClient: %v", err)
+	}
+	if err := b.RouteFromClient(ctx, session.ID, dataFrame(t, "", "ballot")); err != nil {
+		t.Fatalf("RouteFromClient while the admin may still be announced: %v", err)
+	}
+
+	clock.Advance(2 * time.Minute)
+	if gauges := b.Gauges(); gauges.QueuedFrames != 0 {
+		t.Fatalf("gauges = %+v, want nothing queued", gauges)
+	}
+	b.admins.routesMutex.Lock()
+	_, expected := b.admins.routes["nobody"]
+	b.admins.routesMutex.Unlock()
+	if expected {
+		t.Fatalf("b still expects an admin that was never announced")
+	}
+	err = b.RouteFromClient(ctx, session.ID, dataFrame(t, "", "ballot"))
+	if !errors.Is(err, ErrUnknownDestination) {
+		t.Fatalf("expected ErrUnknownDestination, got %v", err)
+	}
+}
+
+func TestClusterRefusesAdminsWithAnotherKey(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	owner, err := crypto.GenerateStaticKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	intruder, err := crypto.GenerateStaticKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := make([]byte, SessionKeySize)
+	registryA, registryB := NewAdminRegistry(), NewAdminRegistry()
+	a := NewClusterRouter("a", WithSessionKey(key), WithAdminRegistry(registryA))
+	b := NewClusterRouter("b", WithSessionKey(key), WithAdminRegistry(registryB))
+
+	// Before the nodes are linked, the intruder claims on b the admin ID the
+	// owner registered on a.
+	if err := registerAdmin(ctx, t, registryA, owner, "admin-1", "admin-1"); err != nil {
+		t.Fatalf("owner registration: %v", err)
+	}
+	adminSide, proxySideAdmin := newClosingPeers()
+	a.RegisterAdmin("admin-1", proxySideAdmin)
+	if err := registerAdmin(ctx, t, registryB, intruder, "admin-1", "admin-1"); err != nil {
+		t.Fatalf("intruder registration on an unlinked node: %v", err)
+	}
+	_, proxySideIntruder := newBufferedPeers()
+	b.RegisterAdmin("admin-1", proxySideIntruder)
+
+	// Admins registered after linking show that both announcements of
+	// admin-1 have been handled.
+	linkNodes(ctx, t, a, b)
+	if err := registerAdmin(ctx, t, registryA, owner, "admin-2", "admin-2"); err != nil {
+		t.Fatal(err)
+	}
+	a.RegisterAdmin("admin-2", proxySideAdmin)
+	if err := registerAdmin(ctx, t, registryB, intruder, "admin-3", "admin-3"); err != nil {
+		t.Fatal(err)
+	}
+	b.RegisterAdmin("admin-3", proxySideIntruder)
+	waitFor(ctx, t, "admin announcements", func() bool {
+		return knows(b.admins, "admin-2") && knows(a.admins, "admin-3")
+	})
+
+	select {
+	case reason := <-proxySideAdmin.reasons:
+		t.Fatalf("owner was evicted with reason %q", reason)
+	default:
+	}
+	_, proxySideClient := newBufferedPeers()
+	session, err := a.JoinClient(ctx, "admin-1", proxySideClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if control := receiveControl(ctx, t, adminSide); control.Kind !=
+		envelope.ControlClientConnected {
+		t.Fatalf("owner got %+v, want its client connected", control)
+	}
+	if err := a.RouteFromClient(ctx, session.ID, dataFrame(t, "", "ballot")); err != nil {
+		t.Fatal(err)
+	}
+	if e := receiveData(ctx, t, adminSide); string(e.Payload) != "ballot" {
+		t.Fatalf("owner got %+v", e)
+	}
+
+	// An admin announced by a is bound to its key on b as well.
+	err = registerAdmin(ctx, t, registryB, intruder, "admin-2", "admin-2")
+	if !errors.Is(err, ErrAdminKeyMismatch) {
+		t.Fatalf("expected ErrAdminKeyMismatch on the other node, got %v", err)
+	}
+}
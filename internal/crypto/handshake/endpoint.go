@@ -1,40 +1,127 @@
 package handshake
 
-import "github.com/Dsek-LTH/decidr/internal/crypto"
+import (
+	"github.com/Dsek-LTH/decidr/internal/crypto"
+	"github.com/flynn/noise"
+)
 
 type endpoint struct {
 	Identity handshakeIdentity
 }
 
-func NewAdminEndpoint() (clientEndpoint endpoint, adminEndpoint endpoint, err error) {
-	clientID, adminID, err := newAdminClientPair()
+// EndpointOption configures the handshake performed by an endpoint.
+// Both parties of a handshake must be created with matching options.
+type EndpointOption func(*handshakeParams)
+
+// WithPattern selects the Noise handshake pattern, e.g. noise.HandshakeXX.
+// Endpoints default to noise.HandshakeNK.
+func WithPattern(pattern noise.HandshakePattern) EndpointOption {
+	return func(params *handshakeParams) {
+		params.pattern = pattern
+	}
+}
+
+// WithPresharedKey mixes a 32-byte pre-shared key into the handshake at the
+// given PSK modifier position, e.g. 2 turns NK into NKpsk2. The handshake only
+// completes if both parties hold the same key; see crypto.DeriveMeetingKey for
+// deriving one from a meeting passphrase.
+func WithPresharedKey(presharedKey []byte, placement int) EndpointOption {
+	return func(params *handshakeParams) {
+		params.presharedKey = presharedKey
+		params.presharedKeyPlacement = placement
+	}
+}
+
+// WithRoster makes the admin reject initiators whose static key is not
+// enrolled in roster. It requires a pattern in which the initiator presents a
+// static key, such as IK or KK.
+func WithRoster(roster *Roster) EndpointOption {
+	return func(params *handshakeParams) {
+		params.roster = roster
+	}
+}
+
+func NewAdminEndpoint(
+	options ...EndpointOption,
+) (clientEndpoint endpoint, adminEndpoint endpoint, err error) {
+	keypair, err := crypto.GenerateStaticKeypair()
 	if err != nil {
 		return endpoint{}, endpoint{}, err
 	}
 
-	return endpoint{Identity: clientID}, endpoint{Identity: adminID}, nil
+	clientEndpoint, adminEndpoint = NewAdminEndpointFromKeypair(keypair, options...)
+	return clientEndpoint, adminEndpoint, nil
+}
+
+// NewAdminEndpointFromKeypair is NewAdminEndpoint for an admin whose static
+// keypair outlives the process, e.g. one loaded with crypto.UnlockKeystore.
+func NewAdminEndpointFromKeypair(
+	keypair crypto.StaticKeypair,
+	options ...EndpointOption,
+) (clientEndpoint endpoint, adminEndpoint endpoint) {
+	clientID, adminID := newAdminClientPair(keypair, newHandshakeParams(options))
+	return endpoint{Identity: clientID}, endpoint{Identity: adminID}
 }
 
-func GetClientEndpoint(adminPublicKey []byte) endpoint {
+func GetClientEndpoint(adminPublicKey []byte, options ...EndpointOption) endpoint {
 	return endpoint{
 		Identity: clientIdentity{
+			handshakeParams: newHandshakeParams(options),
+			AdminPublicKey:  adminPublicKey,
+		},
+	}
+}
+
+// NewVoterEndpoint returns an endpoint that authenticates to the admin with the
+// voter's own static keypair. It uses noise.HandshakeIK unless another pattern
+// is selected.
+func NewVoterEndpoint(
+	adminPublicKey []byte,
+	keypair crypto.StaticKeypair,
+	options ...EndpointOption,
+) endpoint {
+	return endpoint{
+		Identity: voterIdentity{
+			handshakeParams: newHandshakeParams(
+				append([]EndpointOption{WithPattern(noise.HandshakeIK)}, options...),
+			),
 			AdminPublicKey: adminPublicKey,
+			PublicKey:      keypair.Public,
+			PrivateKey:     keypair.Private,
 		},
 	}
 }
 
-func newAdminClientPair() (clientIdentity, adminIdentity, error) {
-	pub, priv, err := crypto.GenerateStaticKeypair()
-	if err != nil {
-		return clientIdentity{}, adminIdentity{}, err
+// ForVoter returns a copy of an admin endpoint that expects the given voter,
+// for patterns such as KK where the voter key must be known in advance.
+// It has no effect on other endpoints.
+func (e endpoint) ForVoter(voterPublicKey []byte) endpoint {
+	if admin, ok := e.Identity.(adminIdentity); ok {
+		admin.VoterPublicKey = voterPublicKey
+		e.Identity = admin
 	}
+	return e
+}
 
+func newHandshakeParams(options []EndpointOption) handshakeParams {
+	var params handshakeParams
+	for _, option := range options {
+		option(&params)
+	}
+	return params
+}
+
+func newAdminClientPair(
+	keypair crypto.StaticKeypair,
+	params handshakeParams,
+) (clientIdentity, adminIdentity) {
 	return clientIdentity{
-			AdminPublicKey: pub,
+			handshakeParams: params,
+			AdminPublicKey:  keypair.Public,
 		},
 		adminIdentity{
-			PublicKey:  pub,
-			PrivateKey: priv,
-		},
-		nil
+			handshakeParams: params,
+			PublicKey:       keypair.Public,
+			PrivateKey:      keypair.Private,
+		}
 }
@@ -0,0 +1,104 @@
+package handshake
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto"
+	"github.com/flynn/noise"
+)
+
+const (
+	enrollmentScheme = "decidr"
+	enrollmentAction = "join"
+)
+
+var (
+	// ErrInvalidEnrollment is returned when an enrolment URI is malformed or
+	// misses one of its fields.
+	ErrInvalidEnrollment = errors.New("handshake: invalid enrollment uri")
+
+	// ErrFingerprintMismatch is returned when the fingerprint words of an
+	// enrolment URI do not belong to the key it carries.
+	ErrFingerprintMismatch = errors.New("handshake: admin key does not match its fingerprint")
+)
+
+// Enrollment is everything a voter needs to join a meeting: where the proxy
+// is, which admin to ask for, and the admin static key to pin. It is shown by
+// the admin as a QR code so that the key never travels over the proxy.
+type Enrollment struct {
+	ProxyURL       string
+	AdminID        string
+	AdminPublicKey []byte
+}
+
+// FingerprintWords returns the words identifying the admin key, for the admin
+// to read out so voters can check what they scanned.
+func (e Enrollment) FingerprintWords() []string {
+	return crypto.GetKeyFingerprintWords(e.AdminPublicKey)
+}
+
+// URI encodes the enrolment as
+//
+//	decidr://join?proxy=<url>&admin=<id>&key=<base64url>&words=<w1-w2-...>
+func (e Enrollment) URI() string {
+	query := url.Values{}
+	query.Set("proxy", e.ProxyURL)
+	query.Set("admin", e.AdminID)
+	query.Set("key", base64.RawURLEncoding.EncodeToString(e.AdminPublicKey))
+	query.Set("words", strings.Join(e.FingerprintWords(), "-"))
+
+	uri := url.URL{Scheme: enrollmentScheme, Host: enrollmentAction, RawQuery: query.Encode()}
+	return uri.String()
+}
+
+// ClientEndpoint returns a client endpoint pinned to the enrolled admin key.
+func (e Enrollment) ClientEndpoint(options ...EndpointOption) endpoint {
+	return GetClientEndpoint(e.AdminPublicKey, options...)
+}
+
+// ParseEnrollmentURI decodes a URI produced by Enrollment.URI. The fingerprint
+// words are checked against the key, so a URI whose key was swapped without
+// also updating the words is rejected with ErrFingerprintMismatch.
+func ParseEnrollmentURI(raw string) (Enrollment, error) {
+	uri, err := url.Parse(raw)
+	if err != nil {
+		return Enrollment{}, fmt.Errorf("%w: %w", ErrInvalidEnrollment, err)
+	}
+	if uri.Scheme != enrollmentScheme || uri.Host != enrollmentAction {
+		return Enrollment{}, fmt.Errorf("%w: not a %s://%s uri", ErrInvalidEnrollment,
+			enrollmentScheme, enrollmentAction)
+	}
+
+	query := uri.Query()
+	enrollment := Enrollment{
+		ProxyURL: query.Get("proxy"),
+		AdminID:  query.Get("admin"),
+	}
+	if enrollment.ProxyURL == "" || enrollment.AdminID == "" {
+		return Enrollment{}, fmt.Errorf("%w: missing proxy or admin", ErrInvalidEnrollment)
+	}
+
+	enrollment.AdminPublicKey, err = base64.RawURLEncoding.DecodeString(query.Get("key"))
+	if err != nil {
+		return Enrollment{}, fmt.Errorf("%w: key: %w", ErrInvalidEnrollment, err)
+	}
+	if len(enrollment.AdminPublicKey) != noise.DH25519.DHLen() {
+		return Enrollment{}, fmt.Errorf("%w: key has %d bytes", ErrInvalidEnrollment,
+			len(enrollment.AdminPublicKey))
+	}
+
+	words := query.Get("words")
+	if words == "" {
+		return Enrollment{}, fmt.Errorf("%w: missing words", ErrInvalidEnrollment)
+	}
+	if !slices.Equal(strings.Split(words, "-"), enrollment.FingerprintWords()) {
+		return Enrollment{}, ErrFingerprintMismatch
+	}
+
+	return enrollment, nil
+}
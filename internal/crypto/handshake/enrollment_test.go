@@ -0,0 +1,95 @@
+package handshake
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto"
+)
+
+func TestEnrollmentURIRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	admin, err := crypto.GenerateStaticKeypair()
+	if err != nil {
+		t.Fatalf("failed to generate admin keypair: %v", err)
+	}
+	enrollment := Enrollment{
+		ProxyURL:       "wss://vote.example.org/proxy?room=1",
+		AdminID:        "admin-1",
+		AdminPublicKey: admin.Public,
+	}
+
+	parsed, err := ParseEnrollmentURI(enrollment.URI())
+	if err != nil {
+		t.Fatalf("ParseEnrollmentURI: %v", err)
+	}
+	if parsed.ProxyURL != enrollment.ProxyURL || parsed.AdminID != enrollment.AdminID ||
+		!bytes.Equal(parsed.AdminPublicKey, admin.Public) {
+		t.Fatalf("got %+v, want %+v", parsed, enrollment)
+	}
+
+	// The enrolled client completes a handshake with the admin it was shown.
+	_, adminEndpoint := NewAdminEndpointFromKeypair(admin)
+	clientSide, adminSide := newInMemoryPeers()
+	client, _ := establishPair(
+		ctx,
+		t,
+		clientSide,
+		adminSide,
+		parsed.ClientEndpoint().Identity,
+		adminEndpoint.Identity,
+	)
+	if !bytes.Equal(client.PeerStatic(), admin.Public) {
+		t.Fatal("client did not pin the enrolled admin key")
+	}
+}
+
+func TestParseEnrollmentURIRejectsSwappedKey(t *testing.T) {
+	honest, err := crypto.GenerateStaticKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	attacker, err := crypto.GenerateStaticKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uri := Enrollment{
+		ProxyURL:       "ws://localhost:8080",
+		AdminID:        "admin-1",
+		AdminPublicKey: honest.Public,
+	}.URI()
+	swapped := strings.Replace(
+		uri,
+		base64.RawURLEncoding.EncodeToString(honest.Public),
+		base64.RawURLEncoding.EncodeToString(attacker.Public),
+		1,
+	)
+
+	if _, err := ParseEnrollmentURI(swapped); !errors.Is(err, ErrFingerprintMismatch) {
+		t.Fatalf("expected ErrFingerprintMismatch, got %v", err)
+	}
+}
+
+func TestParseEnrollmentURIInvalid(t *testing.T) {
+	key := base64.RawURLEncoding.EncodeToString(make([]byte, 32))
+
+	for _, uri := range []string{
+		"https://join?proxy=ws%3A%2F%2Fx&admin=a&key=" + key + "&words=a",
+		"decidr://join?admin=a&key=" + key + "&words=a",
+		"decidr://join?proxy=ws%3A%2F%2Fx&admin=a&key=AAAA&words=a",
+		"decidr://join?proxy=ws%3A%2F%2Fx&admin=a&key=" + key,
+		"decidr://join?proxy=ws%3A%2F%2Fx&admin=a&key=!!",
+	} {
+		if _, err := ParseEnrollmentURI(uri); !errors.Is(err, ErrInvalidEnrollment) {
+			t.Errorf("ParseEnrollmentURI(%q) = %v, want ErrInvalidEnrollment", uri, err)
+		}
+	}
+}
@@ -3,50 +3,155 @@ package handshake
 
 import (
 	"context"
+	"errors"
+	"fmt"
 
 	"github.com/flynn/noise"
 )
 
+// ErrPresharedKeyMismatch is returned when a handshake message fails to
+// authenticate after the pre-shared key has been mixed in, which almost always
+// means the parties were configured with different keys or meeting passphrases.
+//
+// Only the party that reads the first message covered by the key can detect the
+// mismatch during the handshake. With NKpsk2 that is the client; the admin
+// completes its side and fails to decrypt the client's first transport message.
+var ErrPresharedKeyMismatch = errors.New("handshake: pre-shared key mismatch")
+
 // Perform executes a Noise handshake using the specified role (Initiator or Responder).
 //
 // Returns the send and receive cipher states for encrypting/decrypting subsequent messages,
-// the handshake hash for verification, and/or any error encountered during the process.
+// the handshake hash for verification, the hello announced by the peer, and/or any error
+// encountered during the process.
 //
 // sendCipherState is used for outbound traffic after the handshake.
 //
 // receiveCipherState is used for inbound traffic after the handshake.
+//
+// Unlike Establish, Perform leaves negotiating the settings in remoteHello to the caller.
 func Perform(
 	ctx context.Context,
 	send func([]byte) error,
 	receive func() ([]byte, error),
 	identity handshakeIdentity,
+	options ...SessionOption,
 ) (
 	sendCipherState *noise.CipherState,
 	receiveCipherState *noise.CipherState,
 	handshakeState *noise.HandshakeState,
+	remoteHello Hello,
 	err error,
 ) {
-	peer := NewFuncPeer(send, receive)
-	handshakeState, err = noise.NewHandshakeState(identity.getNoiseConfig())
+	return perform(ctx, NewFuncPeer(send, receive), identity, newSession(options))
+}
+
+// Establish executes a Noise handshake over transport and wraps the resulting
+// cipher states in a SecureChannel that encrypts everything sent through it.
+// The hello announced by the peer is available from the returned channel.
+func Establish(
+	ctx context.Context,
+	transport Peer,
+	identity handshakeIdentity,
+	options ...SessionOption,
+) (*SecureChannel, error) {
+	session := newSession(options)
+	sendCipherState, receiveCipherState, handshakeState, remoteHello, err := perform(
+		ctx,
+		transport,
+		identity,
+		session,
+	)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
+	}
+	if session.explicitNonces != remoteHello.ExplicitNonces {
+		return nil, ErrNonceModeMismatch
 	}
 
+	channel := NewSecureChannel(transport, sendCipherState, receiveCipherState, handshakeState)
+	channel.remoteHello = remoteHello
+	channel.protocolVersion = min(ProtocolVersion, remoteHello.Version)
+	channel.rekey.policy = session.rekey.negotiate(remoteHello.Rekey)
+	if session.explicitNonces {
+		channel.explicitReceiver = &explicitReceiver{current: receiveCipherState}
+	}
+	return channel, nil
+}
+
+func perform(
+	ctx context.Context,
+	peer Peer,
+	identity handshakeIdentity,
+	session session,
+) (
+	sendCipherState *noise.CipherState,
+	receiveCipherState *noise.CipherState,
+	handshakeState *noise.HandshakeState,
+	remoteHello Hello,
+	err error,
+) {
+	config, err := identity.getNoiseConfig()
+	if err != nil {
+		return nil, nil, nil, Hello{}, err
+	}
+	config.Prologue = session.prologue.encode()
+
+	session.hello.Rekey = session.rekey
+	session.hello.ExplicitNonces = session.explicitNonces
+	localHello, err := session.hello.encode()
+	if err != nil {
+		return nil, nil, nil, Hello{}, err
+	}
+
+	handshakeState, err = noise.NewHandshakeState(config)
+	if err != nil {
+		return nil, nil, nil, Hello{}, err
+	}
+
+	pattern, role := identity.getPattern(), identity.getRole()
+	lastSent := lastMessageSentBy(pattern, role)
+	lastReceived := lastMessageSentBy(pattern, role.peer())
+
+	// A peer that never writes a message cannot announce anything, so it is
+	// assumed to agree with the local settings.
+	remoteHello = session.hello
+	remoteHello.Version = ProtocolVersion
+
 	var cipherState1, cipherState2 *noise.CipherState
-	for _, step := range stepsFor(identity.getRole()) {
-		cipherState1, cipherState2, err = step.apply(ctx, handshakeState, peer)
+	for index, step := range stepsFor(pattern, role) {
+		var payload []byte
+		if index == lastSent {
+			payload = localHello
+		}
+
+		payload, cipherState1, cipherState2, err = step.apply(ctx, handshakeState, peer, payload)
+		if isPresharedKeyMismatch(err, identity, index) {
+			return nil, nil, nil, Hello{}, fmt.Errorf("%w: %w", ErrPresharedKeyMismatch, err)
+		}
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, Hello{}, err
+		}
+
+		if err := identity.verifyPeer(handshakeState.PeerStatic()); err != nil {
+			return nil, nil, nil, Hello{}, err
+		}
+
+		if index == lastReceived {
+			if remoteHello, err = decodeHello(payload); err != nil {
+				return nil, nil, nil, Hello{}, err
+			}
 		}
 	}
 
-	sendCipherState, receiveCipherState = cipherStatesFor(
-		identity.getRole(),
-		cipherState1,
-		cipherState2,
-	)
+	sendCipherState, receiveCipherState = cipherStatesFor(role, cipherState1, cipherState2)
 
 	// sendCipherState is used for outbound traffic after the handshake.
 	// receiveCipherState is used for inbound traffic after the handshake.
-	return sendCipherState, receiveCipherState, handshakeState, nil
+	return sendCipherState, receiveCipherState, handshakeState, remoteHello, nil
+}
+
+func isPresharedKeyMismatch(err error, identity handshakeIdentity, index int) bool {
+	return errors.Is(err, errReadMessage) &&
+		!errors.Is(err, noise.ErrShortMessage) &&
+		identity.presharedKeyCovers(index)
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/sha256"
 	"fmt"
+	"sync"
 	"testing"
 )
 
@@ -67,7 +68,7 @@ func runHandshakeAsync(
 		send := func(b []byte) error { return peer.Send(ctx, b) }
 		receive := func() ([]byte, error) { return peer.Receive(ctx) }
 
-		if _, _, handshakeState, err := Perform(ctx, send, receive, identity); err != nil {
+		if _, _, handshakeState, _, err := Perform(ctx, send, receive, identity); err != nil {
 			ch <- handshakeResult{err: fmt.Errorf("handshake failed: %w", err)}
 		} else {
 			sum := func() [32]byte {
@@ -96,3 +97,59 @@ func getIdentityPair(t *testing.T) (handshakeIdentity, handshakeIdentity) {
 
 	return clientEndpoint.Identity, adminEndpoint.Identity
 }
+
+// establishWithOptions runs Establish on both ends of a fresh in-memory pair.
+func establishWithOptions(
+	ctx context.Context,
+	t *testing.T,
+	clientOptions, adminOptions []SessionOption,
+) (client, admin *SecureChannel) {
+	t.Helper()
+
+	clientIdentity, adminIdentity := getIdentityPair(t)
+	clientSide, adminSide := newInMemoryPeers()
+
+	adminCh := make(chan *SecureChannel, 1)
+	go func() {
+		channel, err := Establish(ctx, adminSide, adminIdentity, adminOptions...)
+		if err != nil {
+			t.Errorf("admin Establish: %v", err)
+		}
+		adminCh <- channel
+	}()
+
+	client, err := Establish(ctx, clientSide, clientIdentity, clientOptions...)
+	if err != nil {
+		t.Fatalf("client Establish: %v", err)
+	}
+	admin = <-adminCh
+	if admin == nil {
+		t.FailNow()
+	}
+	return client, admin
+}
+
+// queuePeer is a Peer backed by a slice, letting tests drop, duplicate and
+// reorder frames at will.
+type queuePeer struct {
+	mutex  sync.Mutex
+	frames [][]byte
+}
+
+func (p *queuePeer) Send(_ context.Context, b []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.frames = append(p.frames, b)
+	return nil
+}
+
+func (p *queuePeer) Receive(ctx context.Context) ([]byte, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.frames) == 0 {
+		return nil, context.DeadlineExceeded
+	}
+	frame := p.frames[0]
+	p.frames = p.frames[1:]
+	return frame, nil
+}
@@ -1,14 +1,51 @@
 package handshake
 
-import "github.com/flynn/noise"
+import (
+	"bytes"
+	"errors"
+
+	"github.com/flynn/noise"
+)
+
+// ErrUnexpectedPeerStatic is returned when the remote party transmits a static
+// key during the handshake that differs from the one the endpoint expects.
+var ErrUnexpectedPeerStatic = errors.New("handshake: unexpected peer static key")
 
 type handshakeIdentity interface {
 	GetPublicKey() []byte
 	getRole() role
-	getNoiseConfig() noise.Config
+	getPattern() noise.HandshakePattern
+	presharedKeyCovers(index int) bool
+	getNoiseConfig() (noise.Config, error)
+	verifyPeer(peerStatic []byte) error
+}
+
+// handshakeParams holds the handshake settings both endpoints must agree on.
+type handshakeParams struct {
+	pattern noise.HandshakePattern
+
+	presharedKey          []byte
+	presharedKeyPlacement int
+
+	// roster is only consulted by the admin.
+	roster *Roster
+}
+
+func (p handshakeParams) getPattern() noise.HandshakePattern {
+	if p.pattern.Name == "" {
+		return defaultPattern
+	}
+	return p.pattern
+}
+
+// presharedKeyCovers reports whether the pre-shared key has been mixed into the
+// handshake by the time the message at index is decrypted.
+func (p handshakeParams) presharedKeyCovers(index int) bool {
+	return len(p.presharedKey) > 0 && index >= max(p.presharedKeyPlacement-1, 0)
 }
 
 type clientIdentity struct {
+	handshakeParams
 	AdminPublicKey []byte
 }
 
@@ -16,11 +53,61 @@ func (c clientIdentity) GetPublicKey() []byte { return c.AdminPublicKey }
 
 func (clientIdentity) getRole() role { return initiator }
 
+func (c clientIdentity) verifyPeer(peerStatic []byte) error {
+	return verifyPinnedStatic(c.AdminPublicKey, peerStatic)
+}
+
 type adminIdentity struct {
+	handshakeParams
 	PublicKey  []byte
 	PrivateKey []byte
+
+	// VoterPublicKey is the voter's static key for patterns where the admin must
+	// know it before the handshake starts, such as KK.
+	VoterPublicKey []byte
 }
 
 func (a adminIdentity) GetPublicKey() []byte { return a.PublicKey }
 
 func (adminIdentity) getRole() role { return responder }
+
+// verifyPeer rejects voters that are not enrolled in the roster as soon as
+// their static key is known, before the admin answers the handshake.
+func (a adminIdentity) verifyPeer(peerStatic []byte) error {
+	if a.roster == nil || len(peerStatic) == 0 {
+		return nil
+	}
+	if _, ok := a.roster.Lookup(peerStatic); !ok {
+		return ErrUnknownVoter
+	}
+	return nil
+}
+
+// voterIdentity is a client identity that authenticates itself to the admin
+// with its own static keypair.
+type voterIdentity struct {
+	handshakeParams
+	AdminPublicKey []byte
+	PublicKey      []byte
+	PrivateKey     []byte
+}
+
+func (v voterIdentity) GetPublicKey() []byte { return v.PublicKey }
+
+func (voterIdentity) getRole() role { return initiator }
+
+func (v voterIdentity) verifyPeer(peerStatic []byte) error {
+	return verifyPinnedStatic(v.AdminPublicKey, peerStatic)
+}
+
+// verifyPinnedStatic pins the admin key for patterns where the admin transmits
+// its static key during the handshake instead of it being known in advance.
+func verifyPinnedStatic(expected, peerStatic []byte) error {
+	if len(expected) == 0 || len(peerStatic) == 0 {
+		return nil
+	}
+	if !bytes.Equal(expected, peerStatic) {
+		return ErrUnexpectedPeerStatic
+	}
+	return nil
+}
@@ -1,28 +1,115 @@
 package handshake
 
 import (
+	"errors"
+	"fmt"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto"
 	"github.com/flynn/noise"
 )
 
+var (
+	// ErrMissingStaticKeypair is returned when the selected pattern requires the
+	// local party to have a static keypair and the identity carries none.
+	ErrMissingStaticKeypair = errors.New("handshake: pattern requires a local static keypair")
+
+	// ErrMissingPeerStatic is returned when the selected pattern requires the
+	// remote static key to be known in advance and the identity carries none.
+	ErrMissingPeerStatic = errors.New("handshake: pattern requires a known peer static key")
+
+	// ErrInvalidPresharedKey is returned when the pre-shared key has the wrong
+	// length or is placed outside the pattern's messages.
+	ErrInvalidPresharedKey = errors.New("handshake: invalid pre-shared key")
+)
+
 var cipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
 
-func (c clientIdentity) getNoiseConfig() noise.Config {
-	return noise.Config{
-		Pattern:     noise.HandshakeNK,
-		Initiator:   true,
-		CipherSuite: cipherSuite,
-		PeerStatic:  c.AdminPublicKey,
-	}
+func (c clientIdentity) getNoiseConfig() (noise.Config, error) {
+	return newNoiseConfig(c.handshakeParams, c.getRole(), noise.DHKey{}, c.AdminPublicKey)
 }
 
-func (a adminIdentity) getNoiseConfig() noise.Config {
-	return noise.Config{
-		Pattern:     noise.HandshakeNK,
-		Initiator:   false,
-		CipherSuite: cipherSuite,
-		StaticKeypair: noise.DHKey{
+func (a adminIdentity) getNoiseConfig() (noise.Config, error) {
+	if a.roster != nil && !needsLocalStatic(a.getPattern(), initiator) {
+		return noise.Config{}, fmt.Errorf(
+			"%w: %s",
+			ErrRosterRequiresVoterStatic,
+			a.getPattern().Name,
+		)
+	}
+
+	return newNoiseConfig(
+		a.handshakeParams,
+		a.getRole(),
+		noise.DHKey{
 			Public:  a.PublicKey,
 			Private: a.PrivateKey,
 		},
+		a.VoterPublicKey,
+	)
+}
+
+func (v voterIdentity) getNoiseConfig() (noise.Config, error) {
+	return newNoiseConfig(
+		v.handshakeParams,
+		v.getRole(),
+		noise.DHKey{
+			Public:  v.PublicKey,
+			Private: v.PrivateKey,
+		},
+		v.AdminPublicKey,
+	)
+}
+
+// newNoiseConfig builds the configuration for role, only passing on the keys
+// the selected pattern actually uses.
+func newNoiseConfig(
+	params handshakeParams,
+	role role,
+	staticKeypair noise.DHKey,
+	peerStatic []byte,
+) (noise.Config, error) {
+	pattern := params.getPattern()
+	config := noise.Config{
+		Pattern:     pattern,
+		Initiator:   role == initiator,
+		CipherSuite: cipherSuite,
+	}
+
+	if len(params.presharedKey) > 0 {
+		if len(params.presharedKey) != crypto.PresharedKeySize {
+			return noise.Config{}, fmt.Errorf(
+				"%w: got %d bytes, want %d",
+				ErrInvalidPresharedKey,
+				len(params.presharedKey),
+				crypto.PresharedKeySize,
+			)
+		}
+		if params.presharedKeyPlacement < 0 ||
+			params.presharedKeyPlacement > len(pattern.Messages) {
+			return noise.Config{}, fmt.Errorf(
+				"%w: placement %d outside %s",
+				ErrInvalidPresharedKey,
+				params.presharedKeyPlacement,
+				pattern.Name,
+			)
+		}
+		config.PresharedKey = params.presharedKey
+		config.PresharedKeyPlacement = params.presharedKeyPlacement
 	}
+
+	if needsLocalStatic(pattern, role) {
+		if len(staticKeypair.Private) == 0 {
+			return noise.Config{}, fmt.Errorf("%w: %s", ErrMissingStaticKeypair, pattern.Name)
+		}
+		config.StaticKeypair = staticKeypair
+	}
+
+	if needsPeerStatic(pattern, role) {
+		if len(peerStatic) == 0 {
+			return noise.Config{}, fmt.Errorf("%w: %s", ErrMissingPeerStatic, pattern.Name)
+		}
+		config.PeerStatic = peerStatic
+	}
+
+	return config, nil
 }
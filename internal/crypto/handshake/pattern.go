@@ -1,28 +1,80 @@
 package handshake
 
-type pattern struct {
-	initiator []step
-	responder []step
+import (
+	"slices"
+
+	"github.com/flynn/noise"
+)
+
+// defaultPattern is used by endpoints that do not select a pattern explicitly.
+var defaultPattern = noise.HandshakeNK
+
+// stepsFor derives the handshake steps for role from the message list of pattern.
+//
+// Noise handshake messages alternate between the parties, starting with the
+// initiator, so the initiator sends every even message and the responder every
+// odd one. PSK modifiers only append tokens to existing messages and therefore
+// never change the sequence.
+func stepsFor(pattern noise.HandshakePattern, role role) []step {
+	if role != initiator && role != responder {
+		panic("unknown handshake role")
+	}
+
+	steps := make([]step, len(pattern.Messages))
+	for i := range pattern.Messages {
+		if sentBy(i) == role {
+			steps[i] = stepSend{}
+		} else {
+			steps[i] = stepReceive{}
+		}
+	}
+
+	return steps
 }
 
-var patternNK = pattern{
-	initiator: []step{
-		stepSend{},
-		stepReceive{},
-	},
-	responder: []step{
-		stepReceive{},
-		stepSend{},
-	},
+// sentBy returns the role that writes the handshake message at index.
+func sentBy(index int) role {
+	if index%2 == 0 {
+		return initiator
+	}
+	return responder
 }
 
-func stepsFor(role role) []step {
-	switch role {
-	case initiator:
-		return patternNK.initiator
-	case responder:
-		return patternNK.responder
-	default:
-		panic("unknown handshake role")
+// lastMessageSentBy returns the index of the last handshake message written by
+// role, or -1 if role never writes one (the responder of a one-way pattern).
+func lastMessageSentBy(pattern noise.HandshakePattern, role role) int {
+	for i := len(pattern.Messages) - 1; i >= 0; i-- {
+		if sentBy(i) == role {
+			return i
+		}
 	}
+	return -1
+}
+
+// preMessagesFor returns the pre-messages that role contributes to pattern.
+func preMessagesFor(pattern noise.HandshakePattern, role role) []noise.MessagePattern {
+	if role == initiator {
+		return pattern.InitiatorPreMessages
+	}
+	return pattern.ResponderPreMessages
+}
+
+// needsLocalStatic reports whether role must hold a static keypair to run pattern,
+// either because it is known to the peer in advance or transmitted during the handshake.
+func needsLocalStatic(pattern noise.HandshakePattern, role role) bool {
+	if slices.Contains(preMessagesFor(pattern, role), noise.MessagePatternS) {
+		return true
+	}
+	for i, message := range pattern.Messages {
+		if sentBy(i) == role && slices.Contains(message, noise.MessagePatternS) {
+			return true
+		}
+	}
+	return false
+}
+
+// needsPeerStatic reports whether role must know the remote static key before
+// the handshake starts.
+func needsPeerStatic(pattern noise.HandshakePattern, role role) bool {
+	return slices.Contains(preMessagesFor(pattern, role.peer()), noise.MessagePatternS)
 }
@@ -0,0 +1,133 @@
+package handshake
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+)
+
+func TestStepsForDerivesFromPatternMessages(t *testing.T) {
+	type kind string
+	const (
+		send    kind = "send"
+		receive kind = "receive"
+	)
+
+	kinds := func(steps []step) []kind {
+		out := make([]kind, len(steps))
+		for i, s := range steps {
+			switch s.(type) {
+			case stepSend:
+				out[i] = send
+			case stepReceive:
+				out[i] = receive
+			}
+		}
+		return out
+	}
+
+	tests := []struct {
+		pattern   noise.HandshakePattern
+		initiator []kind
+		responder []kind
+	}{
+		{noise.HandshakeN, []kind{send}, []kind{receive}},
+		{noise.HandshakeNN, []kind{send, receive}, []kind{receive, send}},
+		{noise.HandshakeNK, []kind{send, receive}, []kind{receive, send}},
+		{noise.HandshakeIK, []kind{send, receive}, []kind{receive, send}},
+		{noise.HandshakeKK, []kind{send, receive}, []kind{receive, send}},
+		{noise.HandshakeXX, []kind{send, receive, send}, []kind{receive, send, receive}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern.Name, func(t *testing.T) {
+			if got := kinds(stepsFor(tt.pattern, initiator)); !slices.Equal(got, tt.initiator) {
+				t.Errorf("initiator steps = %v, want %v", got, tt.initiator)
+			}
+			if got := kinds(stepsFor(tt.pattern, responder)); !slices.Equal(got, tt.responder) {
+				t.Errorf("responder steps = %v, want %v", got, tt.responder)
+			}
+		})
+	}
+}
+
+func TestHandshakeWithSelectedPatterns(t *testing.T) {
+	for _, pattern := range []noise.HandshakePattern{
+		noise.HandshakeNN,
+		noise.HandshakeNK,
+		noise.HandshakeNX,
+	} {
+		t.Run(pattern.Name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientEndpoint, adminEndpoint, err := NewAdminEndpoint(WithPattern(pattern))
+			if err != nil {
+				t.Fatalf("failed to create endpoints: %v", err)
+			}
+
+			clientSide, adminSide := newInMemoryPeers()
+			client, admin := establishPair(
+				ctx,
+				t,
+				clientSide,
+				adminSide,
+				clientEndpoint.Identity,
+				adminEndpoint.Identity,
+			)
+
+			go func() { _ = client.Send(ctx, []byte("ping")) }()
+			msg, err := admin.Receive(ctx)
+			if err != nil || string(msg) != "ping" {
+				t.Fatalf("admin receive = %q, %v", msg, err)
+			}
+		})
+	}
+}
+
+func TestHandshakeMissingStaticKeypair(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	clientEndpoint, _, err := NewAdminEndpoint(WithPattern(noise.HandshakeXX))
+	if err != nil {
+		t.Fatalf("failed to create endpoints: %v", err)
+	}
+
+	clientSide, _ := newInMemoryPeers()
+	_, err = Establish(ctx, clientSide, clientEndpoint.Identity)
+	if !errors.Is(err, ErrMissingStaticKeypair) {
+		t.Fatalf("expected ErrMissingStaticKeypair, got %v", err)
+	}
+}
+
+func TestHandshakeRejectsUnexpectedTransmittedStatic(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, adminEndpoint, err := NewAdminEndpoint(WithPattern(noise.HandshakeNX))
+	if err != nil {
+		t.Fatalf("failed to create endpoints: %v", err)
+	}
+	otherClient, _, err := NewAdminEndpoint()
+	if err != nil {
+		t.Fatalf("failed to create endpoints: %v", err)
+	}
+	clientEndpoint := GetClientEndpoint(
+		otherClient.Identity.GetPublicKey(),
+		WithPattern(noise.HandshakeNX),
+	)
+
+	clientSide, adminSide := newInMemoryPeers()
+	clientCh := runHandshakeAsync(ctx, clientSide, clientEndpoint.Identity)
+	adminCh := runHandshakeAsync(ctx, adminSide, adminEndpoint.Identity)
+
+	if res := <-clientCh; !errors.Is(res.err, ErrUnexpectedPeerStatic) {
+		t.Fatalf("expected ErrUnexpectedPeerStatic, got %v", res.err)
+	}
+	<-adminCh
+}
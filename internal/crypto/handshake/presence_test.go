@@ -0,0 +1,125 @@
+package handshake
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/envelope"
+)
+
+func receiveControl(ctx context.Context, t *testing.T, peer Peer) envelope.Control {
+	t.Helper()
+
+	frame, err := peer.Receive(ctx)
+	if err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	e, err := envelope.Unmarshal(frame)
+	if err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	control, err := e.Control()
+	if err != nil {
+		t.Fatalf("control: %v", err)
+	}
+	return control
+}
+
+func TestRouterPresenceEvents(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	router := NewMemoryRouter()
+	adminSide, proxySideAdmin := newInMemoryPeers()
+	router.RegisterAdmin("admin-1", proxySideAdmin)
+
+	_, otherAdmin := newInMemoryPeers()
+	router.RegisterAdmin("admin-2", otherAdmin)
+
+	for _, clientID := range []string{"client-b", "client-a"} {
+		_, proxySideClient := newInMemoryPeers()
+		go router.RegisterClient(clientID, "admin-1", proxySideClient)
+
+		control := receiveControl(ctx, t, adminSide)
+		if control.Kind != envelope.ControlClientConnected ||
+			!slices.Equal(control.ClientIDs, []string{clientID}) {
+			t.Fatalf("got %+v, want %s connected", control, clientID)
+		}
+	}
+
+	if clients := router.ClientsOf("admin-1"); !slices.Equal(
+		clients,
+		[]string{"client-a", "client-b"},
+	) {
+		t.Fatalf("ClientsOf(admin-1) = %v", clients)
+	}
+	if clients := router.ClientsOf("admin-2"); len(clients) != 0 {
+		t.Fatalf("ClientsOf(admin-2) = %v, want none", clients)
+	}
+
+	// The admin can also ask the proxy over its connection.
+	request, err := envelope.NewControl("", envelope.Control{Kind: envelope.ControlListClients})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := request.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = router.RouteFromAdmin(ctx, "admin-1", frame) }()
+
+	control := receiveControl(ctx, t, adminSide)
+	if control.Kind != envelope.ControlClientList ||
+		!slices.Equal(control.ClientIDs, []string{"client-a", "client-b"}) {
+		t.Fatalf("got %+v, want the client list", control)
+	}
+
+	go router.RemoveClient("client-b")
+	control = receiveControl(ctx, t, adminSide)
+	if control.Kind != envelope.ControlClientDisconnected ||
+		!slices.Equal(control.ClientIDs, []string{"client-b"}) {
+		t.Fatalf("got %+v, want client-b disconnected", control)
+	}
+	if clients := router.ClientsOf("admin-1"); !slices.Equal(clients, []string{"client-a"}) {
+		t.Fatalf("ClientsOf(admin-1) = %v after removal", clients)
+	}
+}
+
+func TestRouterRejectsControlFromClients(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	router := NewMemoryRouter()
+	_, proxySideAdmin := newInMemoryPeers()
+	router.RegisterAdmin("admin-1", proxySideAdmin)
+	_, proxySideClient := newInMemoryPeers()
+	if err := router.RegisterClient("client-1", "admin-1", proxySideClient); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := envelope.NewControl("admin-1", envelope.Control{
+		Kind:      envelope.ControlClientDisconnected,
+		ClientIDs: []string{"client-2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := e.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = router.RouteFromClient(ctx, "client-1", frame)
+	if !errors.Is(err, ErrForbiddenControl) {
+		t.Fatalf("expected ErrForbiddenControl, got %v", err)
+	}
+
+	// Admins may only ask for the client list.
+	err = router.RouteFromAdmin(ctx, "admin-1", frame)
+	if !errors.Is(err, ErrForbiddenControl) {
+		t.Fatalf("expected ErrForbiddenControl from admin, got %v", err)
+	}
+}
@@ -3,72 +3,445 @@ package handshake
 import (
 	"context"
 	"errors"
-	"sync"
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/envelope"
+	"github.com/flynn/noise"
 )
 
-type Router struct {
-	admins      map[string]Peer
-	adminsMutex sync.RWMutex
+// DefaultMaxFrameSize fits an envelope around the largest Noise message.
+const DefaultMaxFrameSize = noise.MaxMsgLen + envelope.MaxHeaderSize
+
+var (
+	// ErrForeignDestination is returned when a client addresses an envelope to an
+	// admin other than the one it joined.
+	ErrForeignDestination = errors.New("handshake: client addressed another admin")
+
+	// ErrForeignClient is returned when an admin addresses a client bound to
+	// another admin, or a client ID is registered with a second admin.
+	ErrForeignClient = errors.New("handshake: client belongs to another admin")
+
+	// ErrNotRegistered is returned when a frame comes from a client that is
+	// not currently registered.
+	ErrNotRegistered = errors.New("handshake: sender not registered")
+
+	// ErrUnknownDestination is returned when no peer was ever registered under
+	// the destination ID.
+	ErrUnknownDestination = errors.New("handshake: unknown destination")
+
+	// ErrDestinationDisconnected is returned when the destination was connected
+	// but has gone away and the frame could not be queued, or its connection
+	// failed while forwarding.
+	ErrDestinationDisconnected = errors.New("handshake: destination disconnected")
+
+	// ErrForbiddenControl is returned for control envelopes the sender may not
+	// send: clients may not send any, admins only ControlListClients.
+	ErrForbiddenControl = errors.New("handshake: forbidden control message")
 
-	clients      map[string]Peer
-	clientsMutex sync.RWMutex
+	// ErrPayloadTooLarge is returned for frames longer than the router's limit.
+	ErrPayloadTooLarge = errors.New("handshake: payload too large")
+
+	// ErrRateLimited is returned when the router's RateLimiter refuses a sender.
+	ErrRateLimited = errors.New("handshake: rate limited")
+
+	// ErrClientIDTaken is returned when a client ID is registered while
+	// another connection holds it.
+	ErrClientIDTaken = errors.New("handshake: client id in use")
+)
+
+// RateLimiter decides whether a sender may route another frame.
+type RateLimiter interface {
+	Allow(senderID string) bool
 }
 
-func NewRouter() *Router {
-	return &Router{
-		admins:  make(map[string]Peer),
-		clients: make(map[string]Peer),
+// Direction is the way a frame travels through a Router.
+type Direction int
+
+const (
+	// ToAdmin frames come from clients, or from the router itself, e.g.
+	// presence events.
+	ToAdmin Direction = iota
+	// ToClient frames come from admins.
+	ToClient
+)
+
+func (direction Direction) String() string {
+	switch direction {
+	case ToAdmin:
+		return "to_admin"
+	case ToClient:
+		return "to_client"
+	default:
+		return fmt.Sprintf("Direction(%d)", int(direction))
 	}
 }
 
-// RegisterAdmin sets the peer representing the admin connection.
-func (router *Router) RegisterAdmin(id string, peer Peer) {
-	router.adminsMutex.Lock()
-	defer router.adminsMutex.Unlock()
-	router.admins[id] = peer
+// RouterObserver is told what happens to the frames a Router routes, e.g. to
+// export metrics. Its methods are called synchronously and must not block.
+type RouterObserver interface {
+	// FrameRouted is called for every frame sent or queued to a destination.
+	FrameRouted(direction Direction, size int)
+	// FrameRejected is called with the error RouteFromClient or
+	// RouteFromAdmin returns for a frame they could not route.
+	FrameRejected(direction Direction, err error)
 }
 
-// RemoveAdmin cleans up an admin peer.
-func (router *Router) RemoveAdmin(id string) {
-	router.adminsMutex.Lock()
-	defer router.adminsMutex.Unlock()
-	delete(router.admins, id)
+// Router forwards frames between admins and the clients that joined them.
+// MemoryRouter routes between the peers connected to one process;
+// ClusterRouter also reaches the peers connected to other proxy instances.
+type Router interface {
+	// RegisterAdmin makes peer the connection of admin id, replacing and
+	// closing any previous one.
+	RegisterAdmin(id string, peer Peer) AdminSession
+	// LeaveAdmin removes the admin of session, unless another connection
+	// has registered the admin since.
+	LeaveAdmin(session AdminSession)
+
+	JoinClient(ctx context.Context, adminID string, peer Peer) (ClientSession, error)
+	ResumeClient(ctx context.Context, token, adminID string, peer Peer) (ClientSession, error)
+	LeaveClient(session ClientSession)
+
+	RouteFromClient(ctx context.Context, clientID string, frame []byte) error
+	RouteFromAdmin(ctx context.Context, adminID string, frame []byte) error
+	SendClientList(ctx context.Context, adminID string) error
+	ClientsOf(adminID string) []string
+
+	Stats() RouterStats
+	Gauges() RouterGauges
 }
 
-// RegisterClient adds a client peer to the routing table.
-func (router *Router) RegisterClient(id string, peer Peer) {
-	router.clientsMutex.Lock()
-	defer router.clientsMutex.Unlock()
-	router.clients[id] = peer
+// AdminSession is an admin's registration with a Router.
+type AdminSession struct {
+	ID string
+
+	generation uint64
 }
 
-// RemoveClient cleans up a client peer.
-func (router *Router) RemoveClient(id string) {
-	router.clientsMutex.Lock()
-	defer router.clientsMutex.Unlock()
-	delete(router.clients, id)
+// RouterOption configures a MemoryRouter.
+type RouterOption func(*MemoryRouter)
+
+// WithMaxFrameSize limits the size of every routed frame. It defaults to
+// DefaultMaxFrameSize.
+func WithMaxFrameSize(size int) RouterOption {
+	return func(router *MemoryRouter) {
+		router.maxFrameSize = size
+	}
 }
 
-// RouteToAdmin takes a message from a client and forwards it to a specific admin.
-func (router *Router) RouteToAdmin(ctx context.Context, adminID string, data []byte) error {
-	router.adminsMutex.RLock()
-	admin, ok := router.admins[adminID]
-	router.adminsMutex.RUnlock()
+// WithRateLimiter makes RouteFromClient and RouteFromAdmin consult limiter
+// for every frame. Routers have no rate limit by default.
+func WithRateLimiter(limiter RateLimiter) RouterOption {
+	return func(router *MemoryRouter) {
+		router.rateLimiter = limiter
+	}
+}
 
-	if !ok {
-		return errors.New("target admin not connected")
+// WithObserver reports every routed and rejected frame to observer.
+func WithObserver(observer RouterObserver) RouterOption {
+	return func(router *MemoryRouter) {
+		router.observer = observer
+	}
+}
+
+// MemoryRouter is the Router of a single proxy process. Frames for a
+// destination that disconnected are queued (see WithQueue) and delivered in
+// order when it registers again; frames handed to the router must not be
+// modified afterwards.
+type MemoryRouter struct {
+	admins  *routingTable
+	clients *routingTable
+
+	maxFrameSize int
+	rateLimiter  RateLimiter
+	observer     RouterObserver
+
+	queueLimit int
+	queueTTL   time.Duration
+	now        func() time.Time
+	counters   routerCounters
+	// generations numbers every register and remove, so that a route
+	// registered again after it was forgotten reuses no generation.
+	generations atomic.Uint64
+
+	sessionKey    []byte
+	sessionMaxAge time.Duration
+	issuedTokens  issuedTokens
+
+	// hooks tell a ClusterRouter about changes to the routing tables.
+	hooks routerHooks
+	// adminRegistry checks the admins other cluster nodes announce.
+	adminRegistry *AdminRegistry
+}
+
+var _ Router = (*MemoryRouter)(nil)
+
+func NewMemoryRouter(options ...RouterOption) *MemoryRouter {
+	router := &MemoryRouter{
+		admins:        newRoutingTable(),
+		clients:       newRoutingTable(),
+		maxFrameSize:  DefaultMaxFrameSize,
+		queueLimit:    DefaultQueueLimit,
+		queueTTL:      DefaultQueueTTL,
+		now:           time.Now,
+		sessionKey:    newSessionKey(),
+		sessionMaxAge: DefaultSessionMaxAge,
+	}
+	for _, option := range options {
+		option(router)
+	}
+	router.admins.lastSweep = router.now()
+	router.clients.lastSweep = router.now()
+	return router
+}
+
+// RegisterAdmin sets the peer representing the admin connection and delivers
+// the frames queued while the admin was away. A previous connection of the
+// same admin is replaced and, if it is a Closer, closed.
+func (router *MemoryRouter) RegisterAdmin(id string, peer Peer) AdminSession {
+	generation, replaced, _ := router.register(router.admins, id, "", peer, true)
+	evict(replaced, "admin connected elsewhere")
+	return AdminSession{ID: id, generation: generation}
+}
+
+// LeaveAdmin removes the admin of session, unless another connection has
+// registered the admin since.
+func (router *MemoryRouter) LeaveAdmin(session AdminSession) {
+	router.remove(router.admins, session.ID, session.generation)
+}
+
+// RemoveAdmin cleans up an admin peer, whichever connection registered it.
+func (router *MemoryRouter) RemoveAdmin(id string) {
+	router.remove(router.admins, id, 0)
+}
+
+// RegisterClient adds a client peer that joined adminID to the routing table,
+// delivers the frames queued while the client was away and tells the admin.
+// A client ID is bound to the first admin it joins until the router forgets
+// it; registering it with another admin fails with ErrForeignClient, and
+// registering it while it is connected fails with ErrClientIDTaken. The proxy
+// assigns IDs with JoinClient instead.
+func (router *MemoryRouter) RegisterClient(id, adminID string, peer Peer) error {
+	if _, _, err := router.register(router.clients, id, adminID, peer, false); err != nil {
+		return err
 	}
-	return admin.Send(ctx, data)
+	router.notifyAdmin(adminID, envelope.ControlClientConnected, id)
+	return nil
 }
 
-// RouteToClient takes a message from the admin and forwards it to a specific client.
-func (router *Router) RouteToClient(ctx context.Context, clientID string, data []byte) error {
-	router.clientsMutex.RLock()
-	client, ok := router.clients[clientID]
-	router.clientsMutex.RUnlock()
+// RemoveClient cleans up a client peer and tells its admin.
+func (router *MemoryRouter) RemoveClient(id string) {
+	router.removeClient(id, 0)
+}
 
+func (router *MemoryRouter) removeClient(id string, generation uint64) {
+	if adminID, ok := router.remove(router.clients, id, generation); ok {
+		router.notifyAdmin(adminID, envelope.ControlClientDisconnected, id)
+	}
+}
+
+// ClientsOf returns the sorted IDs of the clients currently connected to adminID.
+func (router *MemoryRouter) ClientsOf(adminID string) []string {
+	router.clients.routesMutex.Lock()
+	defer router.clients.routesMutex.Unlock()
+
+	var ids []string
+	for id, r := range router.clients.routes {
+		if r.peer != nil && r.adminID == adminID {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// notifyAdmin sends a presence event to adminID. Events for an absent admin
+// are queued like any other frame. Delivery is best effort: an admin that
+// missed events can ask for the full list with ControlListClients.
+func (router *MemoryRouter) notifyAdmin(
+	adminID string,
+	kind envelope.ControlKind,
+	clientIDs ...string,
+) {
+	_ = router.sendControl(context.Background(), adminID, kind, clientIDs)
+}
+
+func (router *MemoryRouter) sendControl(
+	ctx context.Context,
+	adminID string,
+	kind envelope.ControlKind,
+	clientIDs []string,
+) error {
+	e, err := envelope.NewControl(adminID, envelope.Control{Kind: kind, ClientIDs: clientIDs})
+	if err != nil {
+		return err
+	}
+	frame, err := e.Marshal()
+	if err != nil {
+		return err
+	}
+	return router.RouteToAdmin(ctx, adminID, frame)
+}
+
+// RouteToAdmin forwards a frame to a specific admin. It does not check who
+// sent the frame; frames from clients go through RouteFromClient instead.
+func (router *MemoryRouter) RouteToAdmin(ctx context.Context, adminID string, data []byte) error {
+	if len(data) > router.maxFrameSize {
+		return fmt.Errorf("%w: %d bytes", ErrPayloadTooLarge, len(data))
+	}
+	return router.route(ctx, router.admins, adminID, "", "admin "+adminID, data)
+}
+
+// RouteToClient takes a message from adminID and forwards it to one of its
+// clients. Clients of other admins are rejected with ErrForeignClient.
+func (router *MemoryRouter) RouteToClient(
+	ctx context.Context,
+	adminID, clientID string,
+	data []byte,
+) error {
+	if len(data) > router.maxFrameSize {
+		return fmt.Errorf("%w: %d bytes", ErrPayloadTooLarge, len(data))
+	}
+	return router.route(ctx, router.clients, clientID, adminID, "client "+clientID, data)
+}
+
+// adminOf returns the admin a connected client is bound to.
+func (router *MemoryRouter) adminOf(clientID string) (string, bool) {
+	router.clients.routesMutex.Lock()
+	defer router.clients.routesMutex.Unlock()
+
+	r, ok := router.clients.routes[clientID]
+	if !ok || r.peer == nil {
+		return "", false
+	}
+	return r.adminID, true
+}
+
+// RouteFromClient forwards an envelope frame sent by clientID to the admin the
+// client is bound to. The source is overwritten with clientID so the admin can
+// trust it.
+func (router *MemoryRouter) RouteFromClient(
+	ctx context.Context,
+	clientID string,
+	frame []byte,
+) error {
+	err := router.routeFromClient(ctx, clientID, frame)
+	router.observeRejected(ToAdmin, err)
+	return err
+}
+
+func (router *MemoryRouter) routeFromClient(
+	ctx context.Context,
+	clientID string,
+	frame []byte,
+) error {
+	if err := router.admit(clientID, frame); err != nil {
+		return err
+	}
+
+	adminID, ok := router.adminOf(clientID)
 	if !ok {
-		return errors.New("client not found")
+		return fmt.Errorf("%w: client %s", ErrNotRegistered, clientID)
+	}
+
+	e, err := envelope.Unmarshal(frame)
+	if err != nil {
+		return err
+	}
+	if e.Destination != "" && e.Destination != adminID {
+		return fmt.Errorf("%w: %q", ErrForeignDestination, e.Destination)
+	}
+	if e.Type == envelope.TypeControl {
+		return ErrForbiddenControl
+	}
+
+	e.Source, e.Destination = clientID, adminID
+	if frame, err = e.Marshal(); err != nil {
+		return err
+	}
+	return router.RouteToAdmin(ctx, adminID, frame)
+}
+
+// RouteFromAdmin forwards an envelope frame sent by adminID to the client in
+// its destination, overwriting the source with adminID.
+func (router *MemoryRouter) RouteFromAdmin(
+	ctx context.Context,
+	adminID string,
+	frame []byte,
+) error {
+	err := router.routeFromAdmin(ctx, adminID, frame)
+	router.observeRejected(ToClient, err)
+	return err
+}
+
+func (router *MemoryRouter) routeFromAdmin(
+	ctx context.Context,
+	adminID string,
+	frame []byte,
+) error {
+	if err := router.admit(adminID, frame); err != nil {
+		return err
+	}
+
+	e, err := envelope.Unmarshal(frame)
+	if err != nil {
+		return err
+	}
+	if e.Type == envelope.TypeControl {
+		return router.handleAdminControl(ctx, adminID, e)
+	}
+
+	e.Source = adminID
+	if frame, err = e.Marshal(); err != nil {
+		return err
+	}
+	return router.RouteToClient(ctx, adminID, e.Destination, frame)
+}
+
+// handleAdminControl answers a control envelope an admin sent to the proxy.
+func (router *MemoryRouter) handleAdminControl(
+	ctx context.Context,
+	adminID string,
+	e envelope.Envelope,
+) error {
+	control, err := e.Control()
+	if err != nil {
+		return err
+	}
+	if control.Kind != envelope.ControlListClients {
+		return fmt.Errorf("%w: %v", ErrForbiddenControl, control.Kind)
+	}
+	return router.SendClientList(ctx, adminID)
+}
+
+// SendClientList sends adminID a ControlClientList of its connected clients.
+// The proxy sends one when an admin registers, so the admin knows that it can
+// be reached and which clients are already there, e.g. after a restart.
+func (router *MemoryRouter) SendClientList(ctx context.Context, adminID string) error {
+	return router.sendControl(ctx, adminID, envelope.ControlClientList, router.ClientsOf(adminID))
+}
+
+// admit applies the size and rate limits to a frame before it is decoded.
+func (router *MemoryRouter) admit(senderID string, frame []byte) error {
+	if len(frame) > router.maxFrameSize {
+		return fmt.Errorf("%w: %d bytes", ErrPayloadTooLarge, len(frame))
+	}
+	if router.rateLimiter != nil && !router.rateLimiter.Allow(senderID) {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+func (router *MemoryRouter) observeRouted(direction Direction, size int) {
+	if router.observer != nil {
+		router.observer.FrameRouted(direction, size)
+	}
+}
+
+func (router *MemoryRouter) observeRejected(direction Direction, err error) {
+	if router.observer != nil && err != nil {
+		router.observer.FrameRejected(direction, err)
 	}
-	return client.Send(ctx, data)
 }
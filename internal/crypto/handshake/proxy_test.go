@@ -2,9 +2,13 @@ package handshake
 
 import (
 	"context"
+	"errors"
+	"io"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/Dsek-LTH/decidr/internal/envelope"
 	"github.com/flynn/noise"
 )
 
@@ -12,7 +16,7 @@ func TestE2EHandshakeThroughProxy(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
-	router := NewRouter()
+	router := NewMemoryRouter()
 	clientIdentity, adminIdentity := getIdentityPair(t)
 
 	// 1. Setup Admin Peer
@@ -22,7 +26,7 @@ func TestE2EHandshakeThroughProxy(t *testing.T) {
 
 	// 2. Setup Client Peer
 	clientSide, proxySideClient := newInMemoryPeers()
-	router.RegisterClient("client-1", proxySideClient)
+	router.RegisterClient("client-1", "admin-1", proxySideClient)
 
 	// 3. Start Proxy Forwarding Loops
 	// These loops represent what the Web Servers will do:
@@ -33,9 +37,8 @@ func TestE2EHandshakeThroughProxy(t *testing.T) {
 			if err != nil {
 				return
 			}
-			// Logic: Admin must prefix message with ClientID or use a protocol
-			// for this test, we just route to our one client.
-			_ = router.RouteToClient(ctx, "client-1", msg)
+			// The envelope names the client the admin addresses.
+			_ = router.RouteFromAdmin(ctx, "admin-1", msg)
 		}
 	}()
 
@@ -45,14 +48,14 @@ func TestE2EHandshakeThroughProxy(t *testing.T) {
 			if err != nil {
 				return
 			}
-			_ = router.RouteToAdmin(ctx, "admin-1", msg)
+			_ = router.RouteFromClient(ctx, "client-1", msg)
 		}
 	}()
 
 	// 4. Perform Handshake (The Actual Logic)
 	// Note: We use the *side* peers. The handshake happens between Admin and Client.
-	clientResCh := runHandshakeAsync(ctx, clientSide, clientIdentity)
-	adminResCh := runHandshakeAsync(ctx, adminSide, adminIdentity)
+	clientResCh := runHandshakeAsync(ctx, envelope.NewPeer(clientSide, "admin-1"), clientIdentity)
+	adminResCh := runHandshakeAsync(ctx, envelope.NewPeer(adminSide, "client-1"), adminIdentity)
 
 	clientRes := <-clientResCh
 	adminRes := <-adminResCh
@@ -74,7 +77,7 @@ func TestMultipleAdminsHandshake(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
-	router := NewRouter()
+	router := NewMemoryRouter()
 
 	// Helper to setup a routed pair
 	setupPair := func(adminID, clientID string) (Peer, Peer) {
@@ -82,7 +85,7 @@ func TestMultipleAdminsHandshake(t *testing.T) {
 		adminSide, proxySideAdmin := newInMemoryPeers()
 
 		router.RegisterAdmin(adminID, proxySideAdmin)
-		router.RegisterClient(clientID, proxySideClient)
+		router.RegisterClient(clientID, adminID, proxySideClient)
 
 		// Forwarding loops (simulating the web server logic)
 		go func() {
@@ -91,7 +94,7 @@ func TestMultipleAdminsHandshake(t *testing.T) {
 				if err != nil {
 					return
 				}
-				_ = router.RouteToClient(ctx, clientID, msg)
+				_ = router.RouteFromAdmin(ctx, adminID, msg)
 			}
 		}()
 		go func() {
@@ -100,11 +103,11 @@ func TestMultipleAdminsHandshake(t *testing.T) {
 				if err != nil {
 					return
 				}
-				_ = router.RouteToAdmin(ctx, adminID, msg)
+				_ = router.RouteFromClient(ctx, clientID, msg)
 			}
 		}()
 
-		return adminSide, clientSide
+		return envelope.NewPeer(adminSide, clientID), envelope.NewPeer(clientSide, adminID)
 	}
 
 	// Setup two distinct admin-client pairs
@@ -140,21 +143,81 @@ func TestMultipleAdminsHandshake(t *testing.T) {
 	if string(outA1.hash) == string(outA2.hash) {
 		t.Error("Different admin pairs produced identical handshake hashes")
 	}
+
+	// Admin-2 cannot inject frames into admin-1's client, neither through its
+	// connection nor through the router API.
+	injected, err := envelope.Envelope{
+		Type:        envelope.TypeData,
+		Destination: client1ID,
+		Payload:     []byte("forged ballot"),
+	}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := router.RouteFromAdmin(ctx, admin2ID, injected); !errors.Is(err, ErrForeignClient) {
+		t.Fatalf("admin-2 -> client-1: expected ErrForeignClient, got %v", err)
+	}
+	err = router.RouteToClient(ctx, admin2ID, client1ID, injected)
+	if !errors.Is(err, ErrForeignClient) {
+		t.Fatalf("RouteToClient as admin-2: expected ErrForeignClient, got %v", err)
+	}
+
+	// Client-2 cannot address admin-1 or take over client-1's ID.
+	crossed, err := envelope.Envelope{
+		Type:        envelope.TypeData,
+		Destination: admin1ID,
+		Payload:     []byte("forged vote"),
+	}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := router.RouteFromClient(
+		ctx,
+		client2ID,
+		crossed,
+	); !errors.Is(
+		err,
+		ErrForeignDestination,
+	) {
+		t.Fatalf("client-2 -> admin-1: expected ErrForeignDestination, got %v", err)
+	}
+	_, hijacker := newInMemoryPeers()
+	if err := router.RegisterClient(
+		client1ID,
+		admin2ID,
+		hijacker,
+	); !errors.Is(
+		err,
+		ErrForeignClient,
+	) {
+		t.Fatalf("re-registering client-1 with admin-2: expected ErrForeignClient, got %v", err)
+	}
+
+	quiet, stop := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer stop()
+	if msg, err := c1Side.Receive(quiet); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("client-1 received %q, %v; want nothing", msg, err)
+	}
+	if msg, err := a1Side.Receive(quiet); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("admin-1 received %q, %v; want nothing", msg, err)
+	}
 }
 
 func TestProxyPostHandshakeCommunication(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
-	router := NewRouter()
+	router := NewMemoryRouter()
 	clientIdentity, adminIdentity := getIdentityPair(t)
 
 	// 1. Setup Peers
-	adminSide, proxySideAdmin := newInMemoryPeers()
-	clientSide, proxySideClient := newInMemoryPeers()
+	adminTransport, proxySideAdmin := newInMemoryPeers()
+	clientTransport, proxySideClient := newInMemoryPeers()
+	adminSide := envelope.NewPeer(adminTransport, "client-1")
+	clientSide := envelope.NewPeer(clientTransport, "admin-1")
 
 	router.RegisterAdmin("admin-1", proxySideAdmin)
-	router.RegisterClient("client-1", proxySideClient)
+	router.RegisterClient("client-1", "admin-1", proxySideClient)
 
 	// 2. Start Routing Loops
 	go func() {
@@ -163,7 +226,7 @@ func TestProxyPostHandshakeCommunication(t *testing.T) {
 			if err != nil {
 				return
 			}
-			_ = router.RouteToClient(ctx, "client-1", msg)
+			_ = router.RouteFromAdmin(ctx, "admin-1", msg)
 		}
 	}()
 	go func() {
@@ -172,7 +235,7 @@ func TestProxyPostHandshakeCommunication(t *testing.T) {
 			if err != nil {
 				return
 			}
-			_ = router.RouteToAdmin(ctx, "admin-1", msg)
+			_ = router.RouteFromClient(ctx, "client-1", msg)
 		}
 	}()
 
@@ -189,14 +252,14 @@ func TestProxyPostHandshakeCommunication(t *testing.T) {
 	go func() {
 		send := func(b []byte) error { return clientSide.Send(ctx, b) }
 		receive := func() ([]byte, error) { return clientSide.Receive(ctx) }
-		s, r, _, err := Perform(ctx, send, receive, clientIdentity)
+		s, r, _, _, err := Perform(ctx, send, receive, clientIdentity)
 		clientDone <- result{s, r, err}
 	}()
 
 	go func() {
 		send := func(b []byte) error { return adminSide.Send(ctx, b) }
 		receive := func() ([]byte, error) { return adminSide.Receive(ctx) }
-		s, r, _, err := Perform(ctx, send, receive, adminIdentity)
+		s, r, _, _, err := Perform(ctx, send, receive, adminIdentity)
 		adminDone <- result{s, r, err}
 	}()
 
@@ -261,3 +324,208 @@ func TestProxyPostHandshakeCommunication(t *testing.T) {
 		}
 	})
 }
+
+func TestEnvelopeRoutingThroughProxy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	router := NewMemoryRouter()
+	clientIdentity, adminIdentity := getIdentityPair(t)
+
+	adminSide, proxySideAdmin := newInMemoryPeers()
+	clientSide, proxySideClient := newInMemoryPeers()
+	router.RegisterAdmin("admin-1", proxySideAdmin)
+	router.RegisterClient("client\n1", "admin-1", proxySideClient)
+
+	routeErrors := make(chan error, 2)
+	go func() {
+		for {
+			msg, err := proxySideAdmin.Receive(ctx)
+			if err != nil {
+				return
+			}
+			if err := router.RouteFromAdmin(ctx, "admin-1", msg); err != nil {
+				routeErrors <- err
+			}
+		}
+	}()
+	go func() {
+		for {
+			msg, err := proxySideClient.Receive(ctx)
+			if err != nil {
+				return
+			}
+			if err := router.RouteFromClient(ctx, "client\n1", msg); err != nil {
+				routeErrors <- err
+			}
+		}
+	}()
+
+	// A newline in the client ID no longer confuses the framing.
+	adminPeer := envelope.NewPeer(clientSide, "admin-1")
+	clientPeer := envelope.NewPeer(adminSide, "client\n1")
+	client, admin := establishPair(
+		ctx,
+		t,
+		adminPeer.As(envelope.TypeHandshake),
+		clientPeer.As(envelope.TypeHandshake),
+		clientIdentity,
+		adminIdentity,
+	)
+	client.SetTransport(adminPeer)
+	admin.SetTransport(clientPeer)
+
+	go func() { _ = client.Send(ctx, []byte("secret vote cast")) }()
+	if msg, err := admin.Receive(ctx); err != nil || string(msg) != "secret vote cast" {
+		t.Fatalf("admin received %q, %v", msg, err)
+	}
+
+	// Malformed frames and frames for another admin are rejected, not dropped.
+	go func() { _ = clientSide.Send(ctx, []byte("client-1\nlegacy frame")) }()
+	if err := <-routeErrors; !errors.Is(err, envelope.ErrUnsupportedVersion) {
+		t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+	}
+
+	go func() { _ = envelope.NewPeer(clientSide, "admin-2").Send(ctx, []byte("hi")) }()
+	if err := <-routeErrors; !errors.Is(err, ErrForeignDestination) {
+		t.Fatalf("expected ErrForeignDestination, got %v", err)
+	}
+}
+
+type denyAll struct{}
+
+func (denyAll) Allow(string) bool { return false }
+
+func TestRouterDeliveryFailures(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	frame, err := envelope.Envelope{Type: envelope.TypeData, Payload: []byte("vote")}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := NewMemoryRouter(WithMaxFrameSize(64), WithQueue(0, 0))
+	_, proxySideAdmin := newInMemoryPeers()
+	_, proxySideClient := newInMemoryPeers()
+	if err := router.RegisterClient("client-1", "admin-1", proxySideClient); err != nil {
+		t.Fatal(err)
+	}
+
+	err = router.RouteFromClient(ctx, "client-1", frame)
+	if !errors.Is(err, ErrUnknownDestination) {
+		t.Fatalf("never connected: expected ErrUnknownDestination, got %v", err)
+	}
+
+	router.RegisterAdmin("admin-1", proxySideAdmin)
+	router.RemoveAdmin("admin-1")
+	err = router.RouteFromClient(ctx, "client-1", frame)
+	if !errors.Is(err, ErrDestinationDisconnected) {
+		t.Fatalf("removed: expected ErrDestinationDisconnected, got %v", err)
+	}
+
+	broken := inMemoryPeer{
+		sendFunc: func(context.Context, []byte) error { return io.ErrClosedPipe },
+	}
+	router.RegisterAdmin("admin-1", broken)
+	err = router.RouteFromClient(ctx, "client-1", frame)
+	if !errors.Is(err, ErrDestinationDisconnected) || !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("broken: expected ErrDestinationDisconnected wrapping the send error, got %v", err)
+	}
+
+	err = router.RouteFromAdmin(ctx, "admin-1", make([]byte, 65))
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("expected ErrPayloadTooLarge, got %v", err)
+	}
+
+	limited := NewMemoryRouter(WithRateLimiter(denyAll{}))
+	limited.RegisterAdmin("admin-1", proxySideAdmin)
+	err = limited.RouteFromClient(ctx, "client-1", frame)
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+}
+
+// recordingObserver counts the frames a router reports.
+type recordingObserver struct {
+	mutex    sync.Mutex
+	routed   map[Direction]int
+	bytes    map[Direction]int
+	rejected []error
+}
+
+func (o *recordingObserver) FrameRouted(direction Direction, size int) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.routed[direction]++
+	o.bytes[direction] += size
+}
+
+func (o *recordingObserver) FrameRejected(_ Direction, err error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.rejected = append(o.rejected, err)
+}
+
+func TestRouterObserverAndGauges(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	observer := &recordingObserver{routed: map[Direction]int{}, bytes: map[Direction]int{}}
+	router := NewMemoryRouter(WithObserver(observer))
+	discard := inMemoryPeer{sendFunc: func(context.Context, []byte) error { return nil }}
+
+	router.RegisterAdmin("admin-1", discard)
+	if err := router.RegisterClient("client-1", "admin-1", discard); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.RegisterClient("client-2", "admin-1", discard); err != nil {
+		t.Fatal(err)
+	}
+	router.RemoveClient("client-2")
+
+	toClient := func(id string) []byte {
+		frame, err := envelope.Envelope{
+			Type: envelope.TypeData,
+			// The router sets the source; setting it here keeps the size.
+			Source:      "admin-1",
+			Destination: id,
+			Payload:     []byte("ballot"),
+		}.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return frame
+	}
+	if err := router.RouteFromAdmin(ctx, "admin-1", toClient("client-1")); err != nil {
+		t.Fatal(err)
+	}
+	// Queued for the absent client.
+	if err := router.RouteFromAdmin(ctx, "admin-1", toClient("client-2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.RouteFromAdmin(ctx, "admin-1", toClient("nobody")); err == nil {
+		t.Fatal("routing to an unknown client succeeded")
+	}
+
+	if gauges := router.Gauges(); gauges != (RouterGauges{
+		Admins:       1,
+		Clients:      1,
+		QueuedFrames: 1,
+	}) {
+		t.Fatalf("gauges = %+v", gauges)
+	}
+
+	observer.mutex.Lock()
+	defer observer.mutex.Unlock()
+	// Three presence events went to the admin.
+	if observer.routed[ToAdmin] != 3 || observer.routed[ToClient] != 2 {
+		t.Fatalf("routed = %v", observer.routed)
+	}
+	if observer.bytes[ToClient] != len(toClient("client-1"))+len(toClient("client-2")) {
+		t.Fatalf("bytes = %v", observer.bytes)
+	}
+	if len(observer.rejected) != 1 || !errors.Is(observer.rejected[0], ErrUnknownDestination) {
+		t.Fatalf("rejected = %v", observer.rejected)
+	}
+}
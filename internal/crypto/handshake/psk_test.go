@@ -0,0 +1,120 @@
+package handshake
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto"
+)
+
+func TestPresharedKeyHandshakeMatchingPassphrase(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	chairKey := crypto.DeriveMeetingKey("Blue  Horse Battery", "annual-meeting")
+	voterKey := crypto.DeriveMeetingKey(" blue horse battery", "annual-meeting")
+
+	clientEndpoint, adminEndpoint, err := NewAdminEndpoint(WithPresharedKey(chairKey, 2))
+	if err != nil {
+		t.Fatalf("failed to create endpoints: %v", err)
+	}
+	clientEndpoint = GetClientEndpoint(
+		clientEndpoint.Identity.GetPublicKey(),
+		WithPresharedKey(voterKey, 2),
+	)
+
+	clientSide, adminSide := newInMemoryPeers()
+	client, admin := establishPair(
+		ctx,
+		t,
+		clientSide,
+		adminSide,
+		clientEndpoint.Identity,
+		adminEndpoint.Identity,
+	)
+
+	go func() { _ = client.Send(ctx, []byte("present")) }()
+	if msg, err := admin.Receive(ctx); err != nil || string(msg) != "present" {
+		t.Fatalf("admin receive = %q, %v", msg, err)
+	}
+}
+
+func TestPresharedKeyHandshakeWrongPassphrase(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	clientEndpoint, adminEndpoint, err := NewAdminEndpoint(
+		WithPresharedKey(crypto.DeriveMeetingKey("blue horse", "annual-meeting"), 2),
+	)
+	if err != nil {
+		t.Fatalf("failed to create endpoints: %v", err)
+	}
+	clientEndpoint = GetClientEndpoint(
+		clientEndpoint.Identity.GetPublicKey(),
+		WithPresharedKey(crypto.DeriveMeetingKey("red horse", "annual-meeting"), 2),
+	)
+
+	clientSide, adminSide := newInMemoryPeers()
+	clientCh := runHandshakeAsync(ctx, clientSide, clientEndpoint.Identity)
+	adminCh := runHandshakeAsync(ctx, adminSide, adminEndpoint.Identity)
+
+	if res := <-clientCh; !errors.Is(res.err, ErrPresharedKeyMismatch) {
+		t.Fatalf("expected ErrPresharedKeyMismatch, got %v", res.err)
+	}
+	if res := <-adminCh; res.err != nil {
+		t.Fatalf("admin cannot detect the mismatch during NKpsk2, got %v", res.err)
+	}
+}
+
+func TestPresharedKeyWrongAdminKeyIsNotReportedAsMismatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// A wrong admin key is detected by the admin reading the first message, which
+	// NKpsk2 does not cover yet.
+	_, adminEndpoint, err := NewAdminEndpoint(
+		WithPresharedKey(crypto.DeriveMeetingKey("blue horse", "m"), 2),
+	)
+	if err != nil {
+		t.Fatalf("failed to create endpoints: %v", err)
+	}
+	otherClient, _, err := NewAdminEndpoint()
+	if err != nil {
+		t.Fatalf("failed to create endpoints: %v", err)
+	}
+	clientEndpoint := GetClientEndpoint(
+		otherClient.Identity.GetPublicKey(),
+		WithPresharedKey(crypto.DeriveMeetingKey("blue horse", "m"), 2),
+	)
+
+	clientSide, adminSide := newInMemoryPeers()
+	clientCh := runHandshakeAsync(ctx, clientSide, clientEndpoint.Identity)
+	adminCh := runHandshakeAsync(ctx, adminSide, adminEndpoint.Identity)
+
+	res := <-adminCh
+	if res.err == nil || errors.Is(res.err, ErrPresharedKeyMismatch) {
+		t.Fatalf("expected a plain read failure, got %v", res.err)
+	}
+	cancel()
+	<-clientCh
+}
+
+func TestPresharedKeyInvalidLength(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	clientEndpoint, _, err := NewAdminEndpoint(WithPresharedKey([]byte("too short"), 2))
+	if err != nil {
+		t.Fatalf("failed to create endpoints: %v", err)
+	}
+
+	clientSide, _ := newInMemoryPeers()
+	if _, err := Establish(ctx, clientSide, clientEndpoint.Identity); !errors.Is(
+		err,
+		ErrInvalidPresharedKey,
+	) {
+		t.Fatalf("expected ErrInvalidPresharedKey, got %v", err)
+	}
+}
@@ -0,0 +1,350 @@
+package handshake
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultQueueLimit is the number of frames held for an absent destination.
+	DefaultQueueLimit = 64
+
+	// DefaultQueueTTL is how long a frame for an absent destination is kept.
+	DefaultQueueTTL = 30 * time.Second
+
+	// queueSweepInterval is how often a routing table drops its expired
+	// frames and forgets the destinations that have been absent for longer
+	// than the queue TTL.
+	queueSweepInterval = time.Second
+)
+
+// WithQueue sets how many frames the router holds for each destination that
+// disconnected, and for how long. A limit of zero disables queueing, so
+// frames for absent destinations fail with ErrDestinationDisconnected. A
+// destination that has been absent for longer than ttl with nothing queued is
+// forgotten, and frames for it fail with ErrUnknownDestination.
+func WithQueue(limit int, ttl time.Duration) RouterOption {
+	return func(router *MemoryRouter) {
+		router.queueLimit = limit
+		router.queueTTL = ttl
+	}
+}
+
+// WithClock replaces time.Now for expiring queued frames, absent destinations
+// and resumption tokens, e.g. in tests.
+func WithClock(now func() time.Time) RouterOption {
+	return func(router *MemoryRouter) {
+		router.now = now
+	}
+}
+
+// RouterStats counts what happened to frames routed to absent destinations.
+type RouterStats struct {
+	// Queued frames were held for a destination that had disconnected.
+	Queued uint64
+	// Flushed frames were delivered after their destination re-registered.
+	Flushed uint64
+	// DroppedExpired frames were discarded after waiting longer than the TTL.
+	DroppedExpired uint64
+	// DroppedFull frames were rejected because the destination's queue was full.
+	DroppedFull uint64
+}
+
+type routerCounters struct {
+	queued         atomic.Uint64
+	flushed        atomic.Uint64
+	droppedExpired atomic.Uint64
+	droppedFull    atomic.Uint64
+}
+
+// Stats returns the router's queueing counters since it was created.
+func (router *MemoryRouter) Stats() RouterStats {
+	return RouterStats{
+		Queued:         router.counters.queued.Load(),
+		Flushed:        router.counters.flushed.Load(),
+		DroppedExpired: router.counters.droppedExpired.Load(),
+		DroppedFull:    router.counters.droppedFull.Load(),
+	}
+}
+
+// RouterGauges describes a router's routing tables at one moment.
+type RouterGauges struct {
+	// Admins and Clients are the connected destinations.
+	Admins  int
+	Clients int
+	// QueuedFrames are held for destinations that are absent or being
+	// flushed to.
+	QueuedFrames int
+}
+
+// Gauges returns the router's current connections and queue depth.
+func (router *MemoryRouter) Gauges() RouterGauges {
+	var gauges RouterGauges
+	gauges.Admins, gauges.QueuedFrames = router.count(router.admins)
+	clients, queued := router.count(router.clients)
+	gauges.Clients = clients
+	gauges.QueuedFrames += queued
+	return gauges
+}
+
+type queuedFrame struct {
+	data    []byte
+	expires time.Time
+}
+
+// route is a destination that is connected now or was connected before.
+type route struct {
+	// peer is nil while the destination is absent.
+	peer Peer
+	// adminID is the admin a client route belongs to; empty for admins.
+	adminID string
+	// queue holds frames in routing order while the destination is absent,
+	// or while it is being flushed to a peer that just re-registered.
+	queue    []queuedFrame
+	flushing bool
+	// generation changes on every register and remove, so a flush can tell
+	// that its peer was replaced. Peers are not necessarily comparable.
+	generation uint64
+	// left is when the destination became absent.
+	left time.Time
+}
+
+// routingTable holds the routes of either the admins or the clients.
+type routingTable struct {
+	routes      map[string]*route
+	lastSweep   time.Time
+	routesMutex sync.Mutex
+}
+
+func newRoutingTable() *routingTable {
+	return &routingTable{routes: make(map[string]*route)}
+}
+
+// routerHooks are called with the table locked whenever a peer is registered
+// or removed, so they see the changes to each table in order.
+type routerHooks struct {
+	registered func(table *routingTable, id, adminID string, peer Peer)
+	removed    func(table *routingTable, id string, peer Peer)
+}
+
+// count returns the number of routes connected to this process and of queued
+// frames. Peers of other cluster nodes are not counted.
+func (router *MemoryRouter) count(table *routingTable) (connected, queued int) {
+	table.routesMutex.Lock()
+	defer table.routesMutex.Unlock()
+
+	router.sweep(table)
+	for _, r := range table.routes {
+		if _, remote := r.peer.(*remotePeer); r.peer != nil && !remote {
+			connected++
+		}
+		queued += len(r.queue)
+	}
+	return connected, queued
+}
+
+// register sets the peer for id and delivers the frames queued while id was
+// absent, in order, before any frame routed afterwards. Unless replace is set,
+// registering an id that is connected fails with ErrClientIDTaken; otherwise
+// the peer it replaces is returned so the caller can disconnect it.
+//
+// A client route stays bound to the admin it first registered with, so that
+// frames queued by one admin never reach a client of another.
+func (router *MemoryRouter) register(
+	table *routingTable,
+	id, adminID string,
+	peer Peer,
+	replace bool,
+) (generation uint64, replaced Peer, err error) {
+	table.routesMutex.Lock()
+	router.sweep(table)
+	r, ok := table.routes[id]
+	if ok && r.adminID != adminID {
+		table.routesMutex.Unlock()
+		return 0, nil, fmt.Errorf("%w: %s", ErrForeignClient, id)
+	}
+	if ok && r.peer != nil && !replace {
+		table.routesMutex.Unlock()
+		return 0, nil, fmt.Errorf("%w: %s", ErrClientIDTaken, id)
+	}
+	if !ok {
+		r = &route{}
+		table.routes[id] = r
+	}
+	replaced = r.peer
+	r.peer = peer
+	r.adminID = adminID
+	r.flushing = len(r.queue) > 0
+	r.generation = router.generations.Add(1)
+	generation = r.generation
+	if router.hooks.registered != nil {
+		router.hooks.registered(table, id, adminID, peer)
+	}
+	table.routesMutex.Unlock()
+
+	for {
+		table.routesMutex.Lock()
+		frames := r.queue
+		r.queue = nil
+		if len(frames) == 0 || r.generation != generation {
+			r.queue = frames
+			if r.generation == generation {
+				r.flushing = false
+			}
+			table.routesMutex.Unlock()
+			return generation, replaced, nil
+		}
+		table.routesMutex.Unlock()
+
+		if sent := router.flush(peer, frames); sent < len(frames) {
+			// The peer failed; keep the rest for its next registration.
+			table.routesMutex.Lock()
+			r.queue = append(frames[sent:], r.queue...)
+			if r.generation == generation {
+				r.flushing = false
+			}
+			table.routesMutex.Unlock()
+			return generation, replaced, nil
+		}
+	}
+}
+
+// flush sends frames to peer until one fails and returns how many were
+// handled, counting expired frames as handled.
+func (router *MemoryRouter) flush(peer Peer, frames []queuedFrame) int {
+	now := router.now()
+	for i, frame := range frames {
+		if !now.Before(frame.expires) {
+			router.counters.droppedExpired.Add(1)
+			continue
+		}
+		if err := peer.Send(context.Background(), frame.data); err != nil {
+			return i
+		}
+		router.counters.flushed.Add(1)
+	}
+	return len(frames)
+}
+
+// remove marks id as absent; frames routed to it are queued from now on, until
+// a sweep forgets it. Unless generation is zero, id is only removed if it has
+// not registered again since that generation. It returns the admin the route
+// belonged to and whether id was removed.
+func (router *MemoryRouter) remove(
+	table *routingTable,
+	id string,
+	generation uint64,
+) (adminID string, ok bool) {
+	table.routesMutex.Lock()
+	defer table.routesMutex.Unlock()
+
+	r, ok := table.routes[id]
+	if !ok || r.peer == nil || (generation != 0 && r.generation != generation) {
+		return "", false
+	}
+	if router.hooks.removed != nil {
+		router.hooks.removed(table, id, r.peer)
+	}
+	r.peer = nil
+	r.flushing = false
+	r.generation = router.generations.Add(1)
+	r.left = router.now()
+	return r.adminID, true
+}
+
+// route sends data to id, or queues it if id is absent or still being flushed.
+// Unless owner is empty, the route must belong to that admin.
+func (router *MemoryRouter) route(
+	ctx context.Context,
+	table *routingTable,
+	id, owner, name string,
+	data []byte,
+) error {
+	table.routesMutex.Lock()
+	router.sweep(table)
+	r, ok := table.routes[id]
+	if !ok {
+		table.routesMutex.Unlock()
+		return fmt.Errorf("%w: %s", ErrUnknownDestination, name)
+	}
+	if owner != "" && r.adminID != owner {
+		table.routesMutex.Unlock()
+		return fmt.Errorf("%w: %s", ErrForeignClient, name)
+	}
+	if r.peer == nil || r.flushing {
+		err := router.enqueue(r, name, data)
+		table.routesMutex.Unlock()
+		if err == nil {
+			router.observeRouted(router.direction(table), len(data))
+		}
+		return err
+	}
+	peer := r.peer
+	table.routesMutex.Unlock()
+
+	if err := peer.Send(ctx, data); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrDestinationDisconnected, name, err)
+	}
+	router.observeRouted(router.direction(table), len(data))
+	return nil
+}
+
+// direction returns which way frames routed to table travel.
+func (router *MemoryRouter) direction(table *routingTable) Direction {
+	if table == router.admins {
+		return ToAdmin
+	}
+	return ToClient
+}
+
+// enqueue must be called with the table locked.
+func (router *MemoryRouter) enqueue(r *route, name string, data []byte) error {
+	now := router.now()
+	router.dropExpired(r, now)
+
+	if router.queueLimit == 0 {
+		return fmt.Errorf("%w: %s", ErrDestinationDisconnected, name)
+	}
+	if len(r.queue) >= router.queueLimit {
+		router.counters.droppedFull.Add(1)
+		return fmt.Errorf("%w: %s: queue full", ErrDestinationDisconnected, name)
+	}
+
+	r.queue = append(r.queue, queuedFrame{data: data, expires: now.Add(router.queueTTL)})
+	router.counters.queued.Add(1)
+	return nil
+}
+
+// dropExpired must be called with the table locked.
+func (router *MemoryRouter) dropExpired(r *route, now time.Time) {
+	for len(r.queue) > 0 && !now.Before(r.queue[0].expires) {
+		r.queue[0] = queuedFrame{}
+		r.queue = r.queue[1:]
+		router.counters.droppedExpired.Add(1)
+	}
+	if len(r.queue) == 0 {
+		// Lets the frames be collected.
+		r.queue = nil
+	}
+}
+
+// sweep drops the expired frames in table and forgets the destinations that
+// have been absent for longer than the queue TTL with nothing queued, at most
+// once per queueSweepInterval. It must be called with the table locked.
+func (router *MemoryRouter) sweep(table *routingTable) {
+	now := router.now()
+	if now.Sub(table.lastSweep) < queueSweepInterval {
+		return
+	}
+	table.lastSweep = now
+
+	for id, r := range table.routes {
+		router.dropExpired(r, now)
+		if r.peer == nil && len(r.queue) == 0 && !now.Before(r.left.Add(router.queueTTL)) {
+			delete(table.routes, id)
+		}
+	}
+}
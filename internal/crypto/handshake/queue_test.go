@@ -0,0 +1,249 @@
+package handshake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func receiveN(ctx context.Context, t *testing.T, peer Peer, n int) []string {
+	t.Helper()
+
+	var got []string
+	for range n {
+		msg, err := peer.Receive(ctx)
+		if err != nil {
+			t.Fatalf("receive %d: %v", len(got), err)
+		}
+		got = append(got, string(msg))
+	}
+	return got
+}
+
+func TestRouterQueuesForAbsentClient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	router := NewMemoryRouter()
+	_, proxySide := newInMemoryPeers()
+	router.RegisterClient("client-1", "admin-1", proxySide)
+	router.RemoveClient("client-1")
+
+	for i := range 3 {
+		frame := fmt.Appendf(nil, "frame %d", i)
+		if err := router.RouteToClient(ctx, "admin-1", "client-1", frame); err != nil {
+			t.Fatalf("route while absent: %v", err)
+		}
+	}
+
+	// The client reconnects on a new socket.
+	clientSide, proxySide := newInMemoryPeers()
+	registered := make(chan struct{})
+	go func() {
+		router.RegisterClient("client-1", "admin-1", proxySide)
+		close(registered)
+	}()
+
+	got := receiveN(ctx, t, clientSide, 3)
+	<-registered
+
+	if err := router.RouteToClient(ctx, "admin-1", "client-1", []byte("frame 3")); err != nil {
+		t.Fatalf("route after reconnect: %v", err)
+	}
+	got = append(got, receiveN(ctx, t, clientSide, 1)...)
+
+	want := []string{"frame 0", "frame 1", "frame 2", "frame 3"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if stats := router.Stats(); stats.Queued != 3 || stats.Flushed != 3 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestRouterQueueLimits(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	router := NewMemoryRouter(WithQueue(2, time.Minute), WithClock(clock.Now))
+
+	_, proxySide := newInMemoryPeers()
+	router.RegisterAdmin("admin-1", proxySide)
+	router.RemoveAdmin("admin-1")
+
+	for _, frame := range []string{"stale", "fresh"} {
+		if err := router.RouteToAdmin(ctx, "admin-1", []byte(frame)); err != nil {
+			t.Fatalf("route %q: %v", frame, err)
+		}
+		clock.Advance(40 * time.Second)
+	}
+
+	// "stale" has expired by now and makes room for one more frame.
+	if err := router.RouteToAdmin(ctx, "admin-1", []byte("newest")); err != nil {
+		t.Fatalf("route after expiry: %v", err)
+	}
+	err := router.RouteToAdmin(ctx, "admin-1", []byte("overflow"))
+	if !errors.Is(err, ErrDestinationDisconnected) {
+		t.Fatalf("expected ErrDestinationDisconnected for a full queue, got %v", err)
+	}
+
+	// "fresh" expires before the admin comes back.
+	clock.Advance(30 * time.Second)
+
+	adminSide, proxySide := newInMemoryPeers()
+	go router.RegisterAdmin("admin-1", proxySide)
+
+	if got := receiveN(ctx, t, adminSide, 1); got[0] != "newest" {
+		t.Fatalf("got %q, want newest", got[0])
+	}
+
+	want := RouterStats{Queued: 3, Flushed: 1, DroppedExpired: 2, DroppedFull: 1}
+	if stats := router.Stats(); stats != want {
+		t.Fatalf("stats = %+v, want %+v", stats, want)
+	}
+}
+
+func TestRouterKeepsQueueWhenFlushFails(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	router := NewMemoryRouter()
+	_, proxySide := newInMemoryPeers()
+	router.RegisterClient("client-1", "admin-1", proxySide)
+	router.RemoveClient("client-1")
+
+	for _, frame := range []string{"a", "b"} {
+		if err := router.RouteToClient(ctx, "admin-1", "client-1", []byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	broken := inMemoryPeer{
+		sendFunc: func(context.Context, []byte) error { return errors.New("socket closed") },
+	}
+	router.RegisterClient("client-1", "admin-1", broken)
+	router.RemoveClient("client-1")
+
+	clientSide, proxySide := newInMemoryPeers()
+	go router.RegisterClient("client-1", "admin-1", proxySide)
+
+	if got := receiveN(ctx, t, clientSide, 2); fmt.Sprint(got) != "[a b]" {
+		t.Fatalf("got %q, want [a b]", got)
+	}
+}
+
+func TestRouterQueueDisabled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	router := NewMemoryRouter(WithQueue(0, 0))
+	_, proxySide := newInMemoryPeers()
+	router.RegisterClient("client-1", "admin-1", proxySide)
+	router.RemoveClient("client-1")
+
+	err := router.RouteToClient(ctx, "admin-1", "client-1", []byte("lost"))
+	if !errors.Is(err, ErrDestinationDisconnected) {
+		t.Fatalf("expected ErrDestinationDisconnected, got %v", err)
+	}
+	if stats := router.Stats(); stats != (RouterStats{}) {
+		t.Fatalf("stats = %+v, want zero", stats)
+	}
+}
+
+func TestRouterSweepsExpiredFrames(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	router := NewMemoryRouter(WithQueue(4, time.Minute), WithClock(clock.Now))
+
+	_, proxySide := newInMemoryPeers()
+	if err := router.RegisterClient("client-1", "admin-1", proxySide); err != nil {
+		t.Fatal(err)
+	}
+	router.RemoveClient("client-1")
+	for _, frame := range []string{"a", "b"} {
+		if err := router.RouteToClient(ctx, "admin-1", "client-1", []byte(frame)); err != nil {
+			t.Fatalf("route %q: %v", frame, err)
+		}
+	}
+	if queued := router.Gauges().QueuedFrames; queued != 2 {
+		t.Fatalf("queued frames = %d, want 2", queued)
+	}
+
+	// Nothing is routed to client-1 again, but its frames still expire.
+	clock.Advance(time.Minute)
+	if queued := router.Gauges().QueuedFrames; queued != 0 {
+		t.Fatalf("queued frames = %d, want 0", queued)
+	}
+	if stats := router.Stats(); stats.DroppedExpired != 2 {
+		t.Fatalf("stats = %+v, want 2 dropped as expired", stats)
+	}
+}
+
+func TestRouterForgetsAbsentClients(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	router := NewMemoryRouter(WithQueue(4, time.Minute), WithClock(clock.Now))
+
+	_, proxySide := newInMemoryPeers()
+	session, err := router.JoinClient(ctx, "admin-1", proxySide)
+	if err != nil {
+		t.Fatalf("JoinClient: %v", err)
+	}
+	router.LeaveClient(session)
+
+	// An absent client is remembered for the queue TTL.
+	clock.Advance(30 * time.Second)
+	if err := router.RouteToClient(ctx, "admin-1", session.ID, []byte("a")); err != nil {
+		t.Fatalf("route within the TTL: %v", err)
+	}
+
+	// It is forgotten once it has been away for the TTL with nothing queued.
+	clock.Advance(time.Minute)
+	router.Gauges()
+	router.clients.routesMutex.Lock()
+	remembered := len(router.clients.routes)
+	router.clients.routesMutex.Unlock()
+	if remembered != 0 {
+		t.Fatalf("%d client routes remembered, want 0", remembered)
+	}
+	err = router.RouteToClient(ctx, "admin-1", session.ID, []byte("b"))
+	if !errors.Is(err, ErrUnknownDestination) {
+		t.Fatalf("expected ErrUnknownDestination for a forgotten client, got %v", err)
+	}
+
+	// The token still resumes the session, and the old connection leaving
+	// again does not remove the new one.
+	_, proxySide = newInMemoryPeers()
+	if _, err := router.ResumeClient(ctx, session.Token, "admin-1", proxySide); err != nil {
+		t.Fatalf("ResumeClient: %v", err)
+	}
+	router.LeaveClient(session)
+	if ids := router.ClientsOf("admin-1"); len(ids) != 1 || ids[0] != session.ID {
+		t.Fatalf("ClientsOf = %q, want [%s]", ids, session.ID)
+	}
+}
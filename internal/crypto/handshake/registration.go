@@ -0,0 +1,484 @@
+package handshake
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto"
+	"github.com/Dsek-LTH/decidr/internal/envelope"
+)
+
+const (
+	// ChallengeSize is the length of the nonce an admin signs to register.
+	ChallengeSize = 32
+
+	// DefaultPinLimit is how many admin IDs a registry pins at most.
+	DefaultPinLimit = 10_000
+
+	// DefaultPinTTL is how long an admin ID stays pinned after its admin
+	// last disconnected, once the pin is confirmed.
+	DefaultPinTTL = 30 * 24 * time.Hour
+
+	// DefaultPinConfirmation is how long an admin must stay connected for
+	// the pin of its ID to be confirmed.
+	DefaultPinConfirmation = 10 * time.Minute
+
+	// DefaultUnconfirmedPinTTL is how long an admin ID stays pinned after its
+	// admin last disconnected while the pin is not confirmed.
+	DefaultUnconfirmedPinTTL = 10 * time.Minute
+)
+
+// registrationDomain separates registration signatures from anything else the
+// admin signing key might sign.
+const registrationDomain = "decidr admin registration v1\x00"
+
+var (
+	// ErrChallengeFailed is returned when an admin does not answer the
+	// registration challenge with a valid signature.
+	ErrChallengeFailed = errors.New("handshake: admin challenge failed")
+
+	// ErrAdminKeyMismatch is returned when an admin proves possession of a key
+	// other than the one bound to its ID.
+	ErrAdminKeyMismatch = errors.New("handshake: admin key does not match its id")
+
+	// ErrInvalidAdminID is returned for admin IDs ValidAdminID rejects.
+	ErrInvalidAdminID = errors.New("handshake: invalid admin id")
+
+	// ErrTooManyAdmins is returned when a registry cannot pin another admin
+	// ID because it holds as many pins as it may, all of them in use.
+	ErrTooManyAdmins = errors.New("handshake: too many admin ids pinned")
+)
+
+// ValidAdminID reports whether id can name an admin: it must be 1 to
+// envelope.MaxIDLength bytes of printable UTF-8 without spaces and must not
+// start with '#', so that it reads the same in logs and in files of admin
+// keys.
+func ValidAdminID(id string) bool {
+	if id == "" || len(id) > envelope.MaxIDLength || strings.HasPrefix(id, "#") ||
+		!utf8.ValidString(id) {
+		return false
+	}
+	for _, r := range id {
+		if r == ' ' || !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// AdminPin is the signing key an admin ID is pinned to.
+type AdminPin struct {
+	Key ed25519.PublicKey
+	// Confirmed is set once an admin stayed connected with Key long enough
+	// (see WithPinConfirmation).
+	Confirmed bool
+}
+
+// AdminRegistryOption configures an AdminRegistry that pins admin IDs.
+type AdminRegistryOption func(*AdminRegistry)
+
+// WithPins starts a registry with the given pins, e.g. the ones it had
+// before the proxy restarted.
+func WithPins(pins map[string]AdminPin) AdminRegistryOption {
+	return func(registry *AdminRegistry) {
+		for adminID, pin := range pins {
+			registry.keys[adminID] = &adminPin{
+				key:       bytes.Clone(pin.Key),
+				confirmed: pin.Confirmed,
+			}
+		}
+	}
+}
+
+// WithPinLimits sets how many admin IDs a registry pins at most, and for how
+// long after its admin last disconnected a confirmed ID stays pinned. An ID
+// nobody has used for longer than ttl may be claimed with another key.
+func WithPinLimits(limit int, ttl time.Duration) AdminRegistryOption {
+	return func(registry *AdminRegistry) {
+		registry.pinLimit = limit
+		registry.pinTTL = ttl
+	}
+}
+
+// WithPinConfirmation sets how long an admin must stay connected for the pin
+// of its ID to be confirmed, and how long an unconfirmed pin lasts after its
+// admin disconnected. Without it, anyone connecting once could hold an ID
+// for as long as a confirmed pin lasts.
+func WithPinConfirmation(after, unconfirmedTTL time.Duration) AdminRegistryOption {
+	return func(registry *AdminRegistry) {
+		registry.pinConfirmation = after
+		registry.unconfirmedPinTTL = unconfirmedTTL
+	}
+}
+
+// WithPinsChanged calls changed with all pins whenever one is added, is
+// confirmed or expires, e.g. to keep them across restarts. Calls are made one
+// at a time, with the keys unlocked, and a call never passes older pins than
+// the one before.
+func WithPinsChanged(changed func(pins map[string]AdminPin)) AdminRegistryOption {
+	return func(registry *AdminRegistry) {
+		registry.changed = changed
+	}
+}
+
+// AdminRegistry binds admin IDs to the signing keys allowed to register them
+// with the proxy.
+type AdminRegistry struct {
+	keys        map[string]*adminPin
+	keysMutex   sync.Mutex
+	allowlisted bool
+
+	pinLimit          int
+	pinTTL            time.Duration
+	pinConfirmation   time.Duration
+	unconfirmedPinTTL time.Duration
+	now               func() time.Time
+
+	changed func(pins map[string]AdminPin)
+	// version numbers the snapshots of the pins passed to changed, so that
+	// an older one is never passed after a newer one.
+	version        uint64
+	published      uint64
+	publishedMutex sync.Mutex
+}
+
+// adminPin is the key bound to an admin ID.
+type adminPin struct {
+	key       ed25519.PublicKey
+	confirmed bool
+	// live counts the connected admins that authenticated with key.
+	live int
+	// held is when live last went up from zero.
+	held time.Time
+	// released is when the pin was last used.
+	released time.Time
+}
+
+// NewAdminRegistry returns a registry that pins each admin ID to the first key
+// that registers it.
+func NewAdminRegistry(options ...AdminRegistryOption) *AdminRegistry {
+	registry := &AdminRegistry{
+		keys:              make(map[string]*adminPin),
+		pinLimit:          DefaultPinLimit,
+		pinTTL:            DefaultPinTTL,
+		pinConfirmation:   DefaultPinConfirmation,
+		unconfirmedPinTTL: DefaultUnconfirmedPinTTL,
+		now:               time.Now,
+	}
+	for _, option := range options {
+		option(registry)
+	}
+	for _, pin := range registry.keys {
+		pin.released = registry.now()
+	}
+	return registry
+}
+
+// NewAdminAllowlist returns a registry that only accepts the given keys and
+// rejects every admin ID it does not list.
+func NewAdminAllowlist(keys map[string]ed25519.PublicKey) *AdminRegistry {
+	registry := &AdminRegistry{
+		keys:        make(map[string]*adminPin, len(keys)),
+		allowlisted: true,
+		now:         time.Now,
+	}
+	for adminID, key := range keys {
+		registry.keys[adminID] = &adminPin{key: bytes.Clone(key), confirmed: true}
+	}
+	return registry
+}
+
+// Pinned reports whether adminID is bound to a key, so that registering it
+// would not pin a new ID.
+func (registry *AdminRegistry) Pinned(adminID string) bool {
+	registry.keysMutex.Lock()
+	defer registry.keysMutex.Unlock()
+
+	pin, ok := registry.keys[adminID]
+	return ok && !registry.expired(pin, registry.now())
+}
+
+// Release tells the registry that an admin AuthenticateAdmin accepted has
+// disconnected. The pin of an admin ID only expires while nobody holds it.
+func (registry *AdminRegistry) Release(adminID string) {
+	registry.keysMutex.Lock()
+	changed := false
+	if pin, ok := registry.keys[adminID]; ok && pin.live > 0 {
+		now := registry.now()
+		changed = registry.confirm(pin, now)
+		pin.live--
+		pin.released = now
+	}
+	snapshot, version := registry.snapshot(changed)
+	registry.keysMutex.Unlock()
+
+	registry.publish(snapshot, version)
+}
+
+// bind accepts key for adminID, pinning it if the ID is new and the registry
+// is not an allowlist. With live set, the caller holds the pin until it calls
+// Release.
+func (registry *AdminRegistry) bind(adminID string, key ed25519.PublicKey, live bool) error {
+	if !ValidAdminID(adminID) {
+		return fmt.Errorf("%w: %q", ErrInvalidAdminID, adminID)
+	}
+
+	registry.keysMutex.Lock()
+	changed, err := registry.bindLocked(adminID, key, live)
+	snapshot, version := registry.snapshot(changed)
+	registry.keysMutex.Unlock()
+
+	registry.publish(snapshot, version)
+	return err
+}
+
+// bindLocked is bind with the keys locked. It reports whether the pins
+// changed.
+func (registry *AdminRegistry) bindLocked(
+	adminID string,
+	key ed25519.PublicKey,
+	live bool,
+) (bool, error) {
+	now := registry.now()
+	pin, ok := registry.keys[adminID]
+	changed := false
+	if ok && registry.expired(pin, now) {
+		delete(registry.keys, adminID)
+		ok, changed = false, true
+	}
+	if !ok && registry.allowlisted {
+		return changed, fmt.Errorf("%w: %s", ErrAdminKeyMismatch, adminID)
+	}
+	if !ok {
+		if len(registry.keys) >= registry.pinLimit && !registry.sweep(now) {
+			return changed, fmt.Errorf("%w: %s", ErrTooManyAdmins, adminID)
+		}
+		pin = &adminPin{key: bytes.Clone(key)}
+		registry.keys[adminID] = pin
+		changed = true
+	}
+	if !pin.key.Equal(key) {
+		return changed, fmt.Errorf("%w: %s", ErrAdminKeyMismatch, adminID)
+	}
+
+	if registry.confirm(pin, now) {
+		changed = true
+	}
+	if live {
+		if pin.live == 0 {
+			pin.held = now
+		}
+		pin.live++
+	}
+	pin.released = now
+	return changed, nil
+}
+
+// confirm confirms pin if an admin has held it long enough and reports
+// whether it did. It must be called with the keys locked.
+func (registry *AdminRegistry) confirm(pin *adminPin, now time.Time) bool {
+	if pin.confirmed || pin.live == 0 || now.Sub(pin.held) < registry.pinConfirmation {
+		return false
+	}
+	pin.confirmed = true
+	return true
+}
+
+// key returns the key bound to adminID, or nil if there is none.
+func (registry *AdminRegistry) key(adminID string) ed25519.PublicKey {
+	registry.keysMutex.Lock()
+	defer registry.keysMutex.Unlock()
+
+	if pin, ok := registry.keys[adminID]; ok {
+		return pin.key
+	}
+	return nil
+}
+
+// expired must be called with the keys locked.
+func (registry *AdminRegistry) expired(pin *adminPin, now time.Time) bool {
+	ttl := registry.pinTTL
+	if !pin.confirmed {
+		ttl = registry.unconfirmedPinTTL
+	}
+	return !registry.allowlisted && pin.live == 0 && !now.Before(pin.released.Add(ttl))
+}
+
+// sweep forgets the expired pins and reports whether it forgot any. It must
+// be called with the keys locked.
+func (registry *AdminRegistry) sweep(now time.Time) bool {
+	swept := false
+	for adminID, pin := range registry.keys {
+		if registry.expired(pin, now) {
+			delete(registry.keys, adminID)
+			swept = true
+		}
+	}
+	return swept
+}
+
+// snapshot copies the pins for the changed option if they changed, and
+// numbers the copy. It must be called with the keys locked.
+func (registry *AdminRegistry) snapshot(changed bool) (map[string]AdminPin, uint64) {
+	if !changed || registry.changed == nil {
+		return nil, 0
+	}
+	pins := make(map[string]AdminPin, len(registry.keys))
+	for adminID, pin := range registry.keys {
+		pins[adminID] = AdminPin{Key: pin.key, Confirmed: pin.confirmed}
+	}
+	registry.version++
+	return pins, registry.version
+}
+
+// publish passes a snapshot to the changed option, unless a newer one was
+// passed already. It must be called with the keys unlocked, so that saving
+// the pins does not hold up registrations.
+func (registry *AdminRegistry) publish(pins map[string]AdminPin, version uint64) {
+	if pins == nil {
+		return
+	}
+	registry.publishedMutex.Lock()
+	defer registry.publishedMutex.Unlock()
+
+	if version <= registry.published {
+		return
+	}
+	registry.published = version
+	registry.changed(pins)
+}
+
+// registrationTranscript is what the admin signs: the domain, the admin ID it
+// registers as and the proxy's nonce, so a signature cannot be replayed for
+// another ID or another connection.
+func registrationTranscript(adminID string, nonce []byte) []byte {
+	transcript := []byte(registrationDomain)
+	transcript = binary.BigEndian.AppendUint32(transcript, uint32(len(adminID)))
+	transcript = append(transcript, adminID...)
+	return append(transcript, nonce...)
+}
+
+// AuthenticateAdmin challenges the admin connected on peer to prove that it
+// holds the signing key registry binds to adminID. The proxy calls it before
+// Router.RegisterAdmin, and registry.Release once the admin disconnected.
+func AuthenticateAdmin(
+	ctx context.Context,
+	peer Peer,
+	registry *AdminRegistry,
+	adminID string,
+) error {
+	if !ValidAdminID(adminID) {
+		return fmt.Errorf("%w: %q", ErrInvalidAdminID, adminID)
+	}
+	nonce := make([]byte, ChallengeSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if err := sendChallengeControl(ctx, peer, adminID, envelope.Control{
+		Kind: envelope.ControlChallenge,
+		Data: nonce,
+	}); err != nil {
+		return err
+	}
+
+	response, err := receiveChallengeControl(ctx, peer, envelope.ControlChallengeResponse)
+	if err != nil {
+		return err
+	}
+	if len(response) != ed25519.PublicKeySize+ed25519.SignatureSize {
+		return fmt.Errorf("%w: malformed response", ErrChallengeFailed)
+	}
+	key := ed25519.PublicKey(response[:ed25519.PublicKeySize])
+	signature := response[ed25519.PublicKeySize:]
+	if !ed25519.Verify(key, registrationTranscript(adminID, nonce), signature) {
+		return fmt.Errorf("%w: bad signature", ErrChallengeFailed)
+	}
+
+	return registry.bind(adminID, key, true)
+}
+
+// RespondToChallenge answers the proxy's registration challenge on peer with
+// a signature by the signing key derived from the admin's static keypair. It
+// must be the first thing the admin does after connecting.
+func RespondToChallenge(
+	ctx context.Context,
+	peer Peer,
+	keypair crypto.StaticKeypair,
+	adminID string,
+) error {
+	signingKey, err := crypto.DeriveSigningKey(keypair)
+	if err != nil {
+		return err
+	}
+
+	nonce, err := receiveChallengeControl(ctx, peer, envelope.ControlChallenge)
+	if err != nil {
+		return err
+	}
+	if len(nonce) != ChallengeSize {
+		return fmt.Errorf("%w: malformed challenge", ErrChallengeFailed)
+	}
+
+	response := bytes.Clone(signingKey.Public().(ed25519.PublicKey))
+	response = append(response, ed25519.Sign(signingKey, registrationTranscript(adminID, nonce))...)
+	return sendChallengeControl(ctx, peer, "", envelope.Control{
+		Kind: envelope.ControlChallengeResponse,
+		Data: response,
+	})
+}
+
+func sendChallengeControl(
+	ctx context.Context,
+	peer Peer,
+	destination string,
+	control envelope.Control,
+) error {
+	e, err := envelope.NewControl(destination, control)
+	if err != nil {
+		return err
+	}
+	frame, err := e.Marshal()
+	if err != nil {
+		return err
+	}
+	return peer.Send(ctx, frame)
+}
+
+// receiveChallengeControl returns the data of the next frame on peer, which
+// must be a control envelope of the given kind. A remote error frame is
+// returned as is.
+func receiveChallengeControl(
+	ctx context.Context,
+	peer Peer,
+	kind envelope.ControlKind,
+) ([]byte, error) {
+	frame, err := peer.Receive(ctx)
+	if err != nil {
+		return nil, err
+	}
+	e, err := envelope.Unmarshal(frame)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrChallengeFailed, err)
+	}
+	if err := e.Err(); err != nil {
+		return nil, err
+	}
+	control, err := e.Control()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrChallengeFailed, err)
+	}
+	if control.Kind != kind {
+		return nil, fmt.Errorf("%w: expected %v, got %v", ErrChallengeFailed, kind, control.Kind)
+	}
+	return control.Data, nil
+}
@@ -0,0 +1,303 @@
+package handshake
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto"
+	"github.com/Dsek-LTH/decidr/internal/envelope"
+)
+
+// registerAdmin runs both sides of the registration challenge.
+func registerAdmin(
+	ctx context.Context,
+	t *testing.T,
+	registry *AdminRegistry,
+	keypair crypto.StaticKeypair,
+	claimedID, signedID string,
+) error {
+	t.Helper()
+
+	adminSide, proxySide := newInMemoryPeers()
+	responded := make(chan error, 1)
+	go func() {
+		responded <- RespondToChallenge(ctx, adminSide, keypair, signedID)
+	}()
+
+	err := AuthenticateAdmin(ctx, proxySide, registry, claimedID)
+	if respondErr := <-responded; respondErr != nil {
+		t.Fatalf("RespondToChallenge: %v", respondErr)
+	}
+	return err
+}
+
+func TestAdminRegistryPinsFirstKey(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	owner, err := crypto.GenerateStaticKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	intruder, err := crypto.GenerateStaticKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry := NewAdminRegistry()
+	if err := registerAdmin(ctx, t, registry, owner, "admin-1", "admin-1"); err != nil {
+		t.Fatalf("first registration: %v", err)
+	}
+	if err := registerAdmin(ctx, t, registry, owner, "admin-1", "admin-1"); err != nil {
+		t.Fatalf("reconnect with the pinned key: %v", err)
+	}
+
+	err = registerAdmin(ctx, t, registry, intruder, "admin-1", "admin-1")
+	if !errors.Is(err, ErrAdminKeyMismatch) {
+		t.Fatalf("expected ErrAdminKeyMismatch for another key, got %v", err)
+	}
+
+	// A signature for one ID does not register another.
+	err = registerAdmin(ctx, t, registry, intruder, "admin-2", "admin-1")
+	if !errors.Is(err, ErrChallengeFailed) {
+		t.Fatalf("expected ErrChallengeFailed for a signature over another ID, got %v", err)
+	}
+}
+
+func TestAdminRegistryPinLimits(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	owner, err := crypto.GenerateStaticKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	intruder, err := crypto.GenerateStaticKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var saved map[string]AdminPin
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	registry := NewAdminRegistry(
+		WithPinLimits(2, time.Hour),
+		WithPinsChanged(func(pins map[string]AdminPin) { saved = pins }),
+	)
+	registry.now = clock.Now
+
+	// A pin does not expire while its admin is connected.
+	if err := registerAdmin(ctx, t, registry, owner, "admin-1", "admin-1"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Hour)
+	err = registerAdmin(ctx, t, registry, intruder, "admin-1", "admin-1")
+	if !errors.Is(err, ErrAdminKeyMismatch) {
+		t.Fatalf("expected ErrAdminKeyMismatch for a connected admin, got %v", err)
+	}
+
+	registry.Release("admin-1")
+	clock.Advance(59 * time.Minute)
+	err = registerAdmin(ctx, t, registry, intruder, "admin-1", "admin-1")
+	if !errors.Is(err, ErrAdminKeyMismatch) {
+		t.Fatalf("expected ErrAdminKeyMismatch within the TTL, got %v", err)
+	}
+	clock.Advance(time.Minute)
+	if err := registerAdmin(ctx, t, registry, owner, "admin-1", "admin-1"); err != nil {
+		t.Fatalf("reclaiming an expired pin: %v", err)
+	}
+
+	// Once full, pins in use are kept and unused ones make room.
+	if err := registerAdmin(ctx, t, registry, owner, "admin-2", "admin-2"); err != nil {
+		t.Fatal(err)
+	}
+	err = registerAdmin(ctx, t, registry, owner, "admin-3", "admin-3")
+	if !errors.Is(err, ErrTooManyAdmins) {
+		t.Fatalf("expected ErrTooManyAdmins, got %v", err)
+	}
+	registry.Release("admin-2")
+	clock.Advance(time.Hour)
+	if err := registerAdmin(ctx, t, registry, owner, "admin-3", "admin-3"); err != nil {
+		t.Fatalf("registration after a pin expired: %v", err)
+	}
+	if _, ok := saved["admin-2"]; ok || len(saved) != 2 {
+		t.Fatalf("saved pins for %v, want admin-1 and admin-3", slices.Sorted(maps.Keys(saved)))
+	}
+
+	// Saved pins hold after a restart.
+	restarted := NewAdminRegistry(WithPins(saved))
+	err = registerAdmin(ctx, t, restarted, intruder, "admin-3", "admin-3")
+	if !errors.Is(err, ErrAdminKeyMismatch) {
+		t.Fatalf("expected ErrAdminKeyMismatch after a restart, got %v", err)
+	}
+}
+
+func TestAdminRegistryConfirmsPins(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	owner, err := crypto.GenerateStaticKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	squatter, err := crypto.GenerateStaticKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var registry *AdminRegistry
+	var saved map[string]AdminPin
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	registry = NewAdminRegistry(
+		WithPinLimits(10, time.Hour),
+		WithPinConfirmation(10*time.Minute, time.Minute),
+		WithPinsChanged(func(pins map[string]AdminPin) {
+			// The pins are passed with the keys unlocked.
+			registry.Pinned("admin-1")
+			saved = pins
+		}),
+	)
+	registry.now = clock.Now
+
+	// A pin taken by connecting briefly lasts only the short TTL.
+	if err := registerAdmin(ctx, t, registry, squatter, "admin-1", "admin-1"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute - time.Second)
+	registry.Release("admin-1")
+	if saved["admin-1"].Confirmed {
+		t.Fatal("pin confirmed before its admin stayed connected long enough")
+	}
+	clock.Advance(time.Minute)
+	if registry.Pinned("admin-1") {
+		t.Fatal("unconfirmed pin outlived its TTL")
+	}
+
+	// Staying connected confirms it, so that it lasts the full TTL.
+	if err := registerAdmin(ctx, t, registry, owner, "admin-1", "admin-1"); err != nil {
+		t.Fatalf("claiming an expired unconfirmed pin: %v", err)
+	}
+	clock.Advance(10 * time.Minute)
+	registry.Release("admin-1")
+	if !saved["admin-1"].Confirmed {
+		t.Fatal("pin not confirmed after its admin stayed connected")
+	}
+	clock.Advance(59 * time.Minute)
+	err = registerAdmin(ctx, t, registry, squatter, "admin-1", "admin-1")
+	if !errors.Is(err, ErrAdminKeyMismatch) {
+		t.Fatalf("expected ErrAdminKeyMismatch for a confirmed pin, got %v", err)
+	}
+}
+
+func TestAdminRegistryRejectsInvalidIDs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	keypair, err := crypto.GenerateStaticKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := NewAdminRegistry()
+	for _, id := range []string{
+		"admin-1 AAAA\nzz",
+		"with space",
+		"tab\t",
+		"bell\a",
+		"no\u00a0break",
+		"#comment",
+		"bad \xff utf-8",
+		strings.Repeat("a", envelope.MaxIDLength+1),
+	} {
+		if ValidAdminID(id) {
+			t.Fatalf("ValidAdminID(%q) = true", id)
+		}
+		// The ID is refused before the admin is challenged.
+		_, proxySide := newInMemoryPeers()
+		err := AuthenticateAdmin(ctx, proxySide, registry, id)
+		if !errors.Is(err, ErrInvalidAdminID) {
+			t.Fatalf("expected ErrInvalidAdminID for %q, got %v", id, err)
+		}
+	}
+	for _, id := range []string{"admin-1", "ordförande#2", strings.Repeat("a", envelope.MaxIDLength)} {
+		if err := registerAdmin(ctx, t, registry, keypair, id, id); err != nil {
+			t.Fatalf("registering %q: %v", id, err)
+		}
+	}
+
+	// Nor can another cluster node pin one.
+	err = registry.bind("admin-1\nzz", make(ed25519.PublicKey, ed25519.PublicKeySize), false)
+	if !errors.Is(err, ErrInvalidAdminID) {
+		t.Fatalf("expected ErrInvalidAdminID from bind, got %v", err)
+	}
+}
+
+func TestAdminAllowlist(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	listed, err := crypto.GenerateStaticKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingKey, err := crypto.DeriveSigningKey(listed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry := NewAdminAllowlist(map[string]ed25519.PublicKey{
+		"admin-1": signingKey.Public().(ed25519.PublicKey),
+	})
+	if err := registerAdmin(ctx, t, registry, listed, "admin-1", "admin-1"); err != nil {
+		t.Fatalf("listed admin: %v", err)
+	}
+
+	err = registerAdmin(ctx, t, registry, listed, "admin-2", "admin-2")
+	if !errors.Is(err, ErrAdminKeyMismatch) {
+		t.Fatalf("expected ErrAdminKeyMismatch for an unlisted ID, got %v", err)
+	}
+}
+
+func TestAuthenticateAdminRejectsBadResponses(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	publicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		control envelope.Control
+	}{
+		{"wrong kind", envelope.Control{Kind: envelope.ControlListClients}},
+		{"short", envelope.Control{Kind: envelope.ControlChallengeResponse, Data: []byte{1}}},
+		{
+			"bad signature",
+			envelope.Control{
+				Kind: envelope.ControlChallengeResponse,
+				Data: append(publicKey, make([]byte, ed25519.SignatureSize)...),
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			adminSide, proxySide := newInMemoryPeers()
+			go func() {
+				if _, err := adminSide.Receive(ctx); err != nil {
+					return
+				}
+				_ = sendChallengeControl(ctx, adminSide, "", test.control)
+			}()
+
+			err := AuthenticateAdmin(ctx, proxySide, NewAdminRegistry(), "admin-1")
+			if !errors.Is(err, ErrChallengeFailed) {
+				t.Fatalf("expected ErrChallengeFailed, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package handshake
+
+import (
+	"errors"
+	"time"
+
+	"github.com/flynn/noise"
+)
+
+// ErrNonceExhausted is returned by SecureChannel.Send when the send cipher
+// state is close to running out of nonces. A new handshake must be performed.
+var ErrNonceExhausted = errors.New("handshake: send nonces exhausted, handshake required")
+
+// maxSendNonce keeps the channel well clear of noise.MaxNonce so that a cipher
+// state is never driven to the point where its nonce would wrap.
+const maxSendNonce = noise.MaxNonce - 1<<16
+
+// DefaultRekeyPolicy is announced by Establish unless WithRekeyPolicy is used.
+var DefaultRekeyPolicy = RekeyPolicy{
+	Messages: 1 << 20,
+	Interval: 15 * time.Minute,
+}
+
+// RekeyPolicy schedules rekeying of the cipher states of a SecureChannel.
+// A zero field disables that trigger.
+type RekeyPolicy struct {
+	// Messages rekeys after this many messages have been sent with one key.
+	Messages uint64 `json:"messages,omitempty"`
+
+	// Interval rekeys the first time a message is sent after this much time has
+	// passed since the previous rekey.
+	Interval time.Duration `json:"interval_ns,omitempty"`
+}
+
+// negotiate combines the policies announced by both parties; for each trigger
+// the stricter non-zero value wins, so neither side rekeys less often than it asked for.
+func (p RekeyPolicy) negotiate(remote RekeyPolicy) RekeyPolicy {
+	return RekeyPolicy{
+		Messages: stricter(p.Messages, remote.Messages),
+		Interval: stricter(p.Interval, remote.Interval),
+	}
+}
+
+func stricter[T uint64 | time.Duration](a, b T) T {
+	switch {
+	case a == 0:
+		return b
+	case b == 0:
+		return a
+	default:
+		return min(a, b)
+	}
+}
+
+// WithRekeyPolicy sets the rekey schedule announced to the peer. Pass the zero
+// RekeyPolicy to only rekey when the peer asks for it.
+func WithRekeyPolicy(policy RekeyPolicy) SessionOption {
+	return func(s *session) {
+		s.rekey = policy
+	}
+}
+
+// rekeySchedule tracks when the send cipher state of a channel is due for a
+// rekey. The receiving side follows the rekey records sent by its peer, so both
+// ends of a direction switch keys in lock-step without sharing a clock.
+type rekeySchedule struct {
+	policy    RekeyPolicy
+	now       func() time.Time
+	sent      uint64
+	lastRekey time.Time
+}
+
+func newRekeySchedule(policy RekeyPolicy, now func() time.Time) rekeySchedule {
+	return rekeySchedule{policy: policy, now: now, lastRekey: now()}
+}
+
+func (s *rekeySchedule) due() bool {
+	if s.policy.Messages > 0 && s.sent >= s.policy.Messages {
+		return true
+	}
+	return s.policy.Interval > 0 && s.now().Sub(s.lastRekey) >= s.policy.Interval
+}
+
+func (s *rekeySchedule) reset() {
+	s.sent = 0
+	s.lastRekey = s.now()
+}
@@ -0,0 +1,145 @@
+package handshake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func establishWithRekey(
+	ctx context.Context,
+	t *testing.T,
+	clientPolicy, adminPolicy RekeyPolicy,
+) (client, admin *SecureChannel) {
+	t.Helper()
+
+	return establishWithOptions(
+		ctx,
+		t,
+		[]SessionOption{WithRekeyPolicy(clientPolicy)},
+		[]SessionOption{WithRekeyPolicy(adminPolicy)},
+	)
+}
+
+// sendAndReceive sends n messages from sender and checks they all arrive intact.
+func sendAndReceive(ctx context.Context, t *testing.T, sender, receiver *SecureChannel, n int) {
+	t.Helper()
+
+	errCh := make(chan error, 1)
+	go func() {
+		for i := range n {
+			if err := sender.Send(ctx, fmt.Appendf(nil, "ballot %d", i)); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- nil
+	}()
+
+	for i := range n {
+		msg, err := receiver.Receive(ctx)
+		if err != nil {
+			t.Fatalf("receive %d: %v", i, err)
+		}
+		if want := fmt.Sprintf("ballot %d", i); string(msg) != want {
+			t.Fatalf("got %q, want %q", msg, want)
+		}
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("send: %v", err)
+	}
+}
+
+func TestRekeyPolicyNegotiation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	client, admin := establishWithRekey(
+		ctx,
+		t,
+		RekeyPolicy{Messages: 5},
+		RekeyPolicy{Messages: 100, Interval: time.Minute},
+	)
+
+	want := RekeyPolicy{Messages: 5, Interval: time.Minute}
+	if got := client.RekeyPolicy(); got != want {
+		t.Fatalf("client policy = %+v, want %+v", got, want)
+	}
+	if got := admin.RekeyPolicy(); got != want {
+		t.Fatalf("admin policy = %+v, want %+v", got, want)
+	}
+}
+
+func TestRekeyAfterMessageCount(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	client, admin := establishWithRekey(ctx, t, RekeyPolicy{Messages: 3}, RekeyPolicy{})
+	initialKey := client.sendCipherState.UnsafeKey()
+
+	sendAndReceive(ctx, t, client, admin, 10)
+	sendAndReceive(ctx, t, admin, client, 10)
+
+	if client.sendCipherState.UnsafeKey() == initialKey {
+		t.Fatal("client send key was never rotated")
+	}
+	if client.sendCipherState.UnsafeKey() != admin.receiveCipherState.UnsafeKey() {
+		t.Fatal("client and admin disagree on the client-to-admin key")
+	}
+	if admin.sendCipherState.UnsafeKey() != client.receiveCipherState.UnsafeKey() {
+		t.Fatal("client and admin disagree on the admin-to-client key")
+	}
+
+	// 10 messages with a rekey before the 4th, 7th and 10th use 13 nonces.
+	if nonce := client.sendCipherState.Nonce(); nonce != 13 {
+		t.Fatalf("client used %d nonces, want 13", nonce)
+	}
+}
+
+func TestRekeyAfterInterval(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	client, admin := establishWithRekey(
+		ctx,
+		t,
+		RekeyPolicy{Interval: time.Hour},
+		RekeyPolicy{Interval: time.Hour},
+	)
+
+	now := time.Now()
+	client.rekey.now = func() time.Time { return now }
+	client.rekey.reset()
+	initialKey := client.sendCipherState.UnsafeKey()
+
+	sendAndReceive(ctx, t, client, admin, 2)
+	if client.sendCipherState.UnsafeKey() != initialKey {
+		t.Fatal("client rekeyed before the interval elapsed")
+	}
+
+	now = now.Add(time.Hour)
+	sendAndReceive(ctx, t, client, admin, 2)
+	if client.sendCipherState.UnsafeKey() == initialKey {
+		t.Fatal("client did not rekey after the interval elapsed")
+	}
+	if client.sendCipherState.UnsafeKey() != admin.receiveCipherState.UnsafeKey() {
+		t.Fatal("client and admin disagree on the client-to-admin key")
+	}
+}
+
+func TestSendRefusesNearNonceLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	client, _ := establishWithRekey(ctx, t, RekeyPolicy{}, RekeyPolicy{})
+	client.sendCipherState.SetNonce(maxSendNonce)
+
+	if err := client.Send(ctx, []byte("one too many")); !errors.Is(err, ErrNonceExhausted) {
+		t.Fatalf("expected ErrNonceExhausted, got %v", err)
+	}
+	if nonce := client.sendCipherState.Nonce(); nonce != maxSendNonce {
+		t.Fatalf("nonce advanced to %d after refusing to send", nonce)
+	}
+}
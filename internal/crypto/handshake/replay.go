@@ -0,0 +1,172 @@
+package handshake
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/flynn/noise"
+)
+
+var (
+	// ErrReplayed is returned by SecureChannel.Receive in explicit-nonce mode for
+	// a frame whose nonce was already accepted or has fallen out of the replay
+	// window. The channel remains usable.
+	ErrReplayed = errors.New("handshake: replayed or stale message")
+
+	// ErrInvalidFrame is returned by SecureChannel.Receive in explicit-nonce mode
+	// for a frame too short to carry its header, or for a key epoch the receiver
+	// cannot reach. The channel remains usable.
+	ErrInvalidFrame = errors.New("handshake: invalid explicit-nonce frame")
+
+	// ErrNonceModeMismatch is returned by Establish when only one party asked
+	// for explicit nonces.
+	ErrNonceModeMismatch = errors.New("handshake: peers disagree on explicit nonces")
+)
+
+const (
+	// replayWindowSize is the number of nonces tracked by the replay window. A
+	// frame is accepted up to replayWindowSize-64 nonces behind the highest
+	// accepted one; older frames are treated as replays.
+	replayWindowSize = 1024
+
+	// maxEpochSkip bounds how many rekeys a receiver will derive ahead for one
+	// frame, so a forged header cannot make it spin.
+	maxEpochSkip = 64
+
+	// explicitHeaderSize is the epoch (uint32) followed by the nonce (uint64).
+	explicitHeaderSize = 4 + 8
+)
+
+// WithExplicitNonces makes the channel prefix every frame with its key epoch
+// and nonce, so frames that are dropped, duplicated or reordered by the
+// transport do not desynchronise the session. Both parties must opt in.
+//
+// Rekeying is signalled by the epoch instead of a rekey record, so it survives
+// the loss of any individual frame.
+func WithExplicitNonces() SessionOption {
+	return func(s *session) {
+		s.explicitNonces = true
+	}
+}
+
+// replayWindow is a sliding bitmap of the most recently accepted nonces.
+type replayWindow struct {
+	highest uint64
+	seen    [replayWindowSize / 64]uint64
+	any     bool
+}
+
+// check reports whether nonce may still be accepted, without recording it.
+func (w *replayWindow) check(nonce uint64) error {
+	if !w.any || nonce > w.highest {
+		return nil
+	}
+	if w.highest/64-nonce/64 >= uint64(len(w.seen)) {
+		return ErrReplayed
+	}
+	if w.seen[(nonce/64)%uint64(len(w.seen))]&(1<<(nonce%64)) != 0 {
+		return ErrReplayed
+	}
+	return nil
+}
+
+// accept records nonce as received. It must only be called after the frame
+// carrying it has been authenticated.
+func (w *replayWindow) accept(nonce uint64) {
+	if !w.any {
+		w.any = true
+		w.highest = nonce
+		w.seen = [len(w.seen)]uint64{}
+	} else if nonce > w.highest {
+		// Clear every block the window slides past.
+		for block := w.highest/64 + 1; block <= nonce/64; block++ {
+			if block-w.highest/64 > uint64(len(w.seen)) {
+				w.seen = [len(w.seen)]uint64{}
+				break
+			}
+			w.seen[block%uint64(len(w.seen))] = 0
+		}
+		w.highest = nonce
+	}
+	w.seen[(nonce/64)%uint64(len(w.seen))] |= 1 << (nonce % 64)
+}
+
+// explicitReceiver holds the receive keys of a channel in explicit-nonce mode.
+// It keeps the previous epoch around so frames sent just before a rekey can
+// still be decrypted when they arrive late.
+type explicitReceiver struct {
+	epoch    uint32
+	current  *noise.CipherState
+	previous *noise.CipherState
+	window   replayWindow
+}
+
+func appendExplicitHeader(out []byte, epoch uint32, nonce uint64) []byte {
+	out = binary.BigEndian.AppendUint32(out, epoch)
+	return binary.BigEndian.AppendUint64(out, nonce)
+}
+
+// open authenticates and decrypts a frame, advancing the epoch and the replay
+// window only once the frame has been authenticated.
+func (r *explicitReceiver) open(frame []byte) ([]byte, error) {
+	if len(frame) < explicitHeaderSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrInvalidFrame, len(frame))
+	}
+	header, ciphertext := frame[:explicitHeaderSize], frame[explicitHeaderSize:]
+	epoch := binary.BigEndian.Uint32(header)
+	nonce := binary.BigEndian.Uint64(header[4:])
+
+	if err := r.window.check(nonce); err != nil {
+		return nil, err
+	}
+
+	cipherState, err := r.cipherStateFor(epoch)
+	if err != nil {
+		return nil, err
+	}
+
+	cipherState.SetNonce(nonce)
+	record, err := cipherState.Decrypt(nil, header, ciphertext)
+	if err != nil {
+		return nil, &DecryptionError{Nonce: nonce, Err: err}
+	}
+
+	if epoch > r.epoch {
+		if epoch == r.epoch+1 {
+			r.previous = r.current
+		} else {
+			r.previous = nil
+		}
+		r.epoch, r.current = epoch, cipherState
+	}
+	r.window.accept(nonce)
+
+	return record, nil
+}
+
+// cipherStateFor returns the cipher state for epoch, deriving a candidate by
+// rekeying forward if the sender has moved on.
+func (r *explicitReceiver) cipherStateFor(epoch uint32) (*noise.CipherState, error) {
+	switch {
+	case epoch == r.epoch:
+		return r.current, nil
+	case epoch+1 == r.epoch && r.previous != nil:
+		return r.previous, nil
+	case epoch < r.epoch:
+		return nil, ErrReplayed
+	case epoch-r.epoch > maxEpochSkip:
+		return nil, fmt.Errorf(
+			"%w: epoch %d is too far ahead of %d",
+			ErrInvalidFrame,
+			epoch,
+			r.epoch,
+		)
+	}
+
+	candidate := noise.UnsafeNewCipherState(cipherSuite, r.current.UnsafeKey(), 0)
+	for range epoch - r.epoch {
+		candidate.Rekey()
+	}
+	return candidate, nil
+}
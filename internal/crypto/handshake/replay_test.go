@@ -0,0 +1,145 @@
+package handshake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+
+	for _, nonce := range []uint64{0, 1, 2, 5, 4} {
+		if err := w.check(nonce); err != nil {
+			t.Fatalf("nonce %d rejected: %v", nonce, err)
+		}
+		w.accept(nonce)
+	}
+
+	if err := w.check(4); !errors.Is(err, ErrReplayed) {
+		t.Fatalf("duplicate nonce accepted: %v", err)
+	}
+	if err := w.check(3); err != nil {
+		t.Fatalf("late nonce 3 rejected: %v", err)
+	}
+
+	w.accept(1029)
+	if err := w.check(6); !errors.Is(err, ErrReplayed) {
+		t.Fatalf("nonce outside the window accepted: %v", err)
+	}
+	if err := w.check(1030); err != nil {
+		t.Fatalf("fresh nonce 1030 rejected: %v", err)
+	}
+	if err := w.check(1000); err != nil {
+		t.Fatalf("nonce 1000 inside the window rejected: %v", err)
+	}
+
+	w.accept(1_000_000)
+	if err := w.check(1029); !errors.Is(err, ErrReplayed) {
+		t.Fatalf("nonce far behind accepted: %v", err)
+	}
+	if err := w.check(999_999); err != nil {
+		t.Fatalf("nonce just behind rejected: %v", err)
+	}
+}
+
+// captureFrames sends n ballots through client and returns the raw frames.
+func captureFrames(ctx context.Context, t *testing.T, client *SecureChannel, n int) [][]byte {
+	t.Helper()
+
+	wire := &queuePeer{}
+	client.SetTransport(wire)
+	for i := range n {
+		if err := client.Send(ctx, fmt.Appendf(nil, "ballot %d", i)); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	return wire.frames
+}
+
+func TestExplicitNoncesSurviveLossDuplicationAndReordering(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	options := []SessionOption{WithExplicitNonces(), WithRekeyPolicy(RekeyPolicy{Messages: 3})}
+	client, admin := establishWithOptions(ctx, t, options, options)
+
+	frames := captureFrames(ctx, t, client, 10)
+
+	// Frame 2 is lost, 4 is duplicated, and the epoch-0 frame 1 arrives after
+	// frames from epoch 1.
+	delivery := []int{0, 3, 1, 4, 4, 5, 7, 6, 9, 8}
+	want := []string{
+		"ballot 0", "ballot 3", "ballot 1", "ballot 4", "replay",
+		"ballot 5", "ballot 7", "ballot 6", "ballot 9", "ballot 8",
+	}
+
+	wire := &queuePeer{}
+	for _, i := range delivery {
+		wire.frames = append(wire.frames, frames[i])
+	}
+	admin.SetTransport(wire)
+
+	for i, expected := range want {
+		msg, err := admin.Receive(ctx)
+		if expected == "replay" {
+			if !errors.Is(err, ErrReplayed) {
+				t.Fatalf("delivery %d: expected ErrReplayed, got %q, %v", i, msg, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("delivery %d: %v", i, err)
+		}
+		if string(msg) != expected {
+			t.Fatalf("delivery %d: got %q, want %q", i, msg, expected)
+		}
+	}
+}
+
+func TestExplicitNoncesRejectTamperedHeader(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	options := []SessionOption{WithExplicitNonces()}
+	client, admin := establishWithOptions(ctx, t, options, options)
+
+	frames := captureFrames(ctx, t, client, 2)
+	frames[0][explicitHeaderSize-1] ^= 1 // claim a different nonce
+
+	admin.SetTransport(&queuePeer{frames: [][]byte{frames[0], {1, 2, 3}, frames[1]}})
+
+	if _, err := admin.Receive(ctx); !errors.Is(err, ErrDecryptionFailed) {
+		t.Fatalf("expected ErrDecryptionFailed, got %v", err)
+	}
+	if _, err := admin.Receive(ctx); !errors.Is(err, ErrInvalidFrame) {
+		t.Fatalf("expected ErrInvalidFrame, got %v", err)
+	}
+	if msg, err := admin.Receive(ctx); err != nil || string(msg) != "ballot 1" {
+		t.Fatalf("channel did not recover: %q, %v", msg, err)
+	}
+}
+
+func TestExplicitNonceModeMismatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	clientIdentity, adminIdentity := getIdentityPair(t)
+	clientSide, adminSide := newInMemoryPeers()
+
+	adminCh := make(chan error, 1)
+	go func() {
+		_, err := Establish(ctx, adminSide, adminIdentity)
+		adminCh <- err
+	}()
+
+	_, err := Establish(ctx, clientSide, clientIdentity, WithExplicitNonces())
+	if !errors.Is(err, ErrNonceModeMismatch) {
+		t.Fatalf("expected ErrNonceModeMismatch on client, got %v", err)
+	}
+	if err := <-adminCh; !errors.Is(err, ErrNonceModeMismatch) {
+		t.Fatalf("expected ErrNonceModeMismatch on admin, got %v", err)
+	}
+}
@@ -9,6 +9,14 @@ const (
 	responder
 )
 
+// peer returns the role of the other party in the handshake.
+func (r role) peer() role {
+	if r == initiator {
+		return responder
+	}
+	return initiator
+}
+
 func cipherStatesFor(
 	role role,
 	cipherState1, cipherState2 *noise.CipherState,
@@ -0,0 +1,51 @@
+package handshake
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrUnknownVoter is returned by the admin side of a handshake when the
+// initiator's static key is not enrolled in the roster.
+var ErrUnknownVoter = errors.New("handshake: peer static key is not an enrolled voter")
+
+// ErrRosterRequiresVoterStatic is returned when a roster is configured together
+// with a pattern in which the initiator never presents a static key.
+var ErrRosterRequiresVoterStatic = errors.New(
+	"handshake: roster requires a pattern that authenticates the initiator",
+)
+
+// Roster is the set of voter static keys enrolled for a meeting, keyed by the
+// voter's entry in the voting register. It is safe for concurrent use.
+type Roster struct {
+	voters      map[string]string
+	votersMutex sync.RWMutex
+}
+
+func NewRoster() *Roster {
+	return &Roster{
+		voters: make(map[string]string),
+	}
+}
+
+// Enroll registers publicKey as the static key of voterID.
+func (roster *Roster) Enroll(voterID string, publicKey []byte) {
+	roster.votersMutex.Lock()
+	defer roster.votersMutex.Unlock()
+	roster.voters[string(publicKey)] = voterID
+}
+
+// Revoke removes publicKey from the roster. Existing channels are unaffected.
+func (roster *Roster) Revoke(publicKey []byte) {
+	roster.votersMutex.Lock()
+	defer roster.votersMutex.Unlock()
+	delete(roster.voters, string(publicKey))
+}
+
+// Lookup returns the voter ID enrolled for publicKey.
+func (roster *Roster) Lookup(publicKey []byte) (voterID string, ok bool) {
+	roster.votersMutex.RLock()
+	defer roster.votersMutex.RUnlock()
+	voterID, ok = roster.voters[string(publicKey)]
+	return voterID, ok
+}
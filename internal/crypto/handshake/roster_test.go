@@ -0,0 +1,114 @@
+package handshake
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto"
+	"github.com/flynn/noise"
+)
+
+func newVoterKeypair(t *testing.T) crypto.StaticKeypair {
+	t.Helper()
+
+	keypair, err := crypto.GenerateStaticKeypair()
+	if err != nil {
+		t.Fatalf("failed to generate voter keypair: %v", err)
+	}
+	return keypair
+}
+
+func TestVoterHandshakeEnrolled(t *testing.T) {
+	for _, pattern := range []noise.HandshakePattern{noise.HandshakeIK, noise.HandshakeKK} {
+		t.Run(pattern.Name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			voter := newVoterKeypair(t)
+			roster := NewRoster()
+			roster.Enroll("voter-42", voter.Public)
+
+			_, adminEndpoint, err := NewAdminEndpoint(WithPattern(pattern), WithRoster(roster))
+			if err != nil {
+				t.Fatalf("failed to create endpoints: %v", err)
+			}
+			adminEndpoint = adminEndpoint.ForVoter(voter.Public)
+			voterEndpoint := NewVoterEndpoint(
+				adminEndpoint.Identity.GetPublicKey(),
+				voter,
+				WithPattern(pattern),
+			)
+
+			voterSide, adminSide := newInMemoryPeers()
+			_, admin := establishPair(
+				ctx,
+				t,
+				voterSide,
+				adminSide,
+				voterEndpoint.Identity,
+				adminEndpoint.Identity,
+			)
+
+			if !bytes.Equal(admin.PeerStatic(), voter.Public) {
+				t.Fatal("admin does not see the voter static key")
+			}
+			if voterID, ok := roster.Lookup(admin.PeerStatic()); !ok || voterID != "voter-42" {
+				t.Fatalf("roster lookup = %q, %v", voterID, ok)
+			}
+		})
+	}
+}
+
+func TestVoterHandshakeRejectsUnknownVoter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	roster := NewRoster()
+	roster.Enroll("voter-1", newVoterKeypair(t).Public)
+
+	_, adminEndpoint, err := NewAdminEndpoint(
+		WithPattern(noise.HandshakeIK),
+		WithRoster(roster),
+	)
+	if err != nil {
+		t.Fatalf("failed to create endpoints: %v", err)
+	}
+
+	intruderEndpoint := NewVoterEndpoint(
+		adminEndpoint.Identity.GetPublicKey(),
+		newVoterKeypair(t),
+	)
+
+	voterSide, adminSide := newInMemoryPeers()
+	voterCh := runHandshakeAsync(ctx, voterSide, intruderEndpoint.Identity)
+	adminCh := runHandshakeAsync(ctx, adminSide, adminEndpoint.Identity)
+
+	if res := <-adminCh; !errors.Is(res.err, ErrUnknownVoter) {
+		t.Fatalf("expected ErrUnknownVoter, got %v", res.err)
+	}
+
+	// The admin never answers, so the voter only gives up on cancellation.
+	cancel()
+	if res := <-voterCh; res.err == nil {
+		t.Fatal("expected voter handshake to fail")
+	}
+}
+
+func TestRosterRequiresAuthenticatingPattern(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, adminEndpoint, err := NewAdminEndpoint(WithRoster(NewRoster()))
+	if err != nil {
+		t.Fatalf("failed to create endpoints: %v", err)
+	}
+
+	_, adminSide := newInMemoryPeers()
+	_, err = Establish(ctx, adminSide, adminEndpoint.Identity)
+	if !errors.Is(err, ErrRosterRequiresVoterStatic) {
+		t.Fatalf("expected ErrRosterRequiresVoterStatic, got %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package handshake
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+const (
+	// ProtocolVersion is the application protocol version announced in the hello
+	// payload of every handshake.
+	ProtocolVersion uint16 = 1
+
+	// MinProtocolVersion is the oldest protocol version a peer may announce.
+	MinProtocolVersion uint16 = 1
+
+	// maxHelloSize keeps the hello well below the Noise message size limit.
+	maxHelloSize = 4096
+
+	prologueDomain = "decidr handshake prologue"
+)
+
+var (
+	// ErrUnsupportedVersion is returned when the peer announces a protocol
+	// version older than MinProtocolVersion.
+	ErrUnsupportedVersion = errors.New("handshake: unsupported protocol version")
+
+	// ErrInvalidHello is returned when the peer's handshake payload is missing
+	// or cannot be decoded.
+	ErrInvalidHello = errors.New("handshake: invalid hello payload")
+)
+
+// Prologue identifies the meeting and the routing IDs a handshake is meant for.
+// It is authenticated by the handshake without being transmitted, so both
+// parties must construct the same Prologue; if a proxy splices a client onto
+// the wrong admin, the first encrypted handshake message fails to decrypt.
+type Prologue struct {
+	MeetingID string
+	AdminID   string
+	ClientID  string
+}
+
+// encode serialises the prologue with length-prefixed fields so that no
+// combination of IDs can collide with another.
+func (p Prologue) encode() []byte {
+	out := []byte(prologueDomain)
+	for _, field := range []string{p.MeetingID, p.AdminID, p.ClientID} {
+		out = binary.BigEndian.AppendUint32(out, uint32(len(field)))
+		out = append(out, field...)
+	}
+	return out
+}
+
+// Hello is the application payload each party sends inside the handshake.
+//
+// It is carried in the last handshake message the party writes, which is
+// encrypted for every pattern except those where that message precedes any
+// key agreement (e.g. the first message of NN).
+type Hello struct {
+	// Version is set to ProtocolVersion when the hello is sent.
+	Version      uint16   `json:"version"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	DisplayName  string   `json:"display_name,omitempty"`
+
+	// Rekey is set to the session's rekey policy when the hello is sent.
+	Rekey RekeyPolicy `json:"rekey"`
+
+	// ExplicitNonces is set when the session was started WithExplicitNonces.
+	ExplicitNonces bool `json:"explicit_nonces,omitempty"`
+}
+
+// HasCapability reports whether the hello announces capability.
+func (h Hello) HasCapability(capability string) bool {
+	return slices.Contains(h.Capabilities, capability)
+}
+
+func (h Hello) encode() ([]byte, error) {
+	h.Version = ProtocolVersion
+
+	payload, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > maxHelloSize {
+		return nil, fmt.Errorf("handshake: hello payload of %d bytes is too large", len(payload))
+	}
+	return payload, nil
+}
+
+func decodeHello(payload []byte) (Hello, error) {
+	var hello Hello
+	if err := json.Unmarshal(payload, &hello); err != nil {
+		return Hello{}, fmt.Errorf("%w: %w", ErrInvalidHello, err)
+	}
+	if hello.Version < MinProtocolVersion {
+		return Hello{}, fmt.Errorf(
+			"%w: peer speaks %d, need at least %d",
+			ErrUnsupportedVersion,
+			hello.Version,
+			MinProtocolVersion,
+		)
+	}
+	return hello, nil
+}
+
+// SessionOption configures a single handshake.
+type SessionOption func(*session)
+
+type session struct {
+	prologue Prologue
+	hello    Hello
+	rekey    RekeyPolicy
+
+	explicitNonces bool
+}
+
+func newSession(options []SessionOption) session {
+	s := session{rekey: DefaultRekeyPolicy}
+	for _, option := range options {
+		option(&s)
+	}
+	return s
+}
+
+// WithPrologue binds the handshake to a meeting and to the routing IDs of both
+// parties.
+func WithPrologue(prologue Prologue) SessionOption {
+	return func(s *session) {
+		s.prologue = prologue
+	}
+}
+
+// WithHello sets the payload announced to the peer during the handshake.
+func WithHello(hello Hello) SessionOption {
+	return func(s *session) {
+		s.hello = hello
+	}
+}
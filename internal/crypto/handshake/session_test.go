@@ -0,0 +1,150 @@
+package handshake
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHandshakeExchangesHello(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	prologue := Prologue{MeetingID: "annual-meeting", AdminID: "admin-1", ClientID: "client-1"}
+	clientIdentity, adminIdentity := getIdentityPair(t)
+	clientSide, adminSide := newInMemoryPeers()
+
+	type result struct {
+		channel *SecureChannel
+		err     error
+	}
+	clientCh := make(chan result, 1)
+	adminCh := make(chan result, 1)
+
+	go func() {
+		channel, err := Establish(ctx, clientSide, clientIdentity,
+			WithPrologue(prologue),
+			WithHello(Hello{Capabilities: []string{"ranked-choice"}, DisplayName: "Ada"}),
+		)
+		clientCh <- result{channel, err}
+	}()
+	go func() {
+		channel, err := Establish(ctx, adminSide, adminIdentity,
+			WithPrologue(prologue),
+			WithHello(Hello{DisplayName: "Chair"}),
+		)
+		adminCh <- result{channel, err}
+	}()
+
+	clientRes, adminRes := <-clientCh, <-adminCh
+	if clientRes.err != nil || adminRes.err != nil {
+		t.Fatalf("Establish failed: client=%v, admin=%v", clientRes.err, adminRes.err)
+	}
+
+	fromClient := adminRes.channel.RemoteHello()
+	if fromClient.DisplayName != "Ada" || !fromClient.HasCapability("ranked-choice") {
+		t.Fatalf("admin saw unexpected hello: %+v", fromClient)
+	}
+	if fromClient.Version != ProtocolVersion {
+		t.Fatalf("admin saw version %d, want %d", fromClient.Version, ProtocolVersion)
+	}
+	if got := clientRes.channel.RemoteHello().DisplayName; got != "Chair" {
+		t.Fatalf("client saw display name %q", got)
+	}
+	if clientRes.channel.ProtocolVersion() != ProtocolVersion {
+		t.Fatalf("negotiated version %d", clientRes.channel.ProtocolVersion())
+	}
+}
+
+func TestPerformReturnsRemoteHello(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	clientIdentity, adminIdentity := getIdentityPair(t)
+	clientSide, adminSide := newInMemoryPeers()
+
+	perform := func(peer Peer, identity handshakeIdentity, name string) <-chan Hello {
+		hellos := make(chan Hello, 1)
+		go func() {
+			_, _, _, remoteHello, err := Perform(
+				ctx,
+				func(b []byte) error { return peer.Send(ctx, b) },
+				func() ([]byte, error) { return peer.Receive(ctx) },
+				identity,
+				WithHello(Hello{DisplayName: name}),
+			)
+			if err != nil {
+				t.Errorf("Perform as %s: %v", name, err)
+			}
+			hellos <- remoteHello
+		}()
+		return hellos
+	}
+	fromAdmin := perform(clientSide, clientIdentity, "Ada")
+	fromClient := perform(adminSide, adminIdentity, "Chair")
+
+	if hello := <-fromClient; hello.DisplayName != "Ada" || hello.Version != ProtocolVersion {
+		t.Fatalf("admin saw unexpected hello: %+v", hello)
+	}
+	if hello := <-fromAdmin; hello.DisplayName != "Chair" {
+		t.Fatalf("client saw unexpected hello: %+v", hello)
+	}
+}
+
+func TestHandshakePrologueMismatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	clientIdentity, adminIdentity := getIdentityPair(t)
+	clientSide, adminSide := newInMemoryPeers()
+
+	clientCh := make(chan error, 1)
+	go func() {
+		_, err := Establish(ctx, clientSide, clientIdentity, WithPrologue(Prologue{
+			MeetingID: "annual-meeting",
+			AdminID:   "admin-1",
+			ClientID:  "client-1",
+		}))
+		clientCh <- err
+	}()
+
+	// The proxy spliced the client onto a session meant for another client.
+	_, err := Establish(ctx, adminSide, adminIdentity, WithPrologue(Prologue{
+		MeetingID: "annual-meeting",
+		AdminID:   "admin-1",
+		ClientID:  "client-2",
+	}))
+	if err == nil {
+		t.Fatal("expected admin handshake to fail on prologue mismatch")
+	}
+
+	cancel()
+	<-clientCh
+}
+
+func TestPrologueEncodingIsUnambiguous(t *testing.T) {
+	a := Prologue{MeetingID: "m", AdminID: "ab", ClientID: "c"}
+	b := Prologue{MeetingID: "m", AdminID: "a", ClientID: "bc"}
+
+	if string(a.encode()) == string(b.encode()) {
+		t.Fatal("different prologues encode identically")
+	}
+}
+
+func TestDecodeHello(t *testing.T) {
+	if _, err := decodeHello([]byte(`{"version":0}`)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+	}
+	if _, err := decodeHello(nil); !errors.Is(err, ErrInvalidHello) {
+		t.Fatalf("expected ErrInvalidHello, got %v", err)
+	}
+
+	hello, err := decodeHello([]byte(`{"version":7,"display_name":"Ada"}`))
+	if err != nil {
+		t.Fatalf("decodeHello: %v", err)
+	}
+	if hello.Version != 7 || hello.DisplayName != "Ada" {
+		t.Fatalf("unexpected hello: %+v", hello)
+	}
+}
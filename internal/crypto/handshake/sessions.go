@@ -0,0 +1,314 @@
+package handshake
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/envelope"
+)
+
+// ErrUnknownSession is returned when a client presents a resumption token the
+// router did not issue, issued for another admin, issued too long ago or
+// superseded by a newer one.
+var ErrUnknownSession = errors.New("handshake: unknown session")
+
+const (
+	// SessionKeySize is the length of the key resumption tokens are signed
+	// with.
+	SessionKeySize = 32
+
+	// DefaultSessionMaxAge is how long a resumption token is accepted after
+	// it was issued.
+	DefaultSessionMaxAge = 24 * time.Hour
+)
+
+// sessionTokenDomain separates token MACs from anything else the session key
+// might authenticate.
+const sessionTokenDomain = "decidr session token v3\x00"
+
+// issuedTokensSweepInterval is how often the issue times of tokens that have
+// expired are forgotten.
+const issuedTokensSweepInterval = time.Minute
+
+// WithSessionKey signs resumption tokens with key, so that a router with the
+// same key, such as the proxy after a restart, accepts the tokens this one
+// issued. Without it every router signs with a random key of its own.
+func WithSessionKey(key []byte) RouterOption {
+	return func(router *MemoryRouter) {
+		router.sessionKey = key
+	}
+}
+
+// WithSessionMaxAge sets how long a resumption token is accepted after it was
+// issued. It defaults to DefaultSessionMaxAge. Every connection gets a fresh
+// token, which supersedes the previous one, so only clients that stay away
+// that long lose their session. Tokens are revoked all at once by replacing
+// the session key.
+func WithSessionMaxAge(age time.Duration) RouterOption {
+	return func(router *MemoryRouter) {
+		router.sessionMaxAge = age
+	}
+}
+
+// newSessionKey returns a random session key.
+func newSessionKey() []byte {
+	key := make([]byte, SessionKeySize)
+	// crypto/rand.Read never fails.
+	_, _ = rand.Read(key)
+	return key
+}
+
+// issuedTokens remembers when the latest resumption token of each client was
+// issued, so that the tokens it superseded are refused.
+type issuedTokens struct {
+	latest    map[string]time.Time
+	lastSweep time.Time
+	mutex     sync.Mutex
+}
+
+// issue returns the issue time of a new token for clientID, which is now or,
+// if the latest token was issued at the same instant or later, just after
+// it, so that every token of a client has an issue time of its own.
+func (tokens *issuedTokens) issue(clientID string, now, expired time.Time) time.Time {
+	tokens.mutex.Lock()
+	defer tokens.mutex.Unlock()
+
+	if latest, ok := tokens.latest[clientID]; ok && !now.After(latest) {
+		now = latest.Add(time.Nanosecond)
+	}
+	tokens.record(clientID, now, expired)
+	return now
+}
+
+// renew replaces the token of clientID issued at issued by a new one and
+// returns its issue time. It fails unless issued is the latest token of the
+// client; a client with no record, e.g. after a restart, is taken at its word.
+func (tokens *issuedTokens) renew(
+	clientID string,
+	issued, now, expired time.Time,
+) (time.Time, bool) {
+	tokens.mutex.Lock()
+	defer tokens.mutex.Unlock()
+
+	latest, ok := tokens.latest[clientID]
+	if ok && !latest.Equal(issued) {
+		return time.Time{}, false
+	}
+	if !now.After(issued) {
+		now = issued.Add(time.Nanosecond)
+	}
+	tokens.record(clientID, now, expired)
+	return now, true
+}
+
+// restore makes issued the latest token of clientID again after its renewal
+// was never delivered, unless yet another token was issued since.
+func (tokens *issuedTokens) restore(clientID string, issued, renewed time.Time) {
+	tokens.mutex.Lock()
+	defer tokens.mutex.Unlock()
+
+	if latest, ok := tokens.latest[clientID]; ok && latest.Equal(renewed) {
+		tokens.latest[clientID] = issued
+	}
+}
+
+// record must be called with the mutex held. Once in a while it forgets the
+// tokens issued before expired, which are refused for their age anyway.
+func (tokens *issuedTokens) record(clientID string, issued, expired time.Time) {
+	if tokens.latest == nil {
+		tokens.latest = make(map[string]time.Time)
+	}
+	tokens.latest[clientID] = issued
+
+	if issued.Sub(tokens.lastSweep) < issuedTokensSweepInterval {
+		return
+	}
+	tokens.lastSweep = issued
+	for id, latest := range tokens.latest {
+		if !latest.After(expired) {
+			delete(tokens.latest, id)
+		}
+	}
+}
+
+// Closer is implemented by peers whose connection the router can close, e.g.
+// when a newer connection takes over their ID. Reason is shown to the remote.
+type Closer interface {
+	Close(reason string) error
+}
+
+// evict closes a peer that was replaced by another connection, if it can be.
+func evict(peer Peer, reason string) {
+	if closer, ok := peer.(Closer); ok {
+		_ = closer.Close(reason)
+	}
+}
+
+// ClientSession is a client's registration with the router.
+type ClientSession struct {
+	// ID is the client ID the router assigned; admins address frames to it.
+	ID string
+	// Token lets the client reclaim ID after reconnecting and must be kept
+	// secret by the client. Resuming a session issues a new token, which
+	// the client should keep instead.
+	Token string
+
+	generation uint64
+}
+
+// JoinClient registers peer as a new client of adminID under an unguessable
+// ID and tells it its ID and resumption token in a ControlSession envelope,
+// which is the first frame the peer receives.
+func (router *MemoryRouter) JoinClient(
+	ctx context.Context,
+	adminID string,
+	peer Peer,
+) (ClientSession, error) {
+	id := rand.Text()
+	now := router.now()
+	issued := router.issuedTokens.issue(id, now, now.Add(-router.sessionMaxAge))
+	session := ClientSession{ID: id, Token: router.sessionToken(id, adminID, issued)}
+	return router.startClientSession(ctx, adminID, peer, session)
+}
+
+// ResumeClient registers peer under the client ID that token was issued for
+// by JoinClient, unless the token is older than the session max age (see
+// WithSessionMaxAge) or the client has been issued a newer token since. The
+// router only knows about the tokens it issued itself, so after a restart,
+// or at another cluster node, the first resumption with any token of a client
+// that has not expired is accepted. A connection still holding the ID is
+// closed with a reason if it is a Closer, and stops receiving frames either
+// way.
+func (router *MemoryRouter) ResumeClient(
+	ctx context.Context,
+	token, adminID string,
+	peer Peer,
+) (ClientSession, error) {
+	fields := strings.Split(token, ".")
+	if len(fields) != 3 {
+		return ClientSession{}, ErrUnknownSession
+	}
+	clientID := fields[0]
+	nanoseconds, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return ClientSession{}, ErrUnknownSession
+	}
+	issued := time.Unix(0, nanoseconds)
+	if !hmac.Equal([]byte(token), []byte(router.sessionToken(clientID, adminID, issued))) {
+		return ClientSession{}, ErrUnknownSession
+	}
+	now := router.now()
+	expired := now.Add(-router.sessionMaxAge)
+	if !issued.After(expired) {
+		return ClientSession{}, ErrUnknownSession
+	}
+	renewed, ok := router.issuedTokens.renew(clientID, issued, now, expired)
+	if !ok {
+		return ClientSession{}, ErrUnknownSession
+	}
+
+	session, err := router.startClientSession(
+		ctx,
+		adminID,
+		peer,
+		ClientSession{ID: clientID, Token: router.sessionToken(clientID, adminID, renewed)},
+	)
+	if err != nil {
+		// The client never got the new token, so it may use the old one again.
+		router.issuedTokens.restore(clientID, issued, renewed)
+	}
+	return session, err
+}
+
+// sessionToken is the client ID and the time the token was issued, followed by
+// a MAC over both and the admin ID, so the router only needs to remember the
+// latest issue time of every client to check it.
+func (router *MemoryRouter) sessionToken(clientID, adminID string, issued time.Time) string {
+	nanoseconds := strconv.FormatInt(issued.UnixNano(), 10)
+	mac := hmac.New(sha256.New, router.sessionKey)
+	mac.Write([]byte(sessionTokenDomain))
+	mac.Write(binary.BigEndian.AppendUint32(nil, uint32(len(clientID))))
+	mac.Write([]byte(clientID))
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(issued.UnixNano())))
+	mac.Write([]byte(adminID))
+	return clientID + "." + nanoseconds + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (router *MemoryRouter) startClientSession(
+	ctx context.Context,
+	adminID string,
+	peer Peer,
+	session ClientSession,
+) (ClientSession, error) {
+	// The session goes out before any frame queued for the client is flushed.
+	e, err := envelope.NewControl(session.ID, envelope.Control{
+		Kind:      envelope.ControlSession,
+		ClientIDs: []string{session.ID},
+		Token:     session.Token,
+	})
+	if err != nil {
+		return ClientSession{}, err
+	}
+	frame, err := e.Marshal()
+	if err != nil {
+		return ClientSession{}, err
+	}
+	if err := peer.Send(ctx, frame); err != nil {
+		return ClientSession{}, err
+	}
+
+	generation, replaced, err := router.register(router.clients, session.ID, adminID, peer, true)
+	if err != nil {
+		return ClientSession{}, err
+	}
+	evict(replaced, "client connected elsewhere")
+	router.notifyAdmin(adminID, envelope.ControlClientConnected, session.ID)
+
+	session.generation = generation
+	return session, nil
+}
+
+// LeaveClient removes the client of session and tells its admin, unless
+// another connection has resumed the session since.
+func (router *MemoryRouter) LeaveClient(session ClientSession) {
+	router.removeClient(session.ID, session.generation)
+}
+
+// ReceiveClientSession reads the ControlSession envelope the proxy sends a
+// client right after it connects.
+func ReceiveClientSession(ctx context.Context, peer Peer) (ClientSession, error) {
+	frame, err := peer.Receive(ctx)
+	if err != nil {
+		return ClientSession{}, err
+	}
+	e, err := envelope.Unmarshal(frame)
+	if err != nil {
+		return ClientSession{}, err
+	}
+	if err := e.Err(); err != nil {
+		return ClientSession{}, err
+	}
+	control, err := e.Control()
+	if err != nil {
+		return ClientSession{}, err
+	}
+	if control.Kind != envelope.ControlSession {
+		return ClientSession{}, fmt.Errorf(
+			"%w: expected %v, got %v",
+			envelope.ErrMalformed,
+			envelope.ControlSession,
+			control.Kind,
+		)
+	}
+	return ClientSession{ID: control.ClientIDs[0], Token: control.Token}, nil
+}
@@ -0,0 +1,248 @@
+package handshake
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/envelope"
+)
+
+// closingPeer records the reason it was closed with.
+type closingPeer struct {
+	inMemoryPeer
+	reasons chan string
+}
+
+func (p closingPeer) Close(reason string) error {
+	p.reasons <- reason
+	return nil
+}
+
+func newClosingPeers() (client inMemoryPeer, server closingPeer) {
+	client, proxySide := newInMemoryPeers()
+	return client, closingPeer{inMemoryPeer: proxySide, reasons: make(chan string, 1)}
+}
+
+func TestJoinAndResumeClient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	router := NewMemoryRouter()
+	adminSide, proxySideAdmin := newInMemoryPeers()
+	router.RegisterAdmin("admin-1", proxySideAdmin)
+
+	firstTab, proxySideFirst := newClosingPeers()
+	joined := make(chan ClientSession, 1)
+	go func() {
+		session, err := router.JoinClient(ctx, "admin-1", proxySideFirst)
+		if err != nil {
+			t.Errorf("JoinClient: %v", err)
+		}
+		joined <- session
+	}()
+
+	received, err := ReceiveClientSession(ctx, firstTab)
+	if err != nil {
+		t.Fatalf("ReceiveClientSession: %v", err)
+	}
+	control := receiveControl(ctx, t, adminSide)
+	first := <-joined
+	if received.ID != first.ID || received.Token != first.Token {
+		t.Fatalf("client was told %+v, router returned %+v", received, first)
+	}
+	if control.Kind != envelope.ControlClientConnected ||
+		!slices.Equal(control.ClientIDs, []string{first.ID}) {
+		t.Fatalf("admin got %+v, want %s connected", control, first.ID)
+	}
+
+	// Choosing a connected ID without the token is refused.
+	_, intruder := newInMemoryPeers()
+	err = router.RegisterClient(first.ID, "admin-1", intruder)
+	if !errors.Is(err, ErrClientIDTaken) {
+		t.Fatalf("expected ErrClientIDTaken, got %v", err)
+	}
+	if _, err := router.ResumeClient(ctx, "guess", "admin-1", intruder); !errors.Is(
+		err,
+		ErrUnknownSession,
+	) {
+		t.Fatalf("expected ErrUnknownSession for a guessed token, got %v", err)
+	}
+	_, err = router.ResumeClient(ctx, first.Token, "admin-2", intruder)
+	if !errors.Is(err, ErrUnknownSession) {
+		t.Fatalf("expected ErrUnknownSession for another admin, got %v", err)
+	}
+
+	// The token reclaims the ID and evicts the first connection.
+	secondTab, proxySideSecond := newInMemoryPeers()
+	resumed := make(chan ClientSession, 1)
+	go func() {
+		session, err := router.ResumeClient(ctx, first.Token, "admin-1", proxySideSecond)
+		if err != nil {
+			t.Errorf("ResumeClient: %v", err)
+		}
+		resumed <- session
+	}()
+	if received, err := ReceiveClientSession(ctx, secondTab); err != nil ||
+		received.ID != first.ID {
+		t.Fatalf("resumed session = %+v, %v", received, err)
+	}
+	if reason := <-proxySideFirst.reasons; reason != "client connected elsewhere" {
+		t.Fatalf("evicted with reason %q", reason)
+	}
+	receiveControl(ctx, t, adminSide)
+	second := <-resumed
+
+	// The evicted connection leaving does not remove the one that took over.
+	router.LeaveClient(first)
+	if clients := router.ClientsOf("admin-1"); !slices.Equal(clients, []string{first.ID}) {
+		t.Fatalf("ClientsOf(admin-1) = %v after the evicted connection left", clients)
+	}
+
+	go router.LeaveClient(second)
+	if control := receiveControl(ctx, t, adminSide); control.Kind !=
+		envelope.ControlClientDisconnected {
+		t.Fatalf("admin got %+v, want disconnected", control)
+	}
+	if clients := router.ClientsOf("admin-1"); len(clients) != 0 {
+		t.Fatalf("ClientsOf(admin-1) = %v, want none", clients)
+	}
+}
+
+func TestJoinClientAssignsDistinctIDs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	router := NewMemoryRouter()
+	seen := make(map[string]bool)
+	for range 8 {
+		peer := inMemoryPeer{sendFunc: func(context.Context, []byte) error { return nil }}
+		session, err := router.JoinClient(ctx, "admin-1", peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[session.ID] || seen[session.Token] || session.ID == session.Token {
+			t.Fatalf("session %+v reuses an ID or token", session)
+		}
+		seen[session.ID] = true
+		seen[session.Token] = true
+	}
+}
+
+func TestResumeClientAfterRestart(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	key := make([]byte, SessionKeySize)
+	discard := inMemoryPeer{sendFunc: func(context.Context, []byte) error { return nil }}
+
+	before := NewMemoryRouter(WithSessionKey(key))
+	session, err := before.JoinClient(ctx, "admin-1", discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := NewMemoryRouter(WithSessionKey(key))
+	resumed, err := after.ResumeClient(ctx, session.Token, "admin-1", discard)
+	if err != nil {
+		t.Fatalf("ResumeClient with the same key: %v", err)
+	}
+	if resumed.ID != session.ID {
+		t.Fatalf("resumed as %s, want %s", resumed.ID, session.ID)
+	}
+
+	_, err = NewMemoryRouter().ResumeClient(ctx, session.Token, "admin-1", discard)
+	if !errors.Is(err, ErrUnknownSession) {
+		t.Fatalf("expected ErrUnknownSession with another key, got %v", err)
+	}
+}
+
+func TestResumeClientTokenExpires(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	clock := &fakeClock{now: time.Unix(1_000_000, 0)}
+	router := NewMemoryRouter(WithClock(clock.Now), WithSessionMaxAge(time.Hour))
+	discard := inMemoryPeer{sendFunc: func(context.Context, []byte) error { return nil }}
+
+	joined, err := router.JoinClient(ctx, "admin-1", discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Resuming issues a token that is valid for another max age.
+	clock.Advance(40 * time.Minute)
+	resumed, err := router.ResumeClient(ctx, joined.Token, "admin-1", discard)
+	if err != nil {
+		t.Fatalf("ResumeClient within the max age: %v", err)
+	}
+	if resumed.Token == joined.Token {
+		t.Fatalf("resuming kept token %q", joined.Token)
+	}
+
+	clock.Advance(40 * time.Minute)
+	_, err = router.ResumeClient(ctx, joined.Token, "admin-1", discard)
+	if !errors.Is(err, ErrUnknownSession) {
+		t.Fatalf("expected ErrUnknownSession for an expired token, got %v", err)
+	}
+	if _, err := router.ResumeClient(ctx, resumed.Token, "admin-1", discard); err != nil {
+		t.Fatalf("ResumeClient with the newer token: %v", err)
+	}
+
+	// The issue time cannot be moved without the key.
+	id, rest, _ := strings.Cut(joined.Token, ".")
+	_, mac, _ := strings.Cut(rest, ".")
+	forged := id + "." + strconv.FormatInt(clock.Now().UnixNano(), 10) + "." + mac
+	_, err = router.ResumeClient(ctx, forged, "admin-1", discard)
+	if !errors.Is(err, ErrUnknownSession) {
+		t.Fatalf("expected ErrUnknownSession for a forged issue time, got %v", err)
+	}
+}
+
+func TestResumeClientRefusesSupersededTokens(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	clock := &fakeClock{now: time.Unix(1_000_000, 0)}
+	router := NewMemoryRouter(WithClock(clock.Now))
+	discard := inMemoryPeer{sendFunc: func(context.Context, []byte) error { return nil }}
+
+	joined, err := router.JoinClient(ctx, "admin-1", discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Resuming at the same instant still supersedes the token.
+	resumed, err := router.ResumeClient(ctx, joined.Token, "admin-1", discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = router.ResumeClient(ctx, joined.Token, "admin-1", discard)
+	if !errors.Is(err, ErrUnknownSession) {
+		t.Fatalf("expected ErrUnknownSession for a superseded token, got %v", err)
+	}
+
+	// A token that never reached the client does not supersede the one it
+	// holds.
+	broken := inMemoryPeer{
+		sendFunc: func(context.Context, []byte) error { return errors.New("gone") },
+	}
+	clock.Advance(time.Minute)
+	if _, err := router.ResumeClient(ctx, resumed.Token, "admin-1", broken); err == nil {
+		t.Fatal("ResumeClient succeeded over a broken peer")
+	}
+	latest, err := router.ResumeClient(ctx, resumed.Token, "admin-1", discard)
+	if err != nil {
+		t.Fatalf("ResumeClient after an undelivered token: %v", err)
+	}
+	_, err = router.ResumeClient(ctx, resumed.Token, "admin-1", discard)
+	if !errors.Is(err, ErrUnknownSession) {
+		t.Fatalf("expected ErrUnknownSession for a superseded token, got %v", err)
+	}
+	if _, err := router.ResumeClient(ctx, latest.Token, "admin-1", discard); err != nil {
+		t.Fatalf("ResumeClient with the latest token: %v", err)
+	}
+}
@@ -2,17 +2,25 @@ package handshake
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/flynn/noise"
 )
 
+// errReadMessage marks failures to process a received handshake message, as
+// opposed to failures of the transport itself.
+var errReadMessage = errors.New("handshake read")
+
+// step is a single handshake message. Sending steps write payload into the
+// message; receiving steps ignore it and return the payload they read instead.
 type step interface {
 	apply(
-		context.Context,
-		*noise.HandshakeState,
-		Peer,
-	) (*noise.CipherState, *noise.CipherState, error)
+		ctx context.Context,
+		handshakeState *noise.HandshakeState,
+		peer Peer,
+		payload []byte,
+	) ([]byte, *noise.CipherState, *noise.CipherState, error)
 }
 
 type stepSend struct{}
@@ -21,17 +29,18 @@ func (stepSend) apply(
 	ctx context.Context,
 	handshakeState *noise.HandshakeState,
 	peer Peer,
-) (*noise.CipherState, *noise.CipherState, error) {
-	message, cipherState1, cipherState2, err := handshakeState.WriteMessage(nil, nil)
+	payload []byte,
+) ([]byte, *noise.CipherState, *noise.CipherState, error) {
+	message, cipherState1, cipherState2, err := handshakeState.WriteMessage(nil, payload)
 	if err != nil {
-		return nil, nil, fmt.Errorf("handshake write: %w", err)
+		return nil, nil, nil, fmt.Errorf("handshake write: %w", err)
 	}
 
 	if err := peer.Send(ctx, message); err != nil {
-		return nil, nil, fmt.Errorf("handshake send: %w", err)
+		return nil, nil, nil, fmt.Errorf("handshake send: %w", err)
 	}
 
-	return cipherState1, cipherState2, nil
+	return nil, cipherState1, cipherState2, nil
 }
 
 type stepReceive struct{}
@@ -40,15 +49,16 @@ func (stepReceive) apply(
 	ctx context.Context,
 	handshakeState *noise.HandshakeState,
 	peer Peer,
-) (*noise.CipherState, *noise.CipherState, error) {
+	_ []byte,
+) ([]byte, *noise.CipherState, *noise.CipherState, error) {
 	message, err := peer.Receive(ctx)
 	if err != nil {
-		return nil, nil, fmt.Errorf("handshake receive: %w", err)
+		return nil, nil, nil, fmt.Errorf("handshake receive: %w", err)
 	}
 
-	_, cipherState1, cipherState2, err := handshakeState.ReadMessage(nil, message)
+	payload, cipherState1, cipherState2, err := handshakeState.ReadMessage(nil, message)
 	if err != nil {
-		err = fmt.Errorf("handshake read: %w", err)
+		err = fmt.Errorf("%w: %w", errReadMessage, err)
 	}
-	return cipherState1, cipherState2, err
+	return payload, cipherState1, cipherState2, err
 }
@@ -1,22 +1,46 @@
 package crypto
 
 import (
-	"crypto/ed25519"
 	"crypto/rand"
+	"fmt"
 
 	"golang.org/x/crypto/curve25519"
 )
 
-func GenerateStaticKeypair() (ed25519.PublicKey, ed25519.PrivateKey, error) {
-	var privateKey [32]byte
+// StaticKeypair is an X25519 keypair used as a long-term Noise static key.
+// It is not a signing key.
+type StaticKeypair struct {
+	Public  []byte
+	Private []byte
+}
+
+func GenerateStaticKeypair() (StaticKeypair, error) {
+	var privateKey [curve25519.ScalarSize]byte
 	_, err := rand.Read(privateKey[:])
 	if err != nil {
-		return nil, nil, err
+		return StaticKeypair{}, err
 	}
-	publicKey, err := curve25519.X25519(privateKey[:], curve25519.Basepoint)
+
+	return NewStaticKeypair(privateKey[:])
+}
+
+// NewStaticKeypair recomputes the public half of an X25519 private key.
+func NewStaticKeypair(privateKey []byte) (StaticKeypair, error) {
+	if len(privateKey) != curve25519.ScalarSize {
+		return StaticKeypair{}, fmt.Errorf(
+			"x25519 private key must be %d bytes, got %d",
+			curve25519.ScalarSize,
+			len(privateKey),
+		)
+	}
+
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
 	if err != nil {
-		return nil, nil, err
+		return StaticKeypair{}, err
 	}
 
-	return publicKey, privateKey[:], nil
+	return StaticKeypair{
+		Public:  publicKey,
+		Private: append([]byte(nil), privateKey...),
+	}, nil
 }
@@ -0,0 +1,238 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var (
+	// ErrKeystoreExists is returned by CreateKeystore when the file already exists.
+	ErrKeystoreExists = errors.New("keystore: already exists")
+
+	// ErrWrongPassphrase is returned when a keystore cannot be opened with the
+	// given passphrase, or its contents have been tampered with.
+	ErrWrongPassphrase = errors.New("keystore: wrong passphrase or corrupted file")
+)
+
+const (
+	keystoreVersion = 1
+	keystoreKDF     = "argon2id"
+	keystoreDomain  = "decidr admin keystore"
+	keystoreSalt    = 16
+)
+
+// keystoreParams are the Argon2id parameters used for newly written keystores.
+// They are stored in the file so they can be raised later without breaking
+// existing keystores.
+var keystoreParams = keystoreKDFParams{
+	Time:    3,
+	Memory:  64 * 1024,
+	Threads: 4,
+}
+
+type keystoreKDFParams struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory_kib"`
+	Threads uint8  `json:"threads"`
+}
+
+// keystoreFile is the on-disk JSON representation of a sealed admin keypair.
+// The public key is stored in the clear so it can be shown without unlocking,
+// but it is authenticated together with the KDF parameters.
+type keystoreFile struct {
+	Version    int               `json:"version"`
+	KDF        string            `json:"kdf"`
+	Params     keystoreKDFParams `json:"params"`
+	Salt       []byte            `json:"salt"`
+	Nonce      []byte            `json:"nonce"`
+	PublicKey  []byte            `json:"public_key"`
+	Ciphertext []byte            `json:"ciphertext"`
+}
+
+// CreateKeystore generates a new admin static keypair and seals it in a new
+// file at path, encrypted with a key derived from passphrase.
+func CreateKeystore(path, passphrase string) (StaticKeypair, error) {
+	keypair, err := GenerateStaticKeypair()
+	if err != nil {
+		return StaticKeypair{}, err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return StaticKeypair{}, fmt.Errorf("%w: %s", ErrKeystoreExists, path)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return StaticKeypair{}, err
+	}
+
+	if err := writeKeystore(path, passphrase, keypair); err != nil {
+		return StaticKeypair{}, err
+	}
+	return keypair, nil
+}
+
+// UnlockKeystore reads the keypair sealed at path.
+func UnlockKeystore(path, passphrase string) (StaticKeypair, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return StaticKeypair{}, err
+	}
+
+	var file keystoreFile
+	if err := json.Unmarshal(contents, &file); err != nil {
+		return StaticKeypair{}, fmt.Errorf("keystore: parse %s: %w", path, err)
+	}
+	if file.Version != keystoreVersion || file.KDF != keystoreKDF {
+		return StaticKeypair{}, fmt.Errorf(
+			"keystore: unsupported format version %d with kdf %q",
+			file.Version,
+			file.KDF,
+		)
+	}
+	if err := file.Params.validate(); err != nil {
+		return StaticKeypair{}, err
+	}
+
+	aead, err := chacha20poly1305.New(deriveKeystoreKey(passphrase, file.Salt, file.Params))
+	if err != nil {
+		return StaticKeypair{}, err
+	}
+	if len(file.Nonce) != aead.NonceSize() {
+		return StaticKeypair{}, ErrWrongPassphrase
+	}
+
+	privateKey, err := aead.Open(nil, file.Nonce, file.Ciphertext, file.additionalData())
+	if err != nil {
+		return StaticKeypair{}, ErrWrongPassphrase
+	}
+
+	keypair, err := NewStaticKeypair(privateKey)
+	if err != nil {
+		return StaticKeypair{}, err
+	}
+	if !bytes.Equal(keypair.Public, file.PublicKey) {
+		return StaticKeypair{}, ErrWrongPassphrase
+	}
+	return keypair, nil
+}
+
+// RotateKeystore replaces the keypair sealed at path with a freshly generated
+// one. The passphrase must unlock the existing keystore. Every fingerprint
+// voters have verified for the old key becomes invalid.
+func RotateKeystore(path, passphrase string) (StaticKeypair, error) {
+	if _, err := UnlockKeystore(path, passphrase); err != nil {
+		return StaticKeypair{}, err
+	}
+
+	keypair, err := GenerateStaticKeypair()
+	if err != nil {
+		return StaticKeypair{}, err
+	}
+	if err := writeKeystore(path, passphrase, keypair); err != nil {
+		return StaticKeypair{}, err
+	}
+	return keypair, nil
+}
+
+// OpenOrCreateKeystore unlocks the keystore at path, creating it first if it
+// does not exist yet.
+func OpenOrCreateKeystore(
+	path, passphrase string,
+) (keypair StaticKeypair, created bool, err error) {
+	keypair, err = UnlockKeystore(path, passphrase)
+	if errors.Is(err, fs.ErrNotExist) {
+		keypair, err = CreateKeystore(path, passphrase)
+		return keypair, err == nil, err
+	}
+	return keypair, false, err
+}
+
+// writeKeystore seals keypair with a fresh salt and nonce and atomically
+// replaces the file at path.
+func writeKeystore(path, passphrase string, keypair StaticKeypair) error {
+	file := keystoreFile{
+		Version:   keystoreVersion,
+		KDF:       keystoreKDF,
+		Params:    keystoreParams,
+		Salt:      make([]byte, keystoreSalt),
+		Nonce:     make([]byte, chacha20poly1305.NonceSize),
+		PublicKey: keypair.Public,
+	}
+	if _, err := rand.Read(file.Salt); err != nil {
+		return err
+	}
+	if _, err := rand.Read(file.Nonce); err != nil {
+		return err
+	}
+
+	aead, err := chacha20poly1305.New(deriveKeystoreKey(passphrase, file.Salt, file.Params))
+	if err != nil {
+		return err
+	}
+	file.Ciphertext = aead.Seal(nil, file.Nonce, keypair.Private, file.additionalData())
+
+	contents, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(contents); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// validate rejects parameters that would make unlocking fail or take
+// unreasonably long, e.g. in a file crafted to exhaust the admin's memory.
+func (p keystoreKDFParams) validate() error {
+	if p.Time < 1 || p.Time > 16 || p.Memory < 8*1024 || p.Memory > 1024*1024 || p.Threads < 1 {
+		return fmt.Errorf("keystore: unreasonable kdf parameters %+v", p)
+	}
+	return nil
+}
+
+func deriveKeystoreKey(passphrase string, salt []byte, params keystoreKDFParams) []byte {
+	return argon2.IDKey(
+		[]byte(passphrase),
+		salt,
+		params.Time,
+		params.Memory,
+		params.Threads,
+		chacha20poly1305.KeySize,
+	)
+}
+
+// additionalData binds everything stored in the clear to the ciphertext.
+func (f keystoreFile) additionalData() []byte {
+	ad := []byte(keystoreDomain)
+	ad = binary.BigEndian.AppendUint32(ad, uint32(f.Version))
+	ad = append(ad, f.KDF...)
+	ad = binary.BigEndian.AppendUint32(ad, f.Params.Time)
+	ad = binary.BigEndian.AppendUint32(ad, f.Params.Memory)
+	ad = append(ad, f.Params.Threads)
+	ad = binary.BigEndian.AppendUint32(ad, uint32(len(f.Salt)))
+	ad = append(ad, f.Salt...)
+	return append(ad, f.PublicKey...)
+}
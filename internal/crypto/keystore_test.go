@@ -0,0 +1,127 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeystoreCreateAndUnlock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.keystore")
+
+	created, err := CreateKeystore(path, "correct horse")
+	if err != nil {
+		t.Fatalf("CreateKeystore: %v", err)
+	}
+
+	unlocked, err := UnlockKeystore(path, "correct horse")
+	if err != nil {
+		t.Fatalf("UnlockKeystore: %v", err)
+	}
+	if !bytes.Equal(created.Public, unlocked.Public) ||
+		!bytes.Equal(created.Private, unlocked.Private) {
+		t.Fatal("unlocked keypair differs from the created one")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		t.Fatalf("keystore is readable by others: %v", perm)
+	}
+
+	if _, err := CreateKeystore(path, "correct horse"); !errors.Is(err, ErrKeystoreExists) {
+		t.Fatalf("expected ErrKeystoreExists, got %v", err)
+	}
+}
+
+func TestKeystoreWrongPassphrase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.keystore")
+	if _, err := CreateKeystore(path, "correct horse"); err != nil {
+		t.Fatalf("CreateKeystore: %v", err)
+	}
+
+	if _, err := UnlockKeystore(path, "wrong horse"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("expected ErrWrongPassphrase, got %v", err)
+	}
+}
+
+func TestKeystoreDetectsTamperedPublicKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.keystore")
+	if _, err := CreateKeystore(path, "correct horse"); err != nil {
+		t.Fatalf("CreateKeystore: %v", err)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	var file keystoreFile
+	if err := json.Unmarshal(contents, &file); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	other, err := GenerateStaticKeypair()
+	if err != nil {
+		t.Fatalf("GenerateStaticKeypair: %v", err)
+	}
+	file.PublicKey = other.Public
+	if contents, err = json.Marshal(file); err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if err := os.WriteFile(path, contents, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if _, err := UnlockKeystore(path, "correct horse"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("expected ErrWrongPassphrase, got %v", err)
+	}
+}
+
+func TestKeystoreRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.keystore")
+	original, err := CreateKeystore(path, "correct horse")
+	if err != nil {
+		t.Fatalf("CreateKeystore: %v", err)
+	}
+
+	if _, err := RotateKeystore(path, "wrong horse"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("expected ErrWrongPassphrase, got %v", err)
+	}
+
+	rotated, err := RotateKeystore(path, "correct horse")
+	if err != nil {
+		t.Fatalf("RotateKeystore: %v", err)
+	}
+	if bytes.Equal(rotated.Public, original.Public) {
+		t.Fatal("rotation kept the old key")
+	}
+
+	unlocked, err := UnlockKeystore(path, "correct horse")
+	if err != nil {
+		t.Fatalf("UnlockKeystore: %v", err)
+	}
+	if !bytes.Equal(unlocked.Public, rotated.Public) {
+		t.Fatal("keystore does not contain the rotated key")
+	}
+}
+
+func TestOpenOrCreateKeystore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.keystore")
+
+	first, created, err := OpenOrCreateKeystore(path, "correct horse")
+	if err != nil || !created {
+		t.Fatalf("first OpenOrCreateKeystore = %v, %v", created, err)
+	}
+
+	second, created, err := OpenOrCreateKeystore(path, "correct horse")
+	if err != nil || created {
+		t.Fatalf("second OpenOrCreateKeystore = %v, %v", created, err)
+	}
+	if !bytes.Equal(first.Public, second.Public) {
+		t.Fatal("reopening the keystore yielded a different key")
+	}
+}
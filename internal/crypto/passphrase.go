@@ -0,0 +1,40 @@
+package crypto
+
+import (
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// PresharedKeySize is the length of a Noise pre-shared key in bytes.
+const PresharedKeySize = 32
+
+const (
+	meetingKeyDomain  = "decidr meeting passphrase v1"
+	meetingKeyTime    = 2
+	meetingKeyMemory  = 64 * 1024
+	meetingKeyThreads = 4
+)
+
+// DeriveMeetingKey stretches a meeting passphrase typed by a human into a
+// pre-shared key using Argon2id. The meeting ID salts the derivation so the
+// same passphrase yields unrelated keys for different meetings.
+//
+// Letter case and surrounding or repeated whitespace in the passphrase are
+// ignored, so "Blue  Horse" and "blue horse" derive the same key.
+func DeriveMeetingKey(passphrase, meetingID string) []byte {
+	salt := []byte(meetingKeyDomain + "\x00" + meetingID)
+
+	return argon2.IDKey(
+		[]byte(normalizePassphrase(passphrase)),
+		salt,
+		meetingKeyTime,
+		meetingKeyMemory,
+		meetingKeyThreads,
+		PresharedKeySize,
+	)
+}
+
+func normalizePassphrase(passphrase string) string {
+	return strings.Join(strings.Fields(strings.ToLower(passphrase)), " ")
+}
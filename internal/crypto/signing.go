@@ -0,0 +1,29 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/sha256"
+)
+
+// signingKeyDomain separates the derived signing key from any other key
+// derived from the same static keypair.
+const signingKeyDomain = "decidr admin signing key v1"
+
+// DeriveSigningKey derives an Ed25519 key from an X25519 static keypair, so
+// that the admin can sign with the key voters already trust without storing a
+// second secret. Anyone holding the static private key can derive it, and
+// nobody else can.
+func DeriveSigningKey(keypair StaticKeypair) (ed25519.PrivateKey, error) {
+	seed, err := hkdf.Key(
+		sha256.New,
+		keypair.Private,
+		keypair.Public,
+		signingKeyDomain,
+		ed25519.SeedSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
@@ -2,9 +2,41 @@
 package crypto
 
 import (
+	"crypto/sha256"
+
 	"github.com/Dsek-LTH/decidr/pkg/data/wordlists"
 )
 
+// SessionVerificationWordCount is the number of words compared aloud to
+// authenticate a session (66 bits).
+const SessionVerificationWordCount = 6
+
+// sessionVerificationDomain separates session verification words from any
+// other value derived from the same channel binding.
+const sessionVerificationDomain = "decidr session verification words v1\x00"
+
+// GetSessionVerificationWords derives the short authentication string for a
+// Noise session from its channel binding (the handshake hash). Both parties
+// only see the same words if they completed the same handshake, so comparing
+// them out of band detects a man in the middle even if it presents the right
+// admin key.
+func GetSessionVerificationWords(channelBinding []byte, wordCount int) []string {
+	hash := sha256.Sum256(append([]byte(sessionVerificationDomain), channelBinding...))
+	return GetVerificationWords(hash[:], wordCount)
+}
+
+// fingerprintDomain separates key fingerprints from session verification words.
+const fingerprintDomain = "decidr key fingerprint v1\x00"
+
+// GetKeyFingerprintWords derives the words printed next to a static public
+// key, e.g. on an enrolment QR code, so a voter can check that the key they
+// scanned is the one the admin announces in the room.
+func GetKeyFingerprintWords(publicKey []byte) []string {
+	hash := sha256.Sum256(append([]byte(fingerprintDomain), publicKey...))
+	return GetVerificationWords(hash[:], SessionVerificationWordCount)
+}
+
+// GetVerificationWords encodes hash as BIP-39 words, 11 bits per word.
 func GetVerificationWords(hash []byte, wordCount int) []string {
 	bitLength := len(hash) * 8
 	bits := make([]bool, bitLength)
@@ -0,0 +1,116 @@
+package envelope
+
+import "fmt"
+
+// ControlKind identifies the message carried by a control envelope.
+type ControlKind byte
+
+const (
+	// ControlClientConnected tells an admin that a client joined it.
+	ControlClientConnected ControlKind = iota + 1
+	// ControlClientDisconnected tells an admin that a client left it.
+	ControlClientDisconnected
+	// ControlListClients asks the proxy for the clients currently connected
+	// to the sending admin. It carries no IDs.
+	ControlListClients
+	// ControlClientList answers ControlListClients with every connected client.
+	ControlClientList
+	// ControlChallenge carries the nonce the proxy asks a new admin to sign.
+	ControlChallenge
+	// ControlChallengeResponse carries the admin's signing key and signature.
+	ControlChallengeResponse
+	// ControlSession tells a client the ID the proxy assigned to it and the
+	// token that lets it reclaim that ID after reconnecting.
+	ControlSession
+)
+
+func (k ControlKind) String() string {
+	switch k {
+	case ControlClientConnected:
+		return "client connected"
+	case ControlClientDisconnected:
+		return "client disconnected"
+	case ControlListClients:
+		return "list clients"
+	case ControlClientList:
+		return "client list"
+	case ControlChallenge:
+		return "challenge"
+	case ControlChallengeResponse:
+		return "challenge response"
+	case ControlSession:
+		return "session"
+	default:
+		return fmt.Sprintf("control(%d)", byte(k))
+	}
+}
+
+// carriesData reports whether the kind is followed by opaque data rather than
+// a list of client IDs.
+func (k ControlKind) carriesData() bool {
+	return k == ControlChallenge || k == ControlChallengeResponse
+}
+
+// Control is the decoded payload of a control envelope: the kind followed by
+// either opaque data (challenges) or each client ID prefixed with its length
+// in one byte. A session carries exactly one client ID, followed by the token
+// encoded the same way.
+type Control struct {
+	Kind      ControlKind
+	ClientIDs []string
+	Data      []byte
+	Token     string
+}
+
+// NewControl returns a control envelope addressed to destination.
+func NewControl(destination string, control Control) (Envelope, error) {
+	payload := []byte{byte(control.Kind)}
+	if control.Kind.carriesData() {
+		payload = append(payload, control.Data...)
+		return Envelope{Type: TypeControl, Destination: destination, Payload: payload}, nil
+	}
+	ids := control.ClientIDs
+	if control.Kind == ControlSession {
+		if len(ids) != 1 {
+			return Envelope{}, fmt.Errorf("%w: a session carries one client id", ErrMalformed)
+		}
+		ids = []string{ids[0], control.Token}
+	}
+	for _, id := range ids {
+		if len(id) > MaxIDLength {
+			return Envelope{}, ErrIDTooLong
+		}
+		payload = append(payload, byte(len(id)))
+		payload = append(payload, id...)
+	}
+	return Envelope{Type: TypeControl, Destination: destination, Payload: payload}, nil
+}
+
+// Control decodes the payload of a control envelope.
+func (e Envelope) Control() (Control, error) {
+	if e.Type != TypeControl || len(e.Payload) < 1 {
+		return Control{}, fmt.Errorf("%w: not a control envelope", ErrMalformed)
+	}
+
+	control := Control{Kind: ControlKind(e.Payload[0])}
+	if control.Kind.carriesData() {
+		control.Data = e.Payload[1:]
+		return control, nil
+	}
+	for rest := e.Payload[1:]; len(rest) > 0; {
+		id, next, ok := readID(rest)
+		if !ok {
+			return Control{}, fmt.Errorf("%w: truncated control id", ErrMalformed)
+		}
+		control.ClientIDs = append(control.ClientIDs, id)
+		rest = next
+	}
+	if control.Kind == ControlSession {
+		if len(control.ClientIDs) != 2 {
+			return Control{}, fmt.Errorf("%w: a session carries one client id", ErrMalformed)
+		}
+		control.Token = control.ClientIDs[1]
+		control.ClientIDs = control.ClientIDs[:1]
+	}
+	return control, nil
+}
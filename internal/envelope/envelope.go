@@ -0,0 +1,155 @@
+// Package envelope implements the framing spoken between endpoints and the
+// proxy. Every WebSocket message is exactly one envelope:
+//
+//	offset  size  field
+//	0       1     version, currently 1
+//	1       1     type (handshake, data, control or error)
+//	2       1     flags
+//	3       1     length of the source ID, n
+//	4       n     source ID
+//	4+n     1     length of the destination ID, m
+//	5+n     m     destination ID
+//	5+n+m   rest  payload
+//
+// IDs are opaque byte strings of at most 255 bytes. Endpoints leave the source
+// empty; the proxy overwrites it with the ID the sender connected as, so a
+// receiver can trust the source of every envelope it gets from the proxy.
+package envelope
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Version is the envelope format version written by Marshal.
+const Version byte = 1
+
+// MaxIDLength is the longest source or destination ID that can be encoded.
+const MaxIDLength = 255
+
+const headerSize = 5
+
+// MaxHeaderSize is the longest possible envelope header, so that a frame never
+// exceeds MaxHeaderSize plus the length of its payload.
+const MaxHeaderSize = headerSize + 2*MaxIDLength
+
+var (
+	// ErrMalformed is returned when a frame is too short or its fields are
+	// inconsistent.
+	ErrMalformed = errors.New("envelope: malformed frame")
+
+	// ErrUnsupportedVersion is returned for frames of another format version.
+	ErrUnsupportedVersion = errors.New("envelope: unsupported version")
+
+	// ErrUnknownType is returned for frames of a type this version does not define.
+	ErrUnknownType = errors.New("envelope: unknown type")
+
+	// ErrIDTooLong is returned by Marshal when an ID exceeds MaxIDLength.
+	ErrIDTooLong = errors.New("envelope: id too long")
+)
+
+// Type tells the receiver how to interpret the payload.
+type Type byte
+
+const (
+	// TypeHandshake carries a Noise handshake message.
+	TypeHandshake Type = iota + 1
+	// TypeData carries a message encrypted with the session's cipher states.
+	TypeData
+	// TypeControl carries a message from the proxy itself.
+	TypeControl
+	// TypeError reports why the proxy or a peer rejected an earlier frame.
+	// See NewError for the payload.
+	TypeError
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeHandshake:
+		return "handshake"
+	case TypeData:
+		return "data"
+	case TypeControl:
+		return "control"
+	case TypeError:
+		return "error"
+	default:
+		return fmt.Sprintf("type(%d)", byte(t))
+	}
+}
+
+func (t Type) valid() bool { return t >= TypeHandshake && t <= TypeError }
+
+// Flags modify how an envelope is handled.
+type Flags byte
+
+const (
+	// FlagFatal marks an error after which the sender closes the connection.
+	FlagFatal Flags = 1 << iota
+
+	knownFlags = FlagFatal
+)
+
+// Envelope is one decoded frame.
+type Envelope struct {
+	Type        Type
+	Flags       Flags
+	Source      string
+	Destination string
+	Payload     []byte
+}
+
+// Marshal encodes the envelope in the current format version.
+func (e Envelope) Marshal() ([]byte, error) {
+	if !e.Type.valid() {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownType, e.Type)
+	}
+	if len(e.Source) > MaxIDLength || len(e.Destination) > MaxIDLength {
+		return nil, ErrIDTooLong
+	}
+
+	frame := make([]byte, 0, headerSize+len(e.Source)+len(e.Destination)+len(e.Payload))
+	frame = append(frame, Version, byte(e.Type), byte(e.Flags))
+	frame = append(frame, byte(len(e.Source)))
+	frame = append(frame, e.Source...)
+	frame = append(frame, byte(len(e.Destination)))
+	frame = append(frame, e.Destination...)
+	return append(frame, e.Payload...), nil
+}
+
+// Unmarshal decodes a frame. The payload of the returned envelope aliases frame.
+func Unmarshal(frame []byte) (Envelope, error) {
+	if len(frame) < headerSize {
+		return Envelope{}, fmt.Errorf("%w: %d bytes", ErrMalformed, len(frame))
+	}
+	if frame[0] != Version {
+		return Envelope{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, frame[0])
+	}
+
+	e := Envelope{Type: Type(frame[1]), Flags: Flags(frame[2])}
+	if !e.Type.valid() {
+		return Envelope{}, fmt.Errorf("%w: %v", ErrUnknownType, e.Type)
+	}
+	if e.Flags&^knownFlags != 0 {
+		return Envelope{}, fmt.Errorf("%w: unknown flags %#x", ErrMalformed, byte(e.Flags))
+	}
+
+	rest := frame[3:]
+	var ok bool
+	if e.Source, rest, ok = readID(rest); !ok {
+		return Envelope{}, fmt.Errorf("%w: truncated source", ErrMalformed)
+	}
+	if e.Destination, rest, ok = readID(rest); !ok {
+		return Envelope{}, fmt.Errorf("%w: truncated destination", ErrMalformed)
+	}
+	e.Payload = rest
+	return e, nil
+}
+
+func readID(b []byte) (id string, rest []byte, ok bool) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return "", nil, false
+	}
+	n := int(b[0])
+	return string(b[1 : 1+n]), b[1+n:], true
+}
@@ -0,0 +1,239 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	for _, e := range []Envelope{
+		{Type: TypeHandshake, Destination: "admin-1", Payload: []byte("e, es")},
+		{Type: TypeData, Source: "client\n1", Destination: "admin-1", Payload: []byte{0, '\n', 1}},
+		{Type: TypeControl, Source: "proxy"},
+		{Type: TypeError, Flags: FlagFatal, Destination: strings.Repeat("x", MaxIDLength)},
+	} {
+		frame, err := e.Marshal()
+		if err != nil {
+			t.Fatalf("Marshal(%+v): %v", e, err)
+		}
+
+		got, err := Unmarshal(frame)
+		if err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		if got.Type != e.Type || got.Flags != e.Flags || got.Source != e.Source ||
+			got.Destination != e.Destination || !bytes.Equal(got.Payload, e.Payload) {
+			t.Fatalf("got %+v, want %+v", got, e)
+		}
+	}
+}
+
+func TestMarshalRejects(t *testing.T) {
+	if _, err := (Envelope{Type: 0}).Marshal(); !errors.Is(err, ErrUnknownType) {
+		t.Errorf("type 0: expected ErrUnknownType, got %v", err)
+	}
+
+	long := strings.Repeat("x", MaxIDLength+1)
+	if _, err := (Envelope{Type: TypeData, Source: long}).Marshal(); !errors.Is(err, ErrIDTooLong) {
+		t.Errorf("long source: expected ErrIDTooLong, got %v", err)
+	}
+}
+
+func TestUnmarshalRejects(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		frame []byte
+		want  error
+	}{
+		{"empty", nil, ErrMalformed},
+		{"short", []byte{Version, byte(TypeData), 0, 0}, ErrMalformed},
+		{"version", []byte{2, byte(TypeData), 0, 0, 0}, ErrUnsupportedVersion},
+		{"type", []byte{Version, 9, 0, 0, 0}, ErrUnknownType},
+		{"flags", []byte{Version, byte(TypeData), 0x80, 0, 0}, ErrMalformed},
+		{"source", []byte{Version, byte(TypeData), 0, 5, 'a', 'b'}, ErrMalformed},
+		{"destination", []byte{Version, byte(TypeData), 0, 0, 3, 'a'}, ErrMalformed},
+		{"legacy", []byte("client-1\nhello"), ErrUnsupportedVersion},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Unmarshal(test.frame); !errors.Is(err, test.want) {
+				t.Fatalf("expected %v, got %v", test.want, err)
+			}
+		})
+	}
+}
+
+func TestErrorFrame(t *testing.T) {
+	e := NewError("client-1", CodeUnknownDestination, "admin-9 is not connected")
+	e.Flags |= FlagFatal
+	e.Source = "admin-9"
+
+	frame, err := e.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Unmarshal(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var remote *Error
+	if !errors.As(decoded.Err(), &remote) {
+		t.Fatalf("expected *Error, got %v", decoded.Err())
+	}
+	if remote.Code != CodeUnknownDestination || remote.Message != "admin-9 is not connected" ||
+		!remote.Fatal || remote.Rejected != "admin-9" {
+		t.Fatalf("got %+v", remote)
+	}
+
+	if err := (Envelope{Type: TypeData}).Err(); err != nil {
+		t.Fatalf("data envelope reported error %v", err)
+	}
+	if err := (Envelope{Type: TypeError, Payload: []byte{1}}).Err(); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("expected ErrMalformed for a short error payload, got %v", err)
+	}
+}
+
+func TestCodeFor(t *testing.T) {
+	_, err := Unmarshal([]byte{7, 1, 0, 0, 0})
+	if code := CodeFor(err); code != CodeUnsupportedVersion {
+		t.Fatalf("got %v, want %v", code, CodeUnsupportedVersion)
+	}
+	_, err = Unmarshal([]byte{Version})
+	if code := CodeFor(err); code != CodeMalformedFrame {
+		t.Fatalf("got %v, want %v", code, CodeMalformedFrame)
+	}
+}
+
+// chanTransport delivers frames sent on one end to the other.
+type chanTransport struct {
+	in  <-chan []byte
+	out chan<- []byte
+}
+
+func (c chanTransport) Send(ctx context.Context, frame []byte) error {
+	select {
+	case c.out <- frame:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c chanTransport) Receive(ctx context.Context) ([]byte, error) {
+	select {
+	case frame := <-c.in:
+		return frame, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestPeer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	toProxy := make(chan []byte, 4)
+	fromProxy := make(chan []byte, 4)
+	peer := NewPeer(chanTransport{in: fromProxy, out: toProxy}, "admin-1")
+
+	if err := peer.As(TypeHandshake).Send(ctx, []byte("e")); err != nil {
+		t.Fatal(err)
+	}
+	sent, err := Unmarshal(<-toProxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.Type != TypeHandshake || sent.Destination != "admin-1" || string(sent.Payload) != "e" {
+		t.Fatalf("sent %+v", sent)
+	}
+
+	deliver := func(e Envelope) {
+		frame, err := e.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fromProxy <- frame
+	}
+
+	// Control frames are skipped by Receive.
+	deliver(Envelope{Type: TypeControl, Payload: []byte("presence")})
+	deliver(Envelope{Type: TypeData, Source: "admin-1", Payload: []byte("ack")})
+	if payload, err := peer.Receive(ctx); err != nil || string(payload) != "ack" {
+		t.Fatalf("Receive = %q, %v", payload, err)
+	}
+
+	deliver(Envelope{Type: TypeData, Source: "admin-2", Payload: []byte("spoof")})
+	if _, err := peer.Receive(ctx); !errors.Is(err, ErrUnexpectedSource) {
+		t.Fatalf("expected ErrUnexpectedSource, got %v", err)
+	}
+
+	deliver(NewError("", CodeUnknownDestination, ""))
+	var remote *Error
+	if _, err := peer.Receive(ctx); !errors.As(err, &remote) ||
+		remote.Code != CodeUnknownDestination {
+		t.Fatalf("expected remote unknown destination error, got %v", err)
+	}
+}
+
+func TestControlRoundTrip(t *testing.T) {
+	e, err := NewControl("admin-1", Control{
+		Kind:      ControlClientList,
+		ClientIDs: []string{"client-1", "", "client\n2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := e.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Unmarshal(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	control, err := decoded.Control()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if control.Kind != ControlClientList ||
+		strings.Join(control.ClientIDs, ",") != "client-1,,client\n2" {
+		t.Fatalf("got %+v", control)
+	}
+
+	e, err = NewControl("", Control{
+		Kind:      ControlSession,
+		ClientIDs: []string{"client-1"},
+		Token:     "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	control, err = e.Control()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(control.ClientIDs, []string{"client-1"}) || control.Token != "secret" {
+		t.Fatalf("session round trip got %+v", control)
+	}
+	session := Envelope{Type: TypeControl, Payload: []byte{byte(ControlSession), 1, 'a'}}
+	if _, err := session.Control(); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("expected ErrMalformed for a session without a token, got %v", err)
+	}
+
+	truncated := Envelope{Type: TypeControl, Payload: []byte{byte(ControlClientConnected), 4, 'a'}}
+	if _, err := truncated.Control(); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("expected ErrMalformed, got %v", err)
+	}
+	if _, err := (Envelope{Type: TypeData, Payload: []byte{1}}).Control(); !errors.Is(
+		err,
+		ErrMalformed,
+	) {
+		t.Fatalf("expected ErrMalformed for a data envelope, got %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package envelope
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrorCode identifies the reason in an error frame.
+type ErrorCode uint16
+
+const (
+	// CodeInternal is used for failures the sender does not classify further.
+	CodeInternal ErrorCode = iota
+	// CodeMalformedFrame means the rejected frame could not be decoded.
+	CodeMalformedFrame
+	// CodeUnsupportedVersion means the rejected frame used another format version.
+	CodeUnsupportedVersion
+	// CodeUnknownDestination means nobody with the destination ID is connected.
+	CodeUnknownDestination
+	// CodeForbidden means the sender may not send this frame to this destination.
+	CodeForbidden
+	// CodeDestinationDisconnected means the destination was connected earlier
+	// but is not reachable now.
+	CodeDestinationDisconnected
+	// CodePayloadTooLarge means the rejected frame exceeded the size limit.
+	CodePayloadTooLarge
+	// CodeRateLimited means the sender is sending too fast and should back off.
+	CodeRateLimited
+	// CodeDestinationBusy means the destination is not reading fast enough
+	// and the frame was dropped; the sender may retry later.
+	CodeDestinationBusy
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case CodeInternal:
+		return "internal error"
+	case CodeMalformedFrame:
+		return "malformed frame"
+	case CodeUnsupportedVersion:
+		return "unsupported version"
+	case CodeUnknownDestination:
+		return "unknown destination"
+	case CodeForbidden:
+		return "forbidden"
+	case CodeDestinationDisconnected:
+		return "destination disconnected"
+	case CodePayloadTooLarge:
+		return "payload too large"
+	case CodeRateLimited:
+		return "rate limited"
+	case CodeDestinationBusy:
+		return "destination busy"
+	default:
+		return fmt.Sprintf("code %d", uint16(c))
+	}
+}
+
+// CodeFor classifies an error returned by Unmarshal.
+func CodeFor(err error) ErrorCode {
+	switch {
+	case errors.Is(err, ErrUnsupportedVersion):
+		return CodeUnsupportedVersion
+	case errors.Is(err, ErrMalformed), errors.Is(err, ErrUnknownType):
+		return CodeMalformedFrame
+	default:
+		return CodeInternal
+	}
+}
+
+// Error is the decoded payload of an error frame. A Peer returns it from
+// Receive when the other side reports a problem.
+type Error struct {
+	Code    ErrorCode
+	Message string
+	// Fatal is set when the sender closes the connection after the frame.
+	Fatal bool
+	// Rejected is the destination of the rejected frame, if it had one.
+	Rejected string
+}
+
+func (e *Error) Error() string {
+	text := "envelope: remote error: " + e.Code.String()
+	if e.Rejected != "" {
+		text += " for " + e.Rejected
+	}
+	if e.Message == "" {
+		return text
+	}
+	return text + ": " + e.Message
+}
+
+// NewError returns an error frame addressed to destination. The payload is
+// the big-endian code followed by a UTF-8 message for humans. The proxy sets
+// the source of an error frame to the destination of the frame it rejected,
+// so that the sender can tell which of its frames failed.
+func NewError(destination string, code ErrorCode, message string) Envelope {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return Envelope{
+		Type:        TypeError,
+		Destination: destination,
+		Payload:     append(payload, message...),
+	}
+}
+
+// Err decodes the payload of an error frame. It returns nil for other types.
+func (e Envelope) Err() error {
+	if e.Type != TypeError {
+		return nil
+	}
+	if len(e.Payload) < 2 {
+		return fmt.Errorf("%w: short error payload", ErrMalformed)
+	}
+	return &Error{
+		Code:     ErrorCode(binary.BigEndian.Uint16(e.Payload)),
+		Message:  string(e.Payload[2:]),
+		Fatal:    e.Flags&FlagFatal != 0,
+		Rejected: e.Source,
+	}
+}
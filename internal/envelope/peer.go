@@ -0,0 +1,89 @@
+package envelope
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrUnexpectedSource is returned by Peer.Receive for an envelope from
+// someone other than the peer's remote party. The envelope is discarded and
+// the caller may keep receiving.
+var ErrUnexpectedSource = errors.New("envelope: unexpected source")
+
+// Transport carries whole frames, e.g. one WebSocket message per frame.
+// handshake.Peer satisfies it.
+type Transport interface {
+	Send(ctx context.Context, frame []byte) error
+	Receive(ctx context.Context) ([]byte, error)
+}
+
+// Peer exchanges envelopes with one remote party through the proxy. It sends
+// every payload as a single envelope of its type and returns the payloads
+// of handshake and data envelopes from that party.
+//
+// A Peer satisfies handshake.Peer, so it can be passed to handshake.Establish
+// and used as the transport of a SecureChannel.
+type Peer struct {
+	transport Transport
+	remote    string
+	frameType Type
+}
+
+// NewPeer returns a Peer that sends data envelopes to remote over transport.
+func NewPeer(transport Transport, remote string) *Peer {
+	return &Peer{transport: transport, remote: remote, frameType: TypeData}
+}
+
+// As returns a Peer on the same transport that sends envelopes of frameType,
+// e.g. TypeHandshake while the handshake is running.
+func (p *Peer) As(frameType Type) *Peer {
+	return &Peer{transport: p.transport, remote: p.remote, frameType: frameType}
+}
+
+// Remote returns the ID of the remote party.
+func (p *Peer) Remote() string { return p.remote }
+
+// Send wraps payload in an envelope addressed to the remote party.
+func (p *Peer) Send(ctx context.Context, payload []byte) error {
+	frame, err := Envelope{
+		Type:        p.frameType,
+		Destination: p.remote,
+		Payload:     payload,
+	}.Marshal()
+	if err != nil {
+		return err
+	}
+	return p.transport.Send(ctx, frame)
+}
+
+// Receive returns the payload of the next handshake or data envelope.
+// Control envelopes are skipped; use ReceiveEnvelope to see them. An error
+// frame is returned as an *Error.
+func (p *Peer) Receive(ctx context.Context) ([]byte, error) {
+	for {
+		e, err := p.ReceiveEnvelope(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := e.Err(); err != nil {
+			return nil, err
+		}
+		if e.Type == TypeControl {
+			continue
+		}
+		if e.Source != p.remote {
+			return nil, fmt.Errorf("%w: %q", ErrUnexpectedSource, e.Source)
+		}
+		return e.Payload, nil
+	}
+}
+
+// ReceiveEnvelope reads and decodes the next frame without filtering it.
+func (p *Peer) ReceiveEnvelope(ctx context.Context) (Envelope, error) {
+	frame, err := p.transport.Receive(ctx)
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Unmarshal(frame)
+}
@@ -0,0 +1,370 @@
+// Package metrics collects counters, gauges and histograms and serves them in
+// the Prometheus text exposition format, so that a Prometheus server can
+// scrape the proxy and admin servers without a client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the media type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultLatencyBuckets are histogram bounds in seconds suited to network
+// writes, from half a millisecond to ten seconds.
+var DefaultLatencyBuckets = []float64{
+	0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+// Registry holds metrics in the order they were registered. Registering a
+// name twice panics, as it is a programming error.
+type Registry struct {
+	metrics      []metric
+	names        map[string]bool
+	metricsMutex sync.Mutex
+}
+
+// metric is one metric family with its HELP and TYPE lines.
+type metric interface {
+	name() string
+	help() string
+	kind() string
+	// writeSamples writes the sample lines of the family.
+	writeSamples(w *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (registry *Registry) register(m metric) {
+	registry.metricsMutex.Lock()
+	defer registry.metricsMutex.Unlock()
+
+	if registry.names[m.name()] {
+		panic(fmt.Sprintf("metrics: %s registered twice", m.name()))
+	}
+	registry.names[m.name()] = true
+	registry.metrics = append(registry.metrics, m)
+}
+
+// Counter registers a counter with the given label names.
+func (registry *Registry) Counter(name, help string, labels ...string) *Counter {
+	counter := &Counter{family: newFamily(name, help, labels)}
+	registry.register(counter)
+	return counter
+}
+
+// Gauge registers a gauge with the given label names.
+func (registry *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	gauge := &Gauge{family: newFamily(name, help, labels)}
+	registry.register(gauge)
+	return gauge
+}
+
+// CounterFunc registers an unlabelled counter whose value is read from value
+// on every scrape, for counts kept elsewhere.
+func (registry *Registry) CounterFunc(name, help string, value func() float64) {
+	registry.register(&funcMetric{metricName: name, metricHelp: help, typ: "counter", value: value})
+}
+
+// GaugeFunc registers an unlabelled gauge whose value is read from value on
+// every scrape.
+func (registry *Registry) GaugeFunc(name, help string, value func() float64) {
+	registry.register(&funcMetric{metricName: name, metricHelp: help, typ: "gauge", value: value})
+}
+
+// Histogram registers a histogram with the given upper bucket bounds, which
+// must be sorted, and label names.
+func (registry *Registry) Histogram(
+	name, help string,
+	buckets []float64,
+	labels ...string,
+) *Histogram {
+	if !slices.IsSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets of %s are not sorted", name))
+	}
+	histogram := &Histogram{family: newFamily(name, help, labels), buckets: buckets}
+	registry.register(histogram)
+	return histogram
+}
+
+// WriteTo writes every metric in the text exposition format.
+func (registry *Registry) WriteTo(w io.Writer) (int64, error) {
+	registry.metricsMutex.Lock()
+	metrics := slices.Clone(registry.metrics)
+	registry.metricsMutex.Unlock()
+
+	counter := &countingWriter{w: w}
+	buffered := bufio.NewWriter(counter)
+	for _, m := range metrics {
+		fmt.Fprintf(buffered, "# HELP %s %s\n", m.name(), escapeHelp(m.help()))
+		fmt.Fprintf(buffered, "# TYPE %s %s\n", m.name(), m.kind())
+		m.writeSamples(buffered)
+	}
+	err := buffered.Flush()
+	return counter.n, err
+}
+
+// ServeHTTP serves the metrics to a scraper.
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	_, _ = registry.WriteTo(w)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// family holds the labelled series of one metric, keyed by their label
+// values.
+type family struct {
+	metricName  string
+	metricHelp  string
+	labels      []string
+	series      map[string]*series
+	seriesMutex sync.Mutex
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// buckets and sum are only used by histograms; buckets[i] counts the
+	// observations up to the i-th bound, and the last one the rest.
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+func newFamily(name, help string, labels []string) family {
+	return family{
+		metricName: name,
+		metricHelp: help,
+		labels:     labels,
+		series:     make(map[string]*series),
+	}
+}
+
+func (f *family) name() string { return f.metricName }
+
+func (f *family) help() string { return f.metricHelp }
+
+// get must be called with the series locked.
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf(
+			"metrics: %s has %d labels, got %d values",
+			f.metricName,
+			len(f.labels),
+			len(labelValues),
+		))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: slices.Clone(labelValues)}
+		f.series[key] = s
+	}
+	return s
+}
+
+// sorted returns copies of the series ordered by label values, so scrapes
+// are stable.
+func (f *family) sorted() []series {
+	f.seriesMutex.Lock()
+	defer f.seriesMutex.Unlock()
+
+	sorted := make([]series, 0, len(f.series))
+	for _, s := range f.series {
+		copied := *s
+		copied.buckets = slices.Clone(s.buckets)
+		sorted = append(sorted, copied)
+	}
+	slices.SortFunc(sorted, func(a, b series) int {
+		return slices.Compare(a.labelValues, b.labelValues)
+	})
+	return sorted
+}
+
+// labelPairs formats the labels of s as {a="1",b="2"}, followed by the extra
+// label if its name is not empty.
+func (f *family) labelPairs(s series, extraName, extraValue string) string {
+	pairs := make([]string, 0, len(f.labels)+1)
+	for i, name := range f.labels {
+		pairs = append(pairs, name+`="`+escapeLabel(s.labelValues[i])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+escapeLabel(extraValue)+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Counter is a value that only goes up, e.g. frames routed.
+type Counter struct {
+	family
+}
+
+func (*Counter) kind() string { return "counter" }
+
+// Inc adds one to the series with the given label values.
+func (counter *Counter) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+// Add adds delta, which must not be negative, to the series with the given
+// label values.
+func (counter *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("metrics: %s decreased", counter.metricName))
+	}
+	counter.seriesMutex.Lock()
+	counter.get(labelValues).value += delta
+	counter.seriesMutex.Unlock()
+}
+
+func (counter *Counter) writeSamples(w *bufio.Writer) {
+	for _, s := range counter.sorted() {
+		writeSample(w, counter.metricName, counter.labelPairs(s, "", ""), s.value)
+	}
+}
+
+// Gauge is a value that goes up and down, e.g. open connections.
+type Gauge struct {
+	family
+}
+
+func (*Gauge) kind() string { return "gauge" }
+
+// Set sets the series with the given label values.
+func (gauge *Gauge) Set(value float64, labelValues ...string) {
+	gauge.seriesMutex.Lock()
+	gauge.get(labelValues).value = value
+	gauge.seriesMutex.Unlock()
+}
+
+// Add adds delta to the series with the given label values.
+func (gauge *Gauge) Add(delta float64, labelValues ...string) {
+	gauge.seriesMutex.Lock()
+	gauge.get(labelValues).value += delta
+	gauge.seriesMutex.Unlock()
+}
+
+func (gauge *Gauge) writeSamples(w *bufio.Writer) {
+	for _, s := range gauge.sorted() {
+		writeSample(w, gauge.metricName, gauge.labelPairs(s, "", ""), s.value)
+	}
+}
+
+// Histogram counts observations, e.g. latencies, in buckets.
+type Histogram struct {
+	family
+	buckets []float64
+}
+
+func (*Histogram) kind() string { return "histogram" }
+
+// Observe records value in the series with the given label values.
+func (histogram *Histogram) Observe(value float64, labelValues ...string) {
+	histogram.seriesMutex.Lock()
+	defer histogram.seriesMutex.Unlock()
+
+	s := histogram.get(labelValues)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(histogram.buckets)+1)
+	}
+	i, _ := slices.BinarySearch(histogram.buckets, value)
+	s.buckets[i]++
+	s.sum += value
+	s.count++
+}
+
+func (histogram *Histogram) writeSamples(w *bufio.Writer) {
+	for _, s := range histogram.sorted() {
+		var cumulative uint64
+		for i, count := range s.buckets {
+			cumulative += count
+			bound := math.Inf(1)
+			if i < len(histogram.buckets) {
+				bound = histogram.buckets[i]
+			}
+			writeSample(
+				w,
+				histogram.metricName+"_bucket",
+				histogram.labelPairs(s, "le", formatValue(bound)),
+				float64(cumulative),
+			)
+		}
+		writeSample(w, histogram.metricName+"_sum", histogram.labelPairs(s, "", ""), s.sum)
+		writeSample(
+			w,
+			histogram.metricName+"_count",
+			histogram.labelPairs(s, "", ""),
+			float64(s.count),
+		)
+	}
+}
+
+// funcMetric reads its only value when scraped.
+type funcMetric struct {
+	metricName string
+	metricHelp string
+	typ        string
+	value      func() float64
+}
+
+func (m *funcMetric) name() string { return m.metricName }
+
+func (m *funcMetric) help() string { return m.metricHelp }
+
+func (m *funcMetric) kind() string { return m.typ }
+
+func (m *funcMetric) writeSamples(w *bufio.Writer) {
+	writeSample(w, m.metricName, "", m.value())
+}
+
+func writeSample(w *bufio.Writer, name, labels string, value float64) {
+	w.WriteString(name)
+	w.WriteString(labels)
+	w.WriteByte(' ')
+	w.WriteString(formatValue(value))
+	w.WriteByte('\n')
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string { return helpEscaper.Replace(help) }
+
+func escapeLabel(value string) string { return labelEscaper.Replace(value) }
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	registry := NewRegistry()
+	frames := registry.Counter("frames_total", "Frames routed.", "direction")
+	connections := registry.Gauge("connections", "Open connections.")
+	latency := registry.Histogram("write_seconds", "Write latency.", []float64{0.1, 1})
+	registry.GaugeFunc("queued_frames", "Frames waiting.", func() float64 { return 7 })
+
+	frames.Inc("to_client")
+	frames.Add(2, "to_admin")
+	frames.Inc("to_client")
+	connections.Set(3)
+	connections.Add(-1)
+	latency.Observe(0.05)
+	latency.Observe(0.1)
+	latency.Observe(4)
+
+	var out strings.Builder
+	if _, err := registry.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP frames_total Frames routed.
+# TYPE frames_total counter
+frames_total{direction="to_admin"} 2
+frames_total{direction="to_client"} 2
+# HELP connections Open connections.
+# TYPE connections gauge
+connections 2
+# HELP write_seconds Write latency.
+# TYPE write_seconds histogram
+write_seconds_bucket{le="0.1"} 2
+write_seconds_bucket{le="1"} 2
+write_seconds_bucket{le="+Inf"} 3
+write_seconds_sum 4.15
+write_seconds_count 3
+# HELP queued_frames Frames waiting.
+# TYPE queued_frames gauge
+queued_frames 7
+`
+	if out.String() != want {
+		t.Fatalf("exposition:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	registry := NewRegistry()
+	errors := registry.Counter("errors_total", "Errors\nby \\ kind.", "kind")
+	errors.Inc("say \"hi\"\n")
+
+	var out strings.Builder
+	if _, err := registry.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`# HELP errors_total Errors\nby \\ kind.`,
+		`errors_total{kind="say \"hi\"\n"} 1`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	registry := NewRegistry()
+	registry.CounterFunc("up_total", "Always one.", func() float64 { return 1 })
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if got := recorder.Header().Get("Content-Type"); got != ContentType {
+		t.Fatalf("Content-Type = %q", got)
+	}
+	if !strings.Contains(recorder.Body.String(), "up_total 1\n") {
+		t.Fatalf("body:\n%s", recorder.Body.String())
+	}
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	registry := NewRegistry()
+	registry.Gauge("connections", "Open connections.")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a name twice did not panic")
+		}
+	}()
+	registry.Counter("connections", "Again.")
+}
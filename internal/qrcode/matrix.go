@@ -0,0 +1,274 @@
+package qrcode
+
+// newCode allocates a symbol for version and draws every function pattern,
+// leaving the format information to be drawn once the mask is chosen.
+func newCode(version int, level Level) *Code {
+	size := version*4 + 17
+	code := &Code{
+		Version:    version,
+		Size:       size,
+		Level:      level,
+		modules:    make([][]bool, size),
+		isFunction: make([][]bool, size),
+	}
+	for y := range size {
+		code.modules[y] = make([]bool, size)
+		code.isFunction[y] = make([]bool, size)
+	}
+
+	for i := range size {
+		code.setFunction(6, i, i%2 == 0)
+		code.setFunction(i, 6, i%2 == 0)
+	}
+
+	code.drawFinderPattern(3, 3)
+	code.drawFinderPattern(size-4, 3)
+	code.drawFinderPattern(3, size-4)
+
+	positions := alignmentPatternPositions(version)
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			// Skip the three positions that overlap the finder patterns.
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			code.drawAlignmentPattern(x, y)
+		}
+	}
+
+	// Reserve the format information areas; they are overwritten later.
+	code.drawFormatBits(0)
+	code.drawVersion()
+	return code
+}
+
+func (c *Code) setFunction(x, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.isFunction[y][x] = true
+}
+
+// drawFinderPattern draws a finder pattern and its separator centred on (x, y).
+func (c *Code) drawFinderPattern(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= c.Size || yy >= c.Size {
+				continue
+			}
+			distance := max(abs(dx), abs(dy))
+			c.setFunction(xx, yy, distance != 2 && distance != 4)
+		}
+	}
+}
+
+func (c *Code) drawAlignmentPattern(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// drawFormatBits draws both copies of the format information for mask and
+// the dark module.
+func (c *Code) drawFormatBits(mask int) {
+	data := c.Level.formatBits()<<3 | mask
+	remainder := data
+	for range 10 {
+		remainder = remainder<<1 ^ (remainder>>9)*0x537
+	}
+	bits := (data<<10 | remainder) ^ 0x5412
+
+	for i := 0; i <= 5; i++ {
+		c.setFunction(8, i, bit(bits, i))
+	}
+	c.setFunction(8, 7, bit(bits, 6))
+	c.setFunction(8, 8, bit(bits, 7))
+	c.setFunction(7, 8, bit(bits, 8))
+	for i := 9; i < 15; i++ {
+		c.setFunction(14-i, 8, bit(bits, i))
+	}
+
+	for i := range 8 {
+		c.setFunction(c.Size-1-i, 8, bit(bits, i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFunction(8, c.Size-15+i, bit(bits, i))
+	}
+	c.setFunction(8, c.Size-8, true)
+}
+
+// drawVersion draws both copies of the version information for versions 7 and up.
+func (c *Code) drawVersion() {
+	if c.Version < 7 {
+		return
+	}
+
+	remainder := c.Version
+	for range 12 {
+		remainder = remainder<<1 ^ (remainder>>11)*0x1F25
+	}
+	bits := c.Version<<12 | remainder
+
+	for i := range 18 {
+		a, b := c.Size-11+i%3, i/3
+		c.setFunction(a, b, bit(bits, i))
+		c.setFunction(b, a, bit(bits, i))
+	}
+}
+
+// drawCodewords places the codewords in the zigzag order of the standard,
+// two columns at a time from the bottom right, skipping function modules.
+func (c *Code) drawCodewords(codewords []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		upward := (right+1)&2 == 0
+		for vertical := range c.Size {
+			for j := range 2 {
+				x := right - j
+				y := vertical
+				if upward {
+					y = c.Size - 1 - vertical
+				}
+				if c.isFunction[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				c.modules[y][x] = codewords[i/8]>>(7-i%8)&1 != 0
+				i++
+			}
+		}
+	}
+}
+
+// applyMask inverts every data module selected by mask. Applying the same mask
+// twice restores the original modules.
+func (c *Code) applyMask(mask int) {
+	for y := range c.Size {
+		for x := range c.Size {
+			if !c.isFunction[y][x] && maskSelects(mask, x, y) {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+func maskSelects(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	case 7:
+		return ((x+y)%2+x*y%3)%2 == 0
+	default:
+		panic("qrcode: invalid mask")
+	}
+}
+
+// Penalty weights from the standard.
+const (
+	penaltyRun     = 3
+	penaltyBlock   = 3
+	penaltyFinder  = 40
+	penaltyBalance = 10
+)
+
+// penalty scores the symbol on the four rules of the standard: long runs of
+// one colour, 2x2 blocks, finder-like patterns and dark/light imbalance.
+func (c *Code) penalty() int {
+	result := 0
+
+	for y := range c.Size {
+		result += c.linePenalty(func(i int) bool { return c.modules[y][i] })
+	}
+	for x := range c.Size {
+		result += c.linePenalty(func(i int) bool { return c.modules[i][x] })
+	}
+
+	dark := 0
+	for y := range c.Size {
+		for x := range c.Size {
+			if c.modules[y][x] {
+				dark++
+			}
+			if x+1 < c.Size && y+1 < c.Size {
+				color := c.modules[y][x]
+				if color == c.modules[y][x+1] &&
+					color == c.modules[y+1][x] &&
+					color == c.modules[y+1][x+1] {
+					result += penaltyBlock
+				}
+			}
+		}
+	}
+
+	total := c.Size * c.Size
+	// Steps of 5% away from a 50% dark ratio.
+	deviation := abs(dark*20-total*10) / total
+	result += deviation * penaltyBalance
+
+	return result
+}
+
+// finderLike is the 1:1:3:1:1 ratio of a finder pattern followed by four
+// light modules; its mirror image is penalised as well.
+var finderLike = []bool{true, false, true, true, true, false, true, false, false, false, false}
+
+func (c *Code) linePenalty(at func(int) bool) int {
+	result := 0
+
+	run := 1
+	for i := 1; i <= c.Size; i++ {
+		if i < c.Size && at(i) == at(i-1) {
+			run++
+			continue
+		}
+		if run >= 5 {
+			result += penaltyRun + run - 5
+		}
+		run = 1
+	}
+
+	for i := 0; i+len(finderLike) <= c.Size; i++ {
+		forward, backward := true, true
+		for j, dark := range finderLike {
+			if at(i+j) != dark {
+				forward = false
+			}
+			if at(i+len(finderLike)-1-j) != dark {
+				backward = false
+			}
+		}
+		if forward {
+			result += penaltyFinder
+		}
+		if backward {
+			result += penaltyFinder
+		}
+	}
+
+	return result
+}
+
+func bit(value, i int) bool { return (value>>i)&1 != 0 }
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,205 @@
+package qrcode
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomonRemainder(t *testing.T) {
+	// Version 1-M encoding of "01234567" from the standard's annex.
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+
+	got := reedSolomonRemainder(data, reedSolomonDivisor(len(want)))
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestFormatAndVersionBits(t *testing.T) {
+	code := newCode(7, Low)
+	code.drawFormatBits(0)
+
+	// Published values: format information for L with mask 0, and version
+	// information for version 7.
+	if got := readFormatBits(code); got != 0x77C4 {
+		t.Fatalf("format bits %#x, want 0x77c4", got)
+	}
+
+	version := 0
+	for i := 17; i >= 0; i-- {
+		version <<= 1
+		if code.modules[i/3][code.Size-11+i%3] {
+			version |= 1
+		}
+	}
+	if version != 0x07C94 {
+		t.Fatalf("version bits %#x, want 0x7c94", version)
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	inputs := []string{
+		"",
+		"decidr",
+		"decidr://join?proxy=ws%3A%2F%2Flocalhost%3A8080&admin=admin-1",
+		strings.Repeat("a vote is a vote ", 40),
+	}
+
+	for _, input := range inputs {
+		for level := Low; level <= High; level++ {
+			code, err := Encode([]byte(input), level)
+			if err != nil {
+				t.Fatalf("Encode(%d bytes, %d): %v", len(input), level, err)
+			}
+
+			got := decode(t, code)
+			if string(got) != input {
+				t.Fatalf("level %d: decoded %q, want %q", level, got, input)
+			}
+		}
+	}
+}
+
+func TestEncodeChoosesSmallestVersion(t *testing.T) {
+	// A version 1-L symbol holds at most 17 bytes.
+	code, err := Encode(bytes.Repeat([]byte{'x'}, 17), Low)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code.Version != 1 || code.Size != 21 {
+		t.Fatalf("got version %d of size %d, want 1 of size 21", code.Version, code.Size)
+	}
+
+	code, err = Encode(bytes.Repeat([]byte{'x'}, 18), Low)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code.Version != 2 {
+		t.Fatalf("got version %d, want 2", code.Version)
+	}
+}
+
+func TestEncodeTooLong(t *testing.T) {
+	_, err := Encode(make([]byte, 3000), Low)
+	if !errors.Is(err, ErrTooLong) {
+		t.Fatalf("expected ErrTooLong, got %v", err)
+	}
+}
+
+func TestSVG(t *testing.T) {
+	code, err := Encode([]byte("decidr"), Medium)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svg := code.SVG(4)
+	if !strings.HasPrefix(svg, "<svg") || !strings.Contains(svg, `viewBox="0 0 29 29"`) {
+		t.Fatalf("unexpected svg header: %.100s", svg)
+	}
+	// The top left module of the finder pattern is dark and sits inside the quiet zone.
+	if !strings.Contains(svg, "M4,4h1v1h-1z") {
+		t.Fatal("finder pattern missing from svg")
+	}
+}
+
+// readFormatBits reads the copy of the format information next to the lower
+// left and upper right finder patterns.
+func readFormatBits(code *Code) int {
+	bits := 0
+	for i := range 8 {
+		if code.modules[8][code.Size-1-i] {
+			bits |= 1 << i
+		}
+	}
+	for i := 8; i < 15; i++ {
+		if code.modules[code.Size-15+i][8] {
+			bits |= 1 << i
+		}
+	}
+	return bits
+}
+
+// decode reads the data back out of an error-free symbol, independently of
+// the mask and level recorded on code.
+func decode(t *testing.T, code *Code) []byte {
+	t.Helper()
+
+	format := readFormatBits(code) ^ 0x5412
+	mask := format >> 10 & 7
+	levelBits := format >> 13
+	level := Level(slices.Index([]int{1, 0, 3, 2}, levelBits))
+
+	// The function patterns only depend on the version.
+	reference := newCode(code.Version, level)
+
+	var bits bitBuffer
+	for right := code.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vertical := range code.Size {
+			for j := range 2 {
+				x, y := right-j, vertical
+				if upward {
+					y = code.Size - 1 - vertical
+				}
+				if reference.isFunction[y][x] {
+					continue
+				}
+				dark := code.modules[y][x] != maskSelects(mask, x, y)
+				bits.bits = append(bits.bits, dark)
+			}
+		}
+	}
+	codewords := bits.bytes()[:numRawDataModules(code.Version)/8]
+
+	// Undo the interleaving and drop the error correction codewords.
+	numBlocks := numErrorCorrectionBlocks[level][code.Version]
+	blockECCLen := eccCodewordsPerBlock[level][code.Version]
+	numShortBlocks := numBlocks - len(codewords)%numBlocks
+	shortDataLen := len(codewords)/numBlocks - blockECCLen
+
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := range shortDataLen + 1 {
+		for j := range blocks {
+			if i < shortDataLen || j >= numShortBlocks {
+				blocks[j] = append(blocks[j], codewords[k])
+				k++
+			}
+		}
+	}
+	data := slices.Concat(blocks...)
+
+	var stream bitBuffer
+	for _, b := range data {
+		stream.append(int(b), 8)
+	}
+	read := func(offset, length int) int {
+		value := 0
+		for _, bit := range stream.bits[offset : offset+length] {
+			value <<= 1
+			if bit {
+				value |= 1
+			}
+		}
+		return value
+	}
+
+	if mode := read(0, 4); mode != 0b0100 {
+		t.Fatalf("mode %04b, want byte mode", mode)
+	}
+	countBits := charCountBits(code.Version)
+	length := read(4, countBits)
+
+	out := make([]byte, length)
+	for i := range out {
+		out[i] = byte(read(4+countBits+8*i, 8))
+	}
+	return out
+}
@@ -0,0 +1,32 @@
+package qrcode
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SVG renders the code as a standalone SVG document with a quiet zone of the
+// given number of modules around it. Each module is one user unit, so the
+// image scales with the width and height of the element it is placed in.
+func (c *Code) SVG(quietZone int) string {
+	size := c.Size + 2*quietZone
+
+	var b strings.Builder
+	fmt.Fprintf(
+		&b,
+		`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size,
+		size,
+	)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/>`, size, size)
+	b.WriteString(`<path fill="#000" d="`)
+	for y := range c.Size {
+		for x := range c.Size {
+			if c.modules[y][x] {
+				fmt.Fprintf(&b, "M%d,%dh1v1h-1z", x+quietZone, y+quietZone)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.String()
+}
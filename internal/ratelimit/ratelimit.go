@@ -0,0 +1,142 @@
+// Package ratelimit implements the token buckets and connection counts the
+// proxy uses to keep one sender from flooding the others.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often a Limiter forgets the buckets that have refilled
+// completely, which behave exactly like new ones.
+const sweepInterval = time.Minute
+
+// Option configures a Limiter.
+type Option func(*Limiter)
+
+// WithClock replaces time.Now, e.g. in tests.
+func WithClock(now func() time.Time) Option {
+	return func(limiter *Limiter) {
+		limiter.now = now
+	}
+}
+
+// Limiter keeps a token bucket per key. Each bucket holds up to burst tokens
+// and refills at rate tokens per second; every allowed event takes one.
+// Limiter implements handshake.RateLimiter.
+type Limiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	buckets      map[string]*bucket
+	lastSweep    time.Time
+	bucketsMutex sync.Mutex
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// NewLimiter returns a Limiter allowing rate events per second per key, with
+// bursts of up to burst events. A rate of zero or less allows everything.
+func NewLimiter(rate float64, burst int, options ...Option) *Limiter {
+	limiter := &Limiter{
+		rate:    rate,
+		burst:   float64(max(burst, 1)),
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+	for _, option := range options {
+		option(limiter)
+	}
+	limiter.lastSweep = limiter.now()
+	return limiter
+}
+
+// Allow takes a token from key's bucket and reports whether there was one.
+func (limiter *Limiter) Allow(key string) bool {
+	if limiter.rate <= 0 {
+		return true
+	}
+
+	limiter.bucketsMutex.Lock()
+	defer limiter.bucketsMutex.Unlock()
+
+	now := limiter.now()
+	if now.Sub(limiter.lastSweep) >= sweepInterval {
+		limiter.sweep(now)
+	}
+
+	b, ok := limiter.buckets[key]
+	if !ok {
+		b = &bucket{tokens: limiter.burst, updated: now}
+		limiter.buckets[key] = b
+	}
+	b.tokens = limiter.refill(b, now)
+	b.updated = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill returns the tokens in b at now.
+func (limiter *Limiter) refill(b *bucket, now time.Time) float64 {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed <= 0 {
+		return b.tokens
+	}
+	return min(limiter.burst, b.tokens+elapsed*limiter.rate)
+}
+
+// sweep must be called with the buckets locked.
+func (limiter *Limiter) sweep(now time.Time) {
+	for key, b := range limiter.buckets {
+		if limiter.refill(b, now) >= limiter.burst {
+			delete(limiter.buckets, key)
+		}
+	}
+	limiter.lastSweep = now
+}
+
+// ConnectionLimiter counts open connections per key, e.g. per remote IP.
+type ConnectionLimiter struct {
+	limit       int
+	counts      map[string]int
+	countsMutex sync.Mutex
+}
+
+// NewConnectionLimiter returns a ConnectionLimiter allowing limit connections
+// per key. A limit of zero or less allows any number.
+func NewConnectionLimiter(limit int) *ConnectionLimiter {
+	return &ConnectionLimiter{limit: limit, counts: make(map[string]int)}
+}
+
+// Acquire counts a new connection for key and reports whether it is within
+// the limit. Every successful Acquire must be followed by a Release.
+func (limiter *ConnectionLimiter) Acquire(key string) bool {
+	limiter.countsMutex.Lock()
+	defer limiter.countsMutex.Unlock()
+
+	if limiter.limit > 0 && limiter.counts[key] >= limiter.limit {
+		return false
+	}
+	limiter.counts[key]++
+	return true
+}
+
+// Release ends a connection counted by Acquire.
+func (limiter *ConnectionLimiter) Release(key string) {
+	limiter.countsMutex.Lock()
+	defer limiter.countsMutex.Unlock()
+
+	if limiter.counts[key] <= 1 {
+		delete(limiter.counts, key)
+		return
+	}
+	limiter.counts[key]--
+}
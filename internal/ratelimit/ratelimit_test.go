@@ -0,0 +1,100 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto/handshake"
+)
+
+var _ handshake.RateLimiter = (*Limiter)(nil)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func allowN(limiter *Limiter, key string, n int) int {
+	allowed := 0
+	for range n {
+		if limiter.Allow(key) {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestLimiterBurstAndRefill(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	limiter := NewLimiter(10, 5, WithClock(clock.Now))
+
+	if got := allowN(limiter, "client-1", 8); got != 5 {
+		t.Fatalf("allowed %d of 8 at once, want the burst of 5", got)
+	}
+
+	// Other keys have buckets of their own.
+	if got := allowN(limiter, "client-2", 5); got != 5 {
+		t.Fatalf("client-2 allowed %d, want 5", got)
+	}
+
+	clock.Advance(300 * time.Millisecond)
+	if got := allowN(limiter, "client-1", 5); got != 3 {
+		t.Fatalf("allowed %d after 300ms at 10/s, want 3", got)
+	}
+
+	// Refilling stops at the burst.
+	clock.Advance(time.Hour)
+	if got := allowN(limiter, "client-1", 8); got != 5 {
+		t.Fatalf("allowed %d after an hour, want the burst of 5", got)
+	}
+}
+
+func TestLimiterSweepsFullBuckets(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	limiter := NewLimiter(1, 2, WithClock(clock.Now))
+
+	limiter.Allow("idle")
+	clock.Advance(sweepInterval)
+	limiter.Allow("busy")
+
+	if _, ok := limiter.buckets["idle"]; ok {
+		t.Fatal("the refilled bucket of an idle key was kept")
+	}
+	if _, ok := limiter.buckets["busy"]; !ok {
+		t.Fatal("the bucket of a busy key was dropped")
+	}
+}
+
+func TestLimiterDisabled(t *testing.T) {
+	limiter := NewLimiter(0, 0)
+	if got := allowN(limiter, "client-1", 1000); got != 1000 {
+		t.Fatalf("allowed %d with no rate, want all", got)
+	}
+}
+
+func TestConnectionLimiter(t *testing.T) {
+	limiter := NewConnectionLimiter(2)
+
+	if !limiter.Acquire("10.0.0.1") || !limiter.Acquire("10.0.0.1") {
+		t.Fatal("connections within the limit were refused")
+	}
+	if limiter.Acquire("10.0.0.1") {
+		t.Fatal("a third connection was allowed")
+	}
+	if !limiter.Acquire("10.0.0.2") {
+		t.Fatal("another IP was refused")
+	}
+
+	limiter.Release("10.0.0.1")
+	if !limiter.Acquire("10.0.0.1") {
+		t.Fatal("a connection was refused after one was released")
+	}
+
+	limiter.Release("10.0.0.2")
+	if len(limiter.counts) != 1 {
+		t.Fatalf("counts = %v, want only 10.0.0.1", limiter.counts)
+	}
+}
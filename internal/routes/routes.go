@@ -1,16 +1,46 @@
 package routes
 
 import (
+	"html/template"
 	"net/http"
+	"strings"
 
+	"github.com/Dsek-LTH/decidr/internal/crypto/handshake"
+	"github.com/Dsek-LTH/decidr/internal/qrcode"
 	"github.com/Dsek-LTH/decidr/internal/templates"
 )
 
-func RegisterRoutes(mux *http.ServeMux, renderer *templates.TemplateRenderer) {
+// qrQuietZone is the light border around the enrolment QR code, in modules.
+const qrQuietZone = 4
+
+func RegisterRoutes(
+	mux *http.ServeMux,
+	renderer *templates.TemplateRenderer,
+	enrollment handshake.Enrollment,
+) {
 	mux.HandleFunc(
 		"/",
 		func(w http.ResponseWriter, req *http.Request) {
 			renderer.Render(w, "home", nil)
 		},
 	)
+
+	mux.HandleFunc(
+		"/enrol",
+		func(w http.ResponseWriter, req *http.Request) {
+			uri := enrollment.URI()
+			code, err := qrcode.Encode([]byte(uri), qrcode.Medium)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			renderer.Render(w, "enrol", map[string]any{
+				"QRCode":  template.HTML(code.SVG(qrQuietZone)),
+				"Words":   strings.Join(enrollment.FingerprintWords(), " "),
+				"URI":     uri,
+				"AdminID": enrollment.AdminID,
+			})
+		},
+	)
 }
@@ -0,0 +1,384 @@
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto/handshake"
+)
+
+// An SSE session carries frames over plain HTTP for networks that break
+// WebSocket upgrades. The proxy sends frames down a Server-Sent Events
+// stream opened with a GET request, and the remote sends each frame up in
+// the body of its own POST request to the same path with ?session=. The
+// events are:
+//
+//	event: session   data: the session ID, first on every stream
+//	event: message   data: a frame, base64 encoded
+//	event: close     data: a WebSocket close code, a space and the reason
+const (
+	sseSessionEvent = "session"
+	sseMessageEvent = "message"
+	sseCloseEvent   = "close"
+
+	// sseReceiveQueue is how many posted frames wait for Receive before
+	// further POST requests block.
+	sseReceiveQueue = 16
+
+	// DefaultSSEKeepalive is how often an idle event stream gets a comment,
+	// which keeps proxies in between from timing it out.
+	DefaultSSEKeepalive = 15 * time.Second
+)
+
+// SSEOption configures the SSEPeers of an SSESessions.
+type SSEOption func(*SSEPeer)
+
+// WithSSESendQueue sets how many frames are buffered for the writer.
+func WithSSESendQueue(size int) SSEOption {
+	return func(peer *SSEPeer) {
+		peer.outbound = make(chan outboundFrame, size)
+	}
+}
+
+// WithSSEWriteTimeout bounds how long writing a single event may take.
+func WithSSEWriteTimeout(timeout time.Duration) SSEOption {
+	return func(peer *SSEPeer) {
+		peer.writeTimeout = timeout
+	}
+}
+
+// WithSSEKeepalive sets how often an idle event stream gets a comment.
+func WithSSEKeepalive(interval time.Duration) SSEOption {
+	return func(peer *SSEPeer) {
+		peer.keepalive = interval
+	}
+}
+
+// WithSSEMaxFrameSize sets the largest frame a POST request may carry. It
+// defaults to handshake.DefaultMaxFrameSize.
+func WithSSEMaxFrameSize(size int) SSEOption {
+	return func(peer *SSEPeer) {
+		peer.maxFrameSize = size
+	}
+}
+
+// WithSSEObserver reports every written frame to observer.
+func WithSSEObserver(observer PeerObserver) SSEOption {
+	return func(peer *SSEPeer) {
+		peer.observer = observer
+	}
+}
+
+// SSESessions pairs the event streams of SSEPeers with the POST requests
+// carrying the frames their remotes send.
+type SSESessions struct {
+	options []SSEOption
+
+	peers      map[string]*SSEPeer
+	peersMutex sync.Mutex
+}
+
+// NewSSESessions returns an SSESessions that configures its peers with
+// options.
+func NewSSESessions(options ...SSEOption) *SSESessions {
+	return &SSESessions{
+		options: options,
+		peers:   make(map[string]*SSEPeer),
+	}
+}
+
+// Open answers r with an event stream and returns the peer that sends down
+// it. The handler serving r must call Close or CloseWithCode before it
+// returns; the stream ends then, or when the remote goes away.
+func (sessions *SSESessions) Open(w http.ResponseWriter, r *http.Request) (*SSEPeer, error) {
+	peer := &SSEPeer{
+		id:           rand.Text(),
+		sessions:     sessions,
+		w:            w,
+		controller:   http.NewResponseController(w),
+		request:      r.Context(),
+		inbound:      make(chan []byte, sseReceiveQueue),
+		outbound:     make(chan outboundFrame, DefaultSendQueue),
+		writeTimeout: DefaultWriteTimeout,
+		keepalive:    DefaultSSEKeepalive,
+		maxFrameSize: handshake.DefaultMaxFrameSize,
+		closing:      make(chan struct{}),
+		done:         make(chan struct{}),
+		writerDone:   make(chan struct{}),
+	}
+	for _, option := range sessions.options {
+		option(peer)
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	// Keeps nginx from buffering the stream.
+	header.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	_ = peer.controller.SetWriteDeadline(time.Now().Add(peer.writeTimeout))
+	if err := peer.writeEvent(sseSessionEvent, peer.id); err != nil {
+		return nil, err
+	}
+
+	sessions.peersMutex.Lock()
+	sessions.peers[peer.id] = peer
+	sessions.peersMutex.Unlock()
+
+	go peer.writePump()
+	return peer, nil
+}
+
+// ServeHTTP hands the frame in the body of a POST request to the Receive of
+// the session named by ?session=. It answers 204 once the frame was
+// queued for Receive, 404 for an unknown session and 410 for one that has ended. The
+// remote must wait for the answer before posting its next frame, as
+// concurrent requests may be received in any order.
+func (sessions *SSESessions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessions.peersMutex.Lock()
+	peer, ok := sessions.peers[r.URL.Query().Get("session")]
+	sessions.peersMutex.Unlock()
+	if !ok {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	frame, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(peer.maxFrameSize)))
+	if err != nil {
+		if maxBytes := (*http.MaxBytesError)(nil); errors.As(err, &maxBytes) {
+			http.Error(w, "frame too large", http.StatusRequestEntityTooLarge)
+		}
+		return
+	}
+
+	select {
+	case peer.inbound <- frame:
+		w.WriteHeader(http.StatusNoContent)
+	case <-peer.done:
+		http.Error(w, "session ended", http.StatusGone)
+	case <-r.Context().Done():
+	}
+}
+
+func (sessions *SSESessions) remove(peer *SSEPeer) {
+	sessions.peersMutex.Lock()
+	delete(sessions.peers, peer.id)
+	sessions.peersMutex.Unlock()
+}
+
+// SSEPeer is a handshake.Peer over an SSE session, seen from the proxy.
+// Like a WebSocketPeer, it writes through one writer goroutine, so Send may
+// be called concurrently and does not wait for the frame to be written.
+type SSEPeer struct {
+	id         string
+	sessions   *SSESessions
+	w          http.ResponseWriter
+	controller *http.ResponseController
+	// request is done when the remote closed the event stream.
+	request context.Context
+
+	inbound      chan []byte
+	outbound     chan outboundFrame
+	writeTimeout time.Duration
+	keepalive    time.Duration
+	maxFrameSize int
+	observer     PeerObserver
+
+	// closing asks the writer to flush the queue and send the close event.
+	closing     chan struct{}
+	closingOnce sync.Once
+	closeData   string
+
+	// done is closed when the session ended for any reason; err says why.
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+	// writerDone is closed when the writer stopped writing to w.
+	writerDone chan struct{}
+}
+
+var _ handshake.Closer = (*SSEPeer)(nil)
+
+// ID returns the session ID the remote posts its frames with.
+func (peer *SSEPeer) ID() string {
+	return peer.id
+}
+
+// Send queues frame for the writer. It fails with ErrQueueFull instead of
+// blocking when the remote is not keeping up.
+func (peer *SSEPeer) Send(ctx context.Context, frame []byte) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-peer.done:
+		return peer.closedError()
+	case <-peer.closing:
+		return ErrClosed
+	default:
+	}
+
+	outbound := outboundFrame{data: frame, queued: time.Now()}
+	if deadline, ok := ctx.Deadline(); ok {
+		outbound.deadline = deadline
+	}
+	select {
+	case peer.outbound <- outbound:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Queued returns the number of frames waiting for the writer.
+func (peer *SSEPeer) Queued() int {
+	return len(peer.outbound)
+}
+
+// Receive returns the next frame the remote posted. Cancelling ctx leaves
+// the session usable.
+func (peer *SSEPeer) Receive(ctx context.Context) ([]byte, error) {
+	select {
+	case frame := <-peer.inbound:
+		return frame, nil
+	case <-peer.done:
+		return nil, peer.closedError()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close ends the session with CloseReplaced and reason.
+func (peer *SSEPeer) Close(reason string) error {
+	return peer.CloseWithCode(CloseReplaced, reason)
+}
+
+// CloseWithCode writes the frames already queued and a close event with code
+// and reason, and waits for the writer to stop. Frames that cannot be
+// written within the write timeout are discarded.
+func (peer *SSEPeer) CloseWithCode(code int, reason string) error {
+	peer.closingOnce.Do(func() {
+		// An event's data cannot span lines without changing meaning.
+		reason = strings.NewReplacer("\r", " ", "\n", " ").Replace(reason)
+		peer.closeData = fmt.Sprintf("%d %s", code, reason)
+		close(peer.closing)
+	})
+	<-peer.writerDone
+	return nil
+}
+
+// shutdown records why the session ended, once.
+func (peer *SSEPeer) shutdown(err error) {
+	peer.closeOnce.Do(func() {
+		peer.err = err
+		close(peer.done)
+	})
+}
+
+func (peer *SSEPeer) closedError() error {
+	if errors.Is(peer.err, ErrClosed) {
+		return peer.err
+	}
+	return fmt.Errorf("%w: %w", ErrClosed, peer.err)
+}
+
+// writePump is the only goroutine that writes events to the stream.
+func (peer *SSEPeer) writePump() {
+	defer close(peer.writerDone)
+	defer peer.sessions.remove(peer)
+	// The server keeps the connection for further requests, which must not
+	// inherit a deadline.
+	defer peer.controller.SetWriteDeadline(time.Time{})
+
+	ticker := time.NewTicker(peer.keepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case frame := <-peer.outbound:
+			now := time.Now()
+			deadline := now.Add(peer.writeTimeout)
+			if !frame.deadline.IsZero() && frame.deadline.Before(deadline) {
+				deadline = frame.deadline
+			}
+			if !deadline.After(now) {
+				// The sender has given up on the frame.
+				continue
+			}
+			_ = peer.controller.SetWriteDeadline(deadline)
+			if err := peer.write(frame); err != nil {
+				peer.shutdown(err)
+				return
+			}
+		case <-ticker.C:
+			_ = peer.controller.SetWriteDeadline(time.Now().Add(peer.writeTimeout))
+			if err := peer.writeComment(); err != nil {
+				peer.shutdown(err)
+				return
+			}
+		case <-peer.request.Done():
+			peer.shutdown(ErrClosed)
+			return
+		case <-peer.closing:
+			peer.drain()
+			return
+		}
+	}
+}
+
+// write writes frame and tells the observer how long it took.
+func (peer *SSEPeer) write(frame outboundFrame) error {
+	start := time.Now()
+	if err := peer.writeEvent(
+		sseMessageEvent,
+		base64.StdEncoding.EncodeToString(frame.data),
+	); err != nil {
+		return err
+	}
+	if peer.observer != nil {
+		peer.observer.FrameWritten(len(frame.data), start.Sub(frame.queued), time.Since(start))
+	}
+	return nil
+}
+
+// drain writes the queued frames and the close event within one write
+// timeout.
+func (peer *SSEPeer) drain() {
+	_ = peer.controller.SetWriteDeadline(time.Now().Add(peer.writeTimeout))
+	for len(peer.outbound) > 0 {
+		if err := peer.write(<-peer.outbound); err != nil {
+			peer.shutdown(err)
+			return
+		}
+	}
+
+	_ = peer.writeEvent(sseCloseEvent, peer.closeData)
+	peer.shutdown(ErrClosed)
+}
+
+func (peer *SSEPeer) writeEvent(event, data string) error {
+	if _, err := fmt.Fprintf(peer.w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	return peer.controller.Flush()
+}
+
+func (peer *SSEPeer) writeComment() error {
+	if _, err := io.WriteString(peer.w, ":\n\n"); err != nil {
+		return err
+	}
+	return peer.controller.Flush()
+}
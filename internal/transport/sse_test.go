@@ -0,0 +1,316 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto/handshake"
+	"github.com/Dsek-LTH/decidr/internal/envelope"
+)
+
+// newSSEPair returns the proxy's end of an SSE session and the remote end,
+// along with the URL frames are posted to.
+func newSSEPair(t *testing.T, options ...SSEOption) (*SSEPeer, *SSEClientPeer, string) {
+	t.Helper()
+
+	sessions := NewSSESessions(options...)
+	peers := make(chan *SSEPeer, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sse", func(w http.ResponseWriter, r *http.Request) {
+		peer, err := sessions.Open(w, r)
+		if err != nil {
+			t.Errorf("open: %v", err)
+			return
+		}
+		peers <- peer
+		// Like the proxy, serve the session until it ends.
+		<-peer.done
+		peer.Close("")
+	})
+	mux.Handle("POST /sse", sessions)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	remote, err := DialSSE(ctx, server.Client(), server.URL+"/sse?admin=admin-1")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { remote.Close() })
+
+	peer := <-peers
+	t.Cleanup(func() { peer.Close("") })
+	if remote.SessionID() != peer.ID() {
+		t.Fatalf("remote has session %q, proxy %q", remote.SessionID(), peer.ID())
+	}
+	return peer, remote, server.URL + "/sse?session=" + peer.ID()
+}
+
+func TestSSEPeerFrames(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	peer, remote, _ := newSSEPair(t, WithSSEKeepalive(time.Millisecond))
+	frames := [][]byte{
+		[]byte("hello"),
+		{0, '\n', '\r', 0xff, ':'},
+		bytes.Repeat([]byte("x"), 60_000),
+	}
+
+	for _, frame := range frames {
+		if err := remote.Send(ctx, frame); err != nil {
+			t.Fatalf("remote send: %v", err)
+		}
+	}
+	for _, want := range frames {
+		got, err := peer.Receive(ctx)
+		if err != nil {
+			t.Fatalf("proxy receive: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf(
+				"proxy received %q, want %q",
+				got[:min(len(got), 10)],
+				want[:min(len(want), 10)],
+			)
+		}
+	}
+
+	// Keepalive comments between the frames are skipped.
+	for _, frame := range frames {
+		if err := peer.Send(ctx, frame); err != nil {
+			t.Fatalf("proxy send: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	for _, want := range frames {
+		got, err := remote.Receive(ctx)
+		if err != nil {
+			t.Fatalf("remote receive: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf(
+				"remote received %q, want %q",
+				got[:min(len(got), 10)],
+				want[:min(len(want), 10)],
+			)
+		}
+	}
+}
+
+func TestSSEPeerCloseWithCode(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	peer, remote, postURL := newSSEPair(t)
+	if err := peer.Send(ctx, []byte("queued")); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.CloseWithCode(1012, "restarting\nsoon"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Frames queued before closing are delivered first.
+	if got, err := remote.Receive(ctx); err != nil || string(got) != "queued" {
+		t.Fatalf("received %q, %v", got, err)
+	}
+	_, err := remote.Receive(ctx)
+	var closeErr *SSECloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != 1012 ||
+		closeErr.Reason != "restarting soon" {
+		t.Fatalf("expected a close error with code 1012, got %v", err)
+	}
+	if !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected the close error to match ErrClosed")
+	}
+
+	if err := peer.Send(ctx, []byte("late")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed after closing, got %v", err)
+	}
+	response, err := http.Post(postURL, "application/octet-stream", strings.NewReader("late"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotFound {
+		t.Fatalf("posting to an ended session: %s", response.Status)
+	}
+}
+
+func TestSSEPeerRemoteGoesAway(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	peer, remote, _ := newSSEPair(t)
+	if err := remote.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Receive(ctx); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed after the remote closed its stream, got %v", err)
+	}
+	if err := remote.Send(ctx, []byte("late")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed sending on a closed session, got %v", err)
+	}
+}
+
+func TestSSEPeerMaxFrameSize(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	peer, remote, _ := newSSEPair(t, WithSSEMaxFrameSize(16))
+	if err := remote.Send(ctx, make([]byte, 17)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("expected ErrFrameTooLarge, got %v", err)
+	}
+	if err := remote.Send(ctx, []byte("fits")); err != nil {
+		t.Fatalf("send after a rejected frame: %v", err)
+	}
+	if got, err := peer.Receive(ctx); err != nil || string(got) != "fits" {
+		t.Fatalf("received %q, %v", got, err)
+	}
+}
+
+// TestSSEPeerThroughRouter connects a client over SSE and its admin over a
+// stream to one router, which cannot tell them from WebSocket peers.
+func TestSSEPeerThroughRouter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	router := handshake.NewMemoryRouter()
+	admin, proxySideAdmin := newStreamPair(t, "unix")
+	router.RegisterAdmin("admin-1", proxySideAdmin)
+
+	sessions := NewSSESessions()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sse/client", func(w http.ResponseWriter, r *http.Request) {
+		peer, err := sessions.Open(w, r)
+		if err != nil {
+			t.Errorf("open: %v", err)
+			return
+		}
+		defer peer.Close("")
+		session, err := router.JoinClient(r.Context(), r.URL.Query().Get("admin"), peer)
+		if err != nil {
+			t.Errorf("JoinClient: %v", err)
+			return
+		}
+		defer router.LeaveClient(session)
+		for {
+			frame, err := peer.Receive(r.Context())
+			if err != nil {
+				return
+			}
+			if err := router.RouteFromClient(r.Context(), session.ID, frame); err != nil {
+				t.Errorf("RouteFromClient: %v", err)
+			}
+		}
+	})
+	mux.Handle("POST /sse/client", sessions)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client, err := DialSSE(ctx, server.Client(), server.URL+"/sse/client?admin=admin-1")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	session, err := handshake.ReceiveClientSession(ctx, client)
+	if err != nil {
+		t.Fatalf("ReceiveClientSession: %v", err)
+	}
+
+	// The admin hears of the client before its first frame.
+	receiveEnvelope := func(peer handshake.Peer) envelope.Envelope {
+		t.Helper()
+		frame, err := peer.Receive(ctx)
+		if err != nil {
+			t.Fatalf("receive: %v", err)
+		}
+		e, err := envelope.Unmarshal(frame)
+		if err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		return e
+	}
+	if e := receiveEnvelope(admin); e.Type != envelope.TypeControl {
+		t.Fatalf("admin got %+v, want the client connected control frame", e)
+	}
+
+	ballot, err := envelope.Envelope{Type: envelope.TypeData, Payload: []byte("ballot")}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Send(ctx, ballot); err != nil {
+		t.Fatalf("client send: %v", err)
+	}
+	if e := receiveEnvelope(admin); e.Source != session.ID || string(e.Payload) != "ballot" {
+		t.Fatalf("admin got %+v", e)
+	}
+
+	receipt, err := envelope.Envelope{
+		Type:        envelope.TypeData,
+		Destination: session.ID,
+		Payload:     []byte("receipt"),
+	}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := router.RouteFromAdmin(ctx, "admin-1", receipt); err != nil {
+		t.Fatalf("RouteFromAdmin: %v", err)
+	}
+	if e := receiveEnvelope(client); e.Source != "admin-1" || string(e.Payload) != "receipt" {
+		t.Fatalf("client got %+v", e)
+	}
+}
+
+func TestSSESessionsRejectUnknownSessions(t *testing.T) {
+	server := httptest.NewServer(NewSSESessions())
+	defer server.Close()
+
+	for _, test := range []struct {
+		method string
+		query  string
+		status int
+	}{
+		{http.MethodPost, "?session=nonexistent", http.StatusNotFound},
+		{http.MethodPost, "", http.StatusNotFound},
+		{http.MethodGet, "?session=nonexistent", http.StatusMethodNotAllowed},
+	} {
+		request, err := http.NewRequest(test.method, server.URL+test.query, strings.NewReader("x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != test.status {
+			t.Errorf(
+				"%s %s: got %s, want %d",
+				test.method,
+				test.query,
+				response.Status,
+				test.status,
+			)
+		}
+	}
+}
+
+func TestDialSSERefused(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "missing admin", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	_, err := DialSSE(context.Background(), nil, server.URL)
+	if err == nil || !strings.Contains(err.Error(), "missing admin") {
+		t.Fatalf("expected the refusal to be reported, got %v", err)
+	}
+}
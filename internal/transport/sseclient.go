@@ -0,0 +1,276 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// errMalformedEvent is returned for an event stream that does not follow the
+// SSE session protocol.
+var errMalformedEvent = errors.New("transport: malformed event")
+
+// SSECloseError is returned by SSEClientPeer.Receive when the proxy ended
+// the session, with a code from the same range as WebSocket close codes.
+type SSECloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *SSECloseError) Error() string {
+	return fmt.Sprintf("transport: session closed: %d %s", e.Code, e.Reason)
+}
+
+// Unwrap makes an SSECloseError match ErrClosed.
+func (e *SSECloseError) Unwrap() error {
+	return ErrClosed
+}
+
+// SSEClientPeer is a handshake.Peer over an SSE session, seen from the
+// remote. It is what a client uses where WebSockets do not get through.
+type SSEClientPeer struct {
+	client    *http.Client
+	postURL   string
+	sessionID string
+
+	stream  io.ReadCloser
+	cancel  context.CancelFunc
+	inbound chan []byte
+
+	// sendMutex keeps frames in order by posting one at a time.
+	sendMutex sync.Mutex
+
+	// done is closed when the event stream ended; err says why.
+	done chan struct{}
+	err  error
+}
+
+// DialSSE opens an event stream at rawURL with client, or
+// http.DefaultClient if nil. Frames are posted to the same URL with only
+// ?session= as the query. ctx bounds opening the stream, not its lifetime.
+func DialSSE(ctx context.Context, client *http.Client, rawURL string) (*SSEClientPeer, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	postURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	streamCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
+
+	request, err := http.NewRequestWithContext(streamCtx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	request.Header.Set("Accept", "text/event-stream")
+	response, err := client.Do(request)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		response.Body.Close()
+		cancel()
+		return nil, fmt.Errorf(
+			"transport: event stream refused: %s: %s",
+			response.Status,
+			bytes.TrimSpace(body),
+		)
+	}
+
+	reader := bufio.NewReader(response.Body)
+	event, data, err := readEvent(reader)
+	if err == nil && event != sseSessionEvent {
+		err = fmt.Errorf("%w: expected a session event, got %q", errMalformedEvent, event)
+	}
+	if err != nil {
+		response.Body.Close()
+		cancel()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	postURL.RawQuery = url.Values{"session": {data}}.Encode()
+	peer := &SSEClientPeer{
+		client:    client,
+		postURL:   postURL.String(),
+		sessionID: data,
+		stream:    response.Body,
+		cancel:    cancel,
+		inbound:   make(chan []byte),
+		done:      make(chan struct{}),
+	}
+	go peer.readPump(streamCtx, reader)
+	return peer, nil
+}
+
+// SessionID returns the ID the proxy gave the session.
+func (peer *SSEClientPeer) SessionID() string {
+	return peer.sessionID
+}
+
+// Send posts frame and waits for the proxy to receive it.
+func (peer *SSEClientPeer) Send(ctx context.Context, frame []byte) error {
+	peer.sendMutex.Lock()
+	defer peer.sendMutex.Unlock()
+
+	select {
+	case <-peer.done:
+		return peer.err
+	default:
+	}
+
+	request, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		peer.postURL,
+		bytes.NewReader(frame),
+	)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	response, err := peer.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+
+	switch response.StatusCode {
+	case http.StatusNoContent, http.StatusOK:
+		return nil
+	case http.StatusNotFound, http.StatusGone:
+		return ErrClosed
+	case http.StatusRequestEntityTooLarge:
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(frame))
+	default:
+		return fmt.Errorf(
+			"transport: frame refused: %s: %s",
+			response.Status,
+			bytes.TrimSpace(body),
+		)
+	}
+}
+
+// Receive returns the next frame from the event stream. After the proxy
+// ended the session it returns an *SSECloseError. Cancelling ctx leaves the
+// session usable.
+func (peer *SSEClientPeer) Receive(ctx context.Context) ([]byte, error) {
+	select {
+	case frame := <-peer.inbound:
+		return frame, nil
+	case <-peer.done:
+		return nil, peer.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close ends the event stream, which ends the session.
+func (peer *SSEClientPeer) Close() error {
+	peer.cancel()
+	<-peer.done
+	return nil
+}
+
+// readPump is the only goroutine that reads the event stream.
+func (peer *SSEClientPeer) readPump(ctx context.Context, reader *bufio.Reader) {
+	defer peer.stream.Close()
+
+	for {
+		event, data, err := readEvent(reader)
+		if err == nil {
+			err = peer.handleEvent(ctx, event, data)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				err = ErrClosed
+			}
+			peer.err = err
+			close(peer.done)
+			return
+		}
+	}
+}
+
+// handleEvent passes frames on to Receive and turns the close event into the
+// error that ends the stream.
+func (peer *SSEClientPeer) handleEvent(ctx context.Context, event, data string) error {
+	switch event {
+	case sseMessageEvent:
+		frame, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errMalformedEvent, err)
+		}
+		select {
+		case peer.inbound <- frame:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	case sseCloseEvent:
+		codeText, reason, _ := strings.Cut(data, " ")
+		code, err := strconv.Atoi(codeText)
+		if err != nil {
+			return fmt.Errorf("%w: close code %q", errMalformedEvent, codeText)
+		}
+		return &SSECloseError{Code: code, Reason: reason}
+	default:
+		// Unknown events are skipped so that the protocol can grow.
+		return nil
+	}
+}
+
+// readEvent reads the next event from an event stream, skipping comments.
+// An event without a name is a message, as in the SSE specification.
+func readEvent(reader *bufio.Reader) (event, data string, err error) {
+	var dataLines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = fmt.Errorf("%w: %w", ErrClosed, io.ErrUnexpectedEOF)
+			}
+			return "", "", err
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+
+		if line == "" {
+			if event == "" && dataLines == nil {
+				continue
+			}
+			if event == "" {
+				event = sseMessageEvent
+			}
+			return event, strings.Join(dataLines, "\n"), nil
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			dataLines = append(dataLines, value)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto/handshake"
+)
+
+// streamHeaderSize is the length prefix of every frame on a stream.
+const streamHeaderSize = 4
+
+// ErrFrameTooLarge is returned for frames longer than a StreamPeer's maximum
+// frame size, whether sent or received.
+var ErrFrameTooLarge = errors.New("transport: frame too large")
+
+// StreamOption configures a StreamPeer.
+type StreamOption func(*StreamPeer)
+
+// WithMaxFrameSize sets the largest frame a StreamPeer sends or receives. It
+// defaults to handshake.DefaultMaxFrameSize.
+func WithMaxFrameSize(size int) StreamOption {
+	return func(peer *StreamPeer) {
+		peer.maxFrameSize = size
+	}
+}
+
+// WithStreamSendQueue sets how many frames are buffered for the writer. It
+// defaults to DefaultSendQueue.
+func WithStreamSendQueue(size int) StreamOption {
+	return func(peer *StreamPeer) {
+		peer.outbound = make(chan outboundFrame, size)
+	}
+}
+
+// WithStreamWriteTimeout bounds how long a single write may take. A remote
+// that does not read in time has its connection closed. It defaults to
+// DefaultWriteTimeout.
+func WithStreamWriteTimeout(timeout time.Duration) StreamOption {
+	return func(peer *StreamPeer) {
+		peer.writeTimeout = timeout
+	}
+}
+
+// WithStreamObserver reports every written frame to observer.
+func WithStreamObserver(observer PeerObserver) StreamOption {
+	return func(peer *StreamPeer) {
+		peer.observer = observer
+	}
+}
+
+// StreamPeer is a handshake.Peer over a byte stream, such as a TCP or Unix
+// socket connection. Every frame is written as its length, a big-endian
+// uint32, followed by its bytes.
+//
+// Like a WebSocketPeer, it writes through one writer goroutine, so Send may
+// be called concurrently and does not wait for the frame to be written.
+// Receive honours the deadline and cancellation of its context. A Receive
+// interrupted before any of its frame was read leaves the peer usable; one
+// interrupted in the middle of a frame closes the connection, as the stream
+// can no longer be framed.
+type StreamPeer struct {
+	conn         net.Conn
+	reader       *bufio.Reader
+	outbound     chan outboundFrame
+	maxFrameSize int
+	writeTimeout time.Duration
+	observer     PeerObserver
+
+	readMutex sync.Mutex
+
+	// closing asks the writer to flush the queue, and then to half-close
+	// the connection if halfClose is set.
+	closing     chan struct{}
+	closingOnce sync.Once
+	halfClose   bool
+	// writerDone is closed when the writer stopped; writeErr says why it
+	// stopped if it was asked to.
+	writerDone chan struct{}
+	writeErr   error
+
+	// done is closed when the connection is closed for any reason; err says
+	// why.
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+var _ handshake.Closer = (*StreamPeer)(nil)
+
+// NewStreamPeer takes over conn and starts its writer goroutine. The caller
+// must call Close or CloseWithCode when done with the peer.
+func NewStreamPeer(conn net.Conn, options ...StreamOption) *StreamPeer {
+	peer := &StreamPeer{
+		conn:         conn,
+		reader:       bufio.NewReader(conn),
+		outbound:     make(chan outboundFrame, DefaultSendQueue),
+		maxFrameSize: handshake.DefaultMaxFrameSize,
+		writeTimeout: DefaultWriteTimeout,
+		closing:      make(chan struct{}),
+		writerDone:   make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	for _, option := range options {
+		option(peer)
+	}
+
+	go peer.writePump()
+	return peer
+}
+
+// DialStream connects to address on network, "tcp" or "unix" for example,
+// and returns a StreamPeer over the connection.
+func DialStream(
+	ctx context.Context,
+	network, address string,
+	options ...StreamOption,
+) (*StreamPeer, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamPeer(conn, options...), nil
+}
+
+// Send queues frame for the writer. It fails with ErrQueueFull instead of
+// blocking when the remote is not keeping up.
+func (peer *StreamPeer) Send(ctx context.Context, frame []byte) error {
+	if len(frame) > peer.maxFrameSize {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(frame))
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-peer.done:
+		return peer.closedError()
+	case <-peer.closing:
+		return ErrClosed
+	default:
+	}
+
+	outbound := outboundFrame{data: frame, queued: time.Now()}
+	if deadline, ok := ctx.Deadline(); ok {
+		outbound.deadline = deadline
+	}
+	select {
+	case peer.outbound <- outbound:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Queued returns the number of frames waiting for the writer.
+func (peer *StreamPeer) Queued() int {
+	return len(peer.outbound)
+}
+
+// Receive returns the next frame. It returns io.EOF when the remote closed
+// or half-closed the stream after a whole frame.
+func (peer *StreamPeer) Receive(ctx context.Context) ([]byte, error) {
+	peer.readMutex.Lock()
+	defer peer.readMutex.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// Frames left in the buffer must not be returned once closed.
+	select {
+	case <-peer.done:
+		return nil, peer.closedError()
+	default:
+	}
+	deadline, _ := ctx.Deadline()
+	stop := interruptOn(ctx, deadline, peer.conn.SetReadDeadline)
+	defer stop()
+
+	var header [streamHeaderSize]byte
+	if n, err := io.ReadFull(peer.reader, header[:]); err != nil {
+		if n == 0 && errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, peer.fail(ctx, n == 0, err)
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > uint32(peer.maxFrameSize) {
+		err := fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, size)
+		peer.shutdown(err)
+		return nil, err
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(peer.reader, frame); err != nil {
+		return nil, peer.fail(ctx, false, err)
+	}
+	return frame, nil
+}
+
+// CloseWrite writes the frames already queued and tells the remote that no
+// more frames follow, so that its Receive returns io.EOF, while frames from
+// the remote can still be received. It fails with errors.ErrUnsupported for
+// connections that cannot be half-closed; TCP and Unix connections can.
+func (peer *StreamPeer) CloseWrite() error {
+	if _, ok := peer.conn.(interface{ CloseWrite() error }); !ok {
+		return errors.ErrUnsupported
+	}
+	peer.closingOnce.Do(func() {
+		peer.halfClose = true
+		close(peer.closing)
+	})
+	<-peer.writerDone
+	select {
+	case <-peer.done:
+		return peer.closedError()
+	default:
+		return peer.writeErr
+	}
+}
+
+// Close closes the connection once the frames already queued are written.
+// A stream cannot carry a reason, so reason is discarded; it is there for the
+// router, which closes peers that were replaced by a newer connection.
+func (peer *StreamPeer) Close(reason string) error {
+	return peer.CloseWithCode(CloseReplaced, reason)
+}
+
+// CloseWithCode writes the frames already queued and closes the connection.
+// Frames that cannot be written within the write timeout are discarded. A
+// stream cannot carry a close code or reason either, so both are discarded;
+// CloseWithCode is there so that StreamPeers are closed like the other peers
+// when the proxy shuts down.
+func (peer *StreamPeer) CloseWithCode(code int, reason string) error {
+	peer.closingOnce.Do(func() {
+		close(peer.closing)
+	})
+	<-peer.writerDone
+	peer.shutdown(ErrClosed)
+	return nil
+}
+
+// shutdown records why the connection ended and closes it, once.
+func (peer *StreamPeer) shutdown(err error) {
+	peer.closeOnce.Do(func() {
+		peer.err = err
+		close(peer.done)
+		_ = peer.conn.Close()
+	})
+}
+
+func (peer *StreamPeer) closedError() error {
+	if errors.Is(peer.err, ErrClosed) {
+		return peer.err
+	}
+	return fmt.Errorf("%w: %w", ErrClosed, peer.err)
+}
+
+// writePump is the only goroutine that writes to the connection.
+func (peer *StreamPeer) writePump() {
+	defer close(peer.writerDone)
+
+	for {
+		select {
+		case frame := <-peer.outbound:
+			now := time.Now()
+			deadline := now.Add(peer.writeTimeout)
+			if !frame.deadline.IsZero() && frame.deadline.Before(deadline) {
+				deadline = frame.deadline
+			}
+			if !deadline.After(now) {
+				// The sender has given up on the frame; writing it anyway
+				// would time out and break the connection for every sender.
+				continue
+			}
+			_ = peer.conn.SetWriteDeadline(deadline)
+			if err := peer.write(frame); err != nil {
+				peer.shutdown(err)
+				return
+			}
+		case <-peer.closing:
+			peer.writeErr = peer.drain()
+			return
+		case <-peer.done:
+			return
+		}
+	}
+}
+
+// write writes frame with its length and tells the observer how long it
+// took.
+func (peer *StreamPeer) write(frame outboundFrame) error {
+	start := time.Now()
+	buf := make([]byte, 0, streamHeaderSize+len(frame.data))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(frame.data)))
+	buf = append(buf, frame.data...)
+	if _, err := peer.conn.Write(buf); err != nil {
+		return err
+	}
+	if peer.observer != nil {
+		peer.observer.FrameWritten(len(frame.data), start.Sub(frame.queued), time.Since(start))
+	}
+	return nil
+}
+
+// drain writes the queued frames within one write timeout, and half-closes
+// the connection if asked to. A connection that fails is closed.
+func (peer *StreamPeer) drain() error {
+	_ = peer.conn.SetWriteDeadline(time.Now().Add(peer.writeTimeout))
+	for len(peer.outbound) > 0 {
+		if err := peer.write(<-peer.outbound); err != nil {
+			peer.shutdown(err)
+			return err
+		}
+	}
+	if peer.halfClose {
+		if err := peer.conn.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+			peer.shutdown(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// fail turns an error from a read into the one returned to the caller.
+// Unless intact, part of a frame was read and the stream is closed.
+func (peer *StreamPeer) fail(ctx context.Context, intact bool, err error) error {
+	ctxErr := ctx.Err()
+	if ctxErr == nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			// The context's deadline passed just before the context noticed.
+			ctxErr = context.DeadlineExceeded
+		}
+	}
+	switch {
+	case ctxErr != nil && intact:
+		return ctxErr
+	case ctxErr != nil:
+		err = fmt.Errorf("%w: interrupted mid-frame: %w", ErrClosed, ctxErr)
+	case errors.Is(err, net.ErrClosed):
+		err = ErrClosed
+	case !intact:
+		err = fmt.Errorf("%w: %w", ErrClosed, err)
+	}
+	if !intact {
+		peer.shutdown(err)
+	}
+	return err
+}
+
+// interruptOn sets the connection deadline set by setDeadline to deadline,
+// or no deadline if zero, and to now when ctx is cancelled, so that a
+// blocked read or write returns. The returned function stops watching ctx
+// and must be called before the next read or write.
+func interruptOn(
+	ctx context.Context,
+	deadline time.Time,
+	setDeadline func(time.Time) error,
+) func() {
+	_ = setDeadline(deadline)
+
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		_ = setDeadline(time.Now())
+		close(interrupted)
+	})
+	return func() {
+		if !stop() {
+			<-interrupted
+		}
+	}
+}
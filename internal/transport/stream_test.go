@@ -0,0 +1,327 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newStreamPair returns both ends of a connection on network, "tcp" or
+// "unix", as StreamPeers.
+func newStreamPair(
+	t *testing.T,
+	network string,
+	options ...StreamOption,
+) (dialed, accepted *StreamPeer) {
+	t.Helper()
+
+	address := "127.0.0.1:0"
+	if network == "unix" {
+		address = filepath.Join(t.TempDir(), "peer.sock")
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Errorf("accept: %v", err)
+		}
+		conns <- conn
+	}()
+
+	dialed, err = DialStream(context.Background(), network, listener.Addr().String(), options...)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { dialed.Close("") })
+	accepted = NewStreamPeer(<-conns, options...)
+	t.Cleanup(func() { accepted.Close("") })
+	return dialed, accepted
+}
+
+func TestStreamPeerFrames(t *testing.T) {
+	for _, network := range []string{"tcp", "unix"} {
+		t.Run(network, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			dialed, accepted := newStreamPair(t, network)
+			frames := []string{"hello", "", strings.Repeat("x", 60_000)}
+			go func() {
+				for _, frame := range frames {
+					if err := dialed.Send(ctx, []byte(frame)); err != nil {
+						t.Errorf("send: %v", err)
+						return
+					}
+				}
+			}()
+			for _, want := range frames {
+				got, err := accepted.Receive(ctx)
+				if err != nil {
+					t.Fatalf("receive: %v", err)
+				}
+				if string(got) != want {
+					t.Fatalf("received %d bytes, want %d", len(got), len(want))
+				}
+			}
+
+			if err := accepted.Send(ctx, []byte("reply")); err != nil {
+				t.Fatalf("send back: %v", err)
+			}
+			if got, err := dialed.Receive(ctx); err != nil || string(got) != "reply" {
+				t.Fatalf("received %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestStreamPeerConcurrentSends(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const senders, framesPerSender = 50, 20
+	dialed, accepted := newStreamPair(t, "unix", WithStreamSendQueue(senders*framesPerSender))
+
+	var wg sync.WaitGroup
+	for sender := range senders {
+		wg.Go(func() {
+			for i := range framesPerSender {
+				frame := fmt.Appendf(nil, "%d %d %s", sender, i, strings.Repeat("x", 4096))
+				if err := dialed.Send(ctx, frame); err != nil {
+					t.Errorf("send: %v", err)
+					return
+				}
+			}
+		})
+	}
+
+	next := make(map[int]int)
+	for range senders * framesPerSender {
+		frame, err := accepted.Receive(ctx)
+		if err != nil {
+			t.Fatalf("receive: %v", err)
+		}
+		var sender, i int
+		var padding string
+		if _, err := fmt.Sscanf(string(frame), "%d %d %s", &sender, &i, &padding); err != nil {
+			t.Fatalf("frame %.20q... is corrupt: %v", frame, err)
+		}
+		if i != next[sender] {
+			t.Fatalf("sender %d: got frame %d, want %d", sender, i, next[sender])
+		}
+		next[sender]++
+	}
+	wg.Wait()
+}
+
+func TestStreamPeerMaxFrameSize(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dialed, accepted := newStreamPair(t, "tcp", WithMaxFrameSize(16))
+	if err := dialed.Send(ctx, make([]byte, 17)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("sending too large a frame: %v", err)
+	}
+
+	// Nothing was written, so the stream is still usable.
+	if err := dialed.Send(ctx, []byte("fits")); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if got, err := accepted.Receive(ctx); err != nil || string(got) != "fits" {
+		t.Fatalf("received %q, %v", got, err)
+	}
+
+	// A remote with a larger limit gets its connection closed.
+	if _, err := dialed.conn.Write(append([]byte{0, 0, 0, 17}, make([]byte, 17)...)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := accepted.Receive(ctx); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("receiving too large a frame: %v", err)
+	}
+	if _, err := accepted.Receive(ctx); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed after too large a frame, got %v", err)
+	}
+}
+
+func TestStreamPeerHalfClose(t *testing.T) {
+	for _, network := range []string{"tcp", "unix"} {
+		t.Run(network, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			dialed, accepted := newStreamPair(t, network)
+			if err := dialed.Send(ctx, []byte("last")); err != nil {
+				t.Fatal(err)
+			}
+			if err := dialed.CloseWrite(); err != nil {
+				t.Fatalf("CloseWrite: %v", err)
+			}
+
+			if got, err := accepted.Receive(ctx); err != nil || string(got) != "last" {
+				t.Fatalf("received %q, %v", got, err)
+			}
+			if _, err := accepted.Receive(ctx); !errors.Is(err, io.EOF) {
+				t.Fatalf("expected io.EOF after the remote half-closed, got %v", err)
+			}
+
+			// The other direction still works.
+			if err := accepted.Send(ctx, []byte("answer")); err != nil {
+				t.Fatalf("send after the remote half-closed: %v", err)
+			}
+			if got, err := dialed.Receive(ctx); err != nil || string(got) != "answer" {
+				t.Fatalf("received %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestStreamPeerWriteTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The remote never reads, so the socket buffers fill up.
+	dialed, _ := newStreamPair(t, "unix", WithStreamWriteTimeout(50*time.Millisecond))
+	frame := make([]byte, 60_000)
+	for {
+		err := dialed.Send(ctx, frame)
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, ErrQueueFull) {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if !errors.Is(err, ErrClosed) || errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected ErrClosed for a stalled remote, got %v", err)
+		}
+		break
+	}
+	if err := dialed.Send(ctx, []byte("again")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed after the write timed out, got %v", err)
+	}
+}
+
+func TestStreamPeerQueueFull(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The remote never reads, so the socket buffers fill up, the writer
+	// blocks and the queue fills behind it.
+	dialed, _ := newStreamPair(t, "unix", WithStreamSendQueue(4))
+
+	frame := make([]byte, 64*1024)
+	for range 10_000 {
+		err := dialed.Send(ctx, frame)
+		if errors.Is(err, ErrQueueFull) {
+			if queued := dialed.Queued(); queued != 4 {
+				t.Fatalf("Queued() = %d with a full queue of 4", queued)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+	t.Fatal("Send never reported a full queue")
+}
+
+func TestStreamPeerCloseWritesQueuedFrames(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dialed, accepted := newStreamPair(t, "tcp")
+	for _, frame := range []string{"one", "two", "three"} {
+		if err := dialed.Send(ctx, []byte(frame)); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+	if err := dialed.CloseWithCode(1012, "restarting"); err != nil {
+		t.Fatalf("CloseWithCode: %v", err)
+	}
+	if err := dialed.Send(ctx, []byte("late")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed after closing, got %v", err)
+	}
+
+	for _, want := range []string{"one", "two", "three"} {
+		if got, err := accepted.Receive(ctx); err != nil || string(got) != want {
+			t.Fatalf("received %q, %v, want %q", got, err, want)
+		}
+	}
+	if _, err := accepted.Receive(ctx); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected io.EOF after the remote closed, got %v", err)
+	}
+}
+
+func TestStreamPeerTruncatedFrame(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dialed, accepted := newStreamPair(t, "tcp")
+	if _, err := dialed.conn.Write([]byte{0, 0, 0, 10, 'a'}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dialed.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := accepted.Receive(ctx); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected io.ErrUnexpectedEOF for a truncated frame, got %v", err)
+	}
+}
+
+func TestStreamPeerCancellation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dialed, accepted := newStreamPair(t, "unix")
+
+	receiveCtx, cancelReceive := context.WithCancel(ctx)
+	received := make(chan error, 1)
+	go func() {
+		_, err := accepted.Receive(receiveCtx)
+		received <- err
+	}()
+	cancelReceive()
+	if err := <-received; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	timeoutCtx, cancelTimeout := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancelTimeout()
+	if _, err := accepted.Receive(timeoutCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// Nothing was read, so the stream is still usable.
+	if err := dialed.Send(ctx, []byte("later")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := accepted.Receive(ctx); err != nil || string(got) != "later" {
+		t.Fatalf("received %q, %v after cancelled receives", got, err)
+	}
+
+	// Cancelling in the middle of a frame closes the stream.
+	if _, err := dialed.conn.Write([]byte{0, 0, 0, 10, 'a'}); err != nil {
+		t.Fatal(err)
+	}
+	timeoutCtx, cancelTimeout = context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancelTimeout()
+	if _, err := accepted.Receive(timeoutCtx); !errors.Is(err, ErrClosed) ||
+		!errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected ErrClosed and context.DeadlineExceeded, got %v", err)
+	}
+	if err := accepted.Send(ctx, []byte("too late")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed after an interrupted frame, got %v", err)
+	}
+}
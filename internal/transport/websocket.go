@@ -0,0 +1,312 @@
+// Package transport implements handshake.Peer over network connections.
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Dsek-LTH/decidr/internal/crypto/handshake"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// DefaultSendQueue is the number of frames a WebSocketPeer buffers for
+	// its writer before Send fails with ErrQueueFull.
+	DefaultSendQueue = 256
+
+	// DefaultWriteTimeout bounds every write unless the sender's context
+	// has an earlier deadline.
+	DefaultWriteTimeout = 10 * time.Second
+
+	// DefaultPingInterval is how often a WebSocketPeer pings the remote.
+	DefaultPingInterval = 30 * time.Second
+
+	// DefaultPongTimeout is how long a WebSocketPeer waits for any frame,
+	// pongs included, before it considers the remote dead.
+	DefaultPongTimeout = 2 * DefaultPingInterval
+
+	// CloseReplaced is the WebSocket close code sent by Close, which the
+	// router calls when a newer connection takes over the peer's ID.
+	CloseReplaced = 4000
+)
+
+var (
+	// ErrQueueFull is returned by Send when the remote reads more slowly than
+	// frames are sent to it and the send queue is full.
+	ErrQueueFull = errors.New("transport: send queue full")
+
+	// ErrClosed is returned by Send and Receive after the connection closed.
+	ErrClosed = errors.New("transport: connection closed")
+)
+
+// WebSocketOption configures a WebSocketPeer.
+type WebSocketOption func(*WebSocketPeer)
+
+// WithSendQueue sets how many frames are buffered for the writer.
+func WithSendQueue(size int) WebSocketOption {
+	return func(peer *WebSocketPeer) {
+		peer.outbound = make(chan outboundFrame, size)
+	}
+}
+
+// WithWriteTimeout bounds how long a single write may take.
+func WithWriteTimeout(timeout time.Duration) WebSocketOption {
+	return func(peer *WebSocketPeer) {
+		peer.writeTimeout = timeout
+	}
+}
+
+// WithKeepalive sets how often the remote is pinged and how long it may stay
+// silent before the connection is closed.
+func WithKeepalive(pingInterval, pongTimeout time.Duration) WebSocketOption {
+	return func(peer *WebSocketPeer) {
+		peer.pingInterval = pingInterval
+		peer.pongTimeout = pongTimeout
+	}
+}
+
+// WithReadLimit sets the largest frame Receive accepts. It defaults to
+// handshake.DefaultMaxFrameSize.
+func WithReadLimit(limit int64) WebSocketOption {
+	return func(peer *WebSocketPeer) {
+		peer.readLimit = limit
+	}
+}
+
+// PeerObserver is told about the frames a WebSocketPeer writes, e.g. to
+// export metrics. It is called by the peer's writer and must not block.
+type PeerObserver interface {
+	// FrameWritten is called for every frame written, with how long it waited
+	// in the send queue and how long the write itself took.
+	FrameWritten(size int, queued, write time.Duration)
+}
+
+// WithObserver reports every written frame to observer.
+func WithObserver(observer PeerObserver) WebSocketOption {
+	return func(peer *WebSocketPeer) {
+		peer.observer = observer
+	}
+}
+
+type outboundFrame struct {
+	data []byte
+	// queued is when Send queued the frame.
+	queued time.Time
+	// deadline is the sender's context deadline, if it had one.
+	deadline time.Time
+}
+
+// WebSocketPeer is a handshake.Peer over a WebSocket connection. Every write
+// goes through one writer goroutine, so Send may be called concurrently, as
+// the router does when many clients talk to one admin. Send does not wait
+// for the frame to be written.
+//
+// Pongs are only processed while Receive is being called, so the owner of a
+// WebSocketPeer must keep receiving for the keepalive to work.
+type WebSocketPeer struct {
+	conn *websocket.Conn
+
+	outbound     chan outboundFrame
+	writeTimeout time.Duration
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	readLimit    int64
+	observer     PeerObserver
+
+	// closing asks the writer to flush the queue and send closeMessage.
+	closing      chan struct{}
+	closingOnce  sync.Once
+	closeMessage []byte
+
+	// done is closed when the connection is closed for any reason; err says
+	// why.
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+var _ handshake.Closer = (*WebSocketPeer)(nil)
+
+// NewWebSocketPeer takes over conn and starts its writer goroutine. The
+// caller must call Close or CloseWithCode when done with the peer.
+func NewWebSocketPeer(conn *websocket.Conn, options ...WebSocketOption) *WebSocketPeer {
+	peer := &WebSocketPeer{
+		conn:         conn,
+		outbound:     make(chan outboundFrame, DefaultSendQueue),
+		writeTimeout: DefaultWriteTimeout,
+		pingInterval: DefaultPingInterval,
+		pongTimeout:  DefaultPongTimeout,
+		readLimit:    handshake.DefaultMaxFrameSize,
+		closing:      make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	for _, option := range options {
+		option(peer)
+	}
+
+	conn.SetReadLimit(peer.readLimit)
+	_ = conn.SetReadDeadline(time.Now().Add(peer.pongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(peer.pongTimeout))
+	})
+
+	go peer.writePump()
+	return peer
+}
+
+// Send queues frame for the writer. It fails with ErrQueueFull instead of
+// blocking when the remote is not keeping up.
+func (peer *WebSocketPeer) Send(ctx context.Context, frame []byte) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-peer.done:
+		return peer.closedError()
+	case <-peer.closing:
+		return ErrClosed
+	default:
+	}
+
+	outbound := outboundFrame{data: frame, queued: time.Now()}
+	if deadline, ok := ctx.Deadline(); ok {
+		outbound.deadline = deadline
+	}
+	select {
+	case peer.outbound <- outbound:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Queued returns the number of frames waiting for the writer.
+func (peer *WebSocketPeer) Queued() int {
+	return len(peer.outbound)
+}
+
+// Receive returns the next message. Cancelling ctx interrupts the read, after
+// which the connection can no longer be used.
+func (peer *WebSocketPeer) Receive(ctx context.Context) ([]byte, error) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = peer.conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	_, frame, err := peer.conn.ReadMessage()
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		peer.shutdown(err)
+		return nil, err
+	}
+	_ = peer.conn.SetReadDeadline(time.Now().Add(peer.pongTimeout))
+	return frame, nil
+}
+
+// Close closes the connection with CloseReplaced and reason.
+func (peer *WebSocketPeer) Close(reason string) error {
+	return peer.CloseWithCode(CloseReplaced, reason)
+}
+
+// CloseWithCode writes the frames already queued, sends a close frame with
+// code and reason and closes the connection. Frames that cannot be written
+// within the write timeout are discarded.
+func (peer *WebSocketPeer) CloseWithCode(code int, reason string) error {
+	peer.closingOnce.Do(func() {
+		peer.closeMessage = websocket.FormatCloseMessage(code, reason)
+		close(peer.closing)
+	})
+	<-peer.done
+	return nil
+}
+
+// shutdown records why the connection ended and closes it, once.
+func (peer *WebSocketPeer) shutdown(err error) {
+	peer.closeOnce.Do(func() {
+		peer.err = err
+		close(peer.done)
+		_ = peer.conn.Close()
+	})
+}
+
+func (peer *WebSocketPeer) closedError() error {
+	if errors.Is(peer.err, ErrClosed) {
+		return peer.err
+	}
+	return fmt.Errorf("%w: %w", ErrClosed, peer.err)
+}
+
+// writePump is the only goroutine that writes data and pings to the
+// connection.
+func (peer *WebSocketPeer) writePump() {
+	ticker := time.NewTicker(peer.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case frame := <-peer.outbound:
+			now := time.Now()
+			deadline := now.Add(peer.writeTimeout)
+			if !frame.deadline.IsZero() && frame.deadline.Before(deadline) {
+				deadline = frame.deadline
+			}
+			if !deadline.After(now) {
+				// The sender has given up on the frame; writing it anyway
+				// would time out and break the connection for every sender.
+				continue
+			}
+			_ = peer.conn.SetWriteDeadline(deadline)
+			if err := peer.write(frame); err != nil {
+				peer.shutdown(err)
+				return
+			}
+		case <-ticker.C:
+			err := peer.conn.WriteControl(
+				websocket.PingMessage,
+				nil,
+				time.Now().Add(peer.writeTimeout),
+			)
+			if err != nil {
+				peer.shutdown(err)
+				return
+			}
+		case <-peer.closing:
+			peer.drain()
+			return
+		case <-peer.done:
+			return
+		}
+	}
+}
+
+// write writes frame and tells the observer how long it took.
+func (peer *WebSocketPeer) write(frame outboundFrame) error {
+	start := time.Now()
+	if err := peer.conn.WriteMessage(websocket.BinaryMessage, frame.data); err != nil {
+		return err
+	}
+	if peer.observer != nil {
+		peer.observer.FrameWritten(len(frame.data), start.Sub(frame.queued), time.Since(start))
+	}
+	return nil
+}
+
+// drain writes the queued frames and the close message within one write
+// timeout and closes the connection.
+func (peer *WebSocketPeer) drain() {
+	deadline := time.Now().Add(peer.writeTimeout)
+	_ = peer.conn.SetWriteDeadline(deadline)
+	for len(peer.outbound) > 0 {
+		if err := peer.write(<-peer.outbound); err != nil {
+			peer.shutdown(err)
+			return
+		}
+	}
+
+	_ = peer.conn.WriteControl(websocket.CloseMessage, peer.closeMessage, deadline)
+	peer.shutdown(ErrClosed)
+}
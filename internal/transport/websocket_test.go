@@ -0,0 +1,237 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newWebSocketPair returns the proxy's end of a WebSocket connection as a
+// WebSocketPeer and the remote end as a plain connection.
+func newWebSocketPair(
+	t *testing.T,
+	options ...WebSocketOption,
+) (*WebSocketPeer, *websocket.Conn) {
+	t.Helper()
+
+	peers := make(chan *WebSocketPeer, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		peers <- NewWebSocketPeer(conn, options...)
+	}))
+	t.Cleanup(server.Close)
+
+	remote, _, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(server.URL, "http"),
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { remote.Close() })
+
+	peer := <-peers
+	t.Cleanup(func() { peer.CloseWithCode(websocket.CloseNormalClosure, "") })
+	return peer, remote
+}
+
+func TestWebSocketPeerConcurrentSends(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const senders, framesPerSender = 300, 10
+	peer, remote := newWebSocketPair(t, WithSendQueue(senders*framesPerSender))
+
+	var wg sync.WaitGroup
+	for sender := range senders {
+		wg.Go(func() {
+			for i := range framesPerSender {
+				frame := fmt.Appendf(
+					nil,
+					"voter-%d frame-%d %s",
+					sender,
+					i,
+					strings.Repeat("x", 512),
+				)
+				if err := peer.Send(ctx, frame); err != nil {
+					t.Errorf("send: %v", err)
+					return
+				}
+			}
+		})
+	}
+
+	next := make(map[int]int)
+	for range senders * framesPerSender {
+		_, frame, err := remote.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		var sender, i int
+		var padding string
+		if _, err := fmt.Sscanf(
+			string(frame),
+			"voter-%d frame-%d %s",
+			&sender,
+			&i,
+			&padding,
+		); err != nil ||
+			len(padding) != 512 {
+			t.Fatalf("corrupt frame %.40q: %v", frame, err)
+		}
+		if i != next[sender] {
+			t.Fatalf("voter-%d: got frame %d, want %d", sender, i, next[sender])
+		}
+		next[sender]++
+	}
+	wg.Wait()
+}
+
+func TestWebSocketPeerQueueFull(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The remote never reads, so the socket buffers fill up, the writer
+	// blocks and the queue fills behind it.
+	peer, _ := newWebSocketPair(t, WithSendQueue(4))
+
+	frame := make([]byte, 64*1024)
+	for range 10_000 {
+		err := peer.Send(ctx, frame)
+		if errors.Is(err, ErrQueueFull) {
+			if queued := peer.Queued(); queued != 4 {
+				t.Fatalf("Queued() = %d with a full queue of 4", queued)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+	t.Fatal("Send never reported a full queue")
+}
+
+// writeObserver collects the sizes of written frames.
+type writeObserver chan int
+
+func (o writeObserver) FrameWritten(size int, queued, write time.Duration) {
+	if queued < 0 || write < 0 {
+		panic("negative duration")
+	}
+	o <- size
+}
+
+func TestWebSocketPeerObserver(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	observer := make(writeObserver, 2)
+	peer, remote := newWebSocketPair(t, WithObserver(observer))
+
+	for _, frame := range []string{"ballot", "result"} {
+		if err := peer.Send(ctx, []byte(frame)); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		if _, _, err := remote.ReadMessage(); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+	}
+	for range 2 {
+		select {
+		case size := <-observer:
+			if size != 6 {
+				t.Fatalf("observed a %d byte frame, want 6", size)
+			}
+		case <-ctx.Done():
+			t.Fatal("the observer was not told about a written frame")
+		}
+	}
+}
+
+func TestWebSocketPeerKeepalive(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A remote that reads answers pings and stays connected.
+	peer, remote := newWebSocketPair(t, WithKeepalive(20*time.Millisecond, 100*time.Millisecond))
+	go func() {
+		for {
+			if _, _, err := remote.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	waitCtx, waitCancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer waitCancel()
+	if _, err := peer.Receive(waitCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context to expire first, got %v", err)
+	}
+
+	// A remote that never reads never answers pings and is dropped.
+	peer, _ = newWebSocketPair(t, WithKeepalive(20*time.Millisecond, 100*time.Millisecond))
+	if _, err := peer.Receive(ctx); err == nil || ctx.Err() != nil {
+		t.Fatalf("expected the silent remote to time out, got %v", err)
+	}
+	if err := peer.Send(ctx, []byte("late")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed after the timeout, got %v", err)
+	}
+}
+
+func TestWebSocketPeerReadLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	peer, remote := newWebSocketPair(t, WithReadLimit(16))
+	if err := remote.WriteMessage(websocket.BinaryMessage, make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Receive(ctx); err != nil {
+		t.Fatalf("frame at the limit: %v", err)
+	}
+
+	if err := remote.WriteMessage(websocket.BinaryMessage, make([]byte, 17)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Receive(ctx); !errors.Is(err, websocket.ErrReadLimit) {
+		t.Fatalf("expected ErrReadLimit, got %v", err)
+	}
+}
+
+func TestWebSocketPeerClose(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Frames queued before the close are written before the close frame.
+	peer, remote := newWebSocketPair(t)
+	if err := peer.Send(ctx, []byte("fatal error")); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.Close("client connected elsewhere"); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.Send(ctx, []byte("late")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed after Close, got %v", err)
+	}
+
+	if _, frame, err := remote.ReadMessage(); err != nil || string(frame) != "fatal error" {
+		t.Fatalf("read %q, %v before the close frame", frame, err)
+	}
+	_, _, err := remote.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != CloseReplaced ||
+		closeErr.Text != "client connected elsewhere" {
+		t.Fatalf("expected close %d with the reason, got %v", CloseReplaced, err)
+	}
+}